@@ -0,0 +1,315 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+// Access log formats.
+const (
+	// AccessLogCommon is Common Log Format followed by host, client ID and
+	// duration in milliseconds.
+	AccessLogCommon = "common"
+	// AccessLogCombined is Combined Log Format followed by host, client ID
+	// and duration in milliseconds.
+	AccessLogCombined = "combined"
+	// AccessLogJSON writes entries as JSON objects one per line.
+	AccessLogJSON = "json"
+)
+
+// AccessLogEntry describes a single public HTTP request or TCP connection.
+type AccessLogEntry struct {
+	Time time.Time
+	// Protocol is the tunnel protocol i.e. http, tcp, sni.
+	Protocol   string
+	Client     id.ID
+	RemoteAddr string
+	// Host is HTTP request host or address public connection was accepted
+	// on.
+	Host string
+	// Method, Path, Proto, Status, User, Referer and UserAgent are set for
+	// HTTP requests only.
+	Method    string
+	Path      string
+	Proto     string
+	Status    int
+	User      string
+	Referer   string
+	UserAgent string
+	// BytesIn specifies number of bytes received from the remote address,
+	// for HTTP requests it's the body size.
+	BytesIn int64
+	// BytesOut specifies number of bytes sent to the remote address, for
+	// HTTP requests it's the body size.
+	BytesOut int64
+	Duration time.Duration
+}
+
+// AccessLog writes access log entries to a writer.
+type AccessLog struct {
+	w      io.Writer
+	format string
+	mu     sync.Mutex
+}
+
+// NewAccessLog creates AccessLog writing to w in a given format, if format is
+// empty AccessLogCommon is used.
+func NewAccessLog(w io.Writer, format string) (*AccessLog, error) {
+	switch format {
+	case "":
+		format = AccessLogCommon
+	case AccessLogCommon, AccessLogCombined, AccessLogJSON:
+		// ok
+	default:
+		return nil, fmt.Errorf("unknown access log format %q", format)
+	}
+
+	return &AccessLog{
+		w:      w,
+		format: format,
+	}, nil
+}
+
+// Log writes a single entry.
+func (l *AccessLog) Log(e *AccessLogEntry) error {
+	var (
+		b   []byte
+		err error
+	)
+	if l.format == AccessLogJSON {
+		b, err = l.json(e)
+		if err != nil {
+			return err
+		}
+	} else {
+		b = l.text(e)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, err = l.w.Write(b)
+	return err
+}
+
+func (l *AccessLog) text(e *AccessLogEntry) []byte {
+	var b bytes.Buffer
+
+	host, _, err := net.SplitHostPort(e.RemoteAddr)
+	if err != nil {
+		host = e.RemoteAddr
+	}
+
+	var request string
+	if e.Method != "" {
+		request = e.Method + " " + e.Path + " " + e.Proto
+	} else {
+		request = e.Protocol + " " + e.Host
+	}
+
+	fmt.Fprintf(&b, "%s - %s [%s] %q %s %d",
+		orDash(host),
+		orDash(e.User),
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		request,
+		orDash(statusText(e.Status)),
+		e.BytesOut,
+	)
+	if l.format == AccessLogCombined {
+		fmt.Fprintf(&b, " %q %q", orDash(e.Referer), orDash(e.UserAgent))
+	}
+	fmt.Fprintf(&b, " %s %s %d\n",
+		orDash(e.Host),
+		orDash(clientText(e.Client)),
+		e.Duration.Nanoseconds()/int64(time.Millisecond),
+	)
+
+	return b.Bytes()
+}
+
+func (l *AccessLog) json(e *AccessLogEntry) ([]byte, error) {
+	b, err := json.Marshal(struct {
+		Time       time.Time `json:"time"`
+		Protocol   string    `json:"protocol"`
+		Client     string    `json:"client,omitempty"`
+		RemoteAddr string    `json:"remote_addr"`
+		Host       string    `json:"host"`
+		Method     string    `json:"method,omitempty"`
+		Path       string    `json:"path,omitempty"`
+		Proto      string    `json:"proto,omitempty"`
+		Status     int       `json:"status,omitempty"`
+		User       string    `json:"user,omitempty"`
+		Referer    string    `json:"referer,omitempty"`
+		UserAgent  string    `json:"user_agent,omitempty"`
+		BytesIn    int64     `json:"bytes_in"`
+		BytesOut   int64     `json:"bytes_out"`
+		Duration   float64   `json:"duration_ms"`
+	}{
+		Time:       e.Time,
+		Protocol:   e.Protocol,
+		Client:     clientText(e.Client),
+		RemoteAddr: e.RemoteAddr,
+		Host:       e.Host,
+		Method:     e.Method,
+		Path:       e.Path,
+		Proto:      e.Proto,
+		Status:     e.Status,
+		User:       e.User,
+		Referer:    e.Referer,
+		UserAgent:  e.UserAgent,
+		BytesIn:    e.BytesIn,
+		BytesOut:   e.BytesOut,
+		Duration:   e.Duration.Seconds() * 1000,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// accessLogProtocol returns protocol of a connection proxied with msg, SNI
+// connections are distinguished by the tunnel host.
+func accessLogProtocol(msg *proto.ControlMessage) string {
+	if msg.TunnelHost != "" {
+		return proto.SNI
+	}
+	return msg.ForwardedProto
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func statusText(status int) string {
+	if status == 0 {
+		return ""
+	}
+	return strconv.Itoa(status)
+}
+
+func clientText(identifier id.ID) string {
+	if identifier == (id.ID{}) {
+		return ""
+	}
+	return identifier.String()
+}
+
+// RotatingFile is io.WriteCloser appending to a file, when the file would
+// exceed max size it's renamed to path.1, older files are shifted to path.2
+// and so on, files exceeding max backups are removed.
+type RotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// NewRotatingFile opens file at path for appending. If maxSize is 0 the file
+// is never rotated.
+func NewRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	f := &RotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.f = file
+	f.size = info.Size()
+	return nil
+}
+
+// Write writes p to the file rotating it if needed.
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.f == nil {
+		return 0, os.ErrClosed
+	}
+
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil && f.f == nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.f.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *RotatingFile) rotate() error {
+	if err := f.f.Close(); err != nil {
+		return err
+	}
+	f.f = nil
+
+	var err error
+	if f.maxBackups > 0 {
+		os.Remove(f.backup(f.maxBackups))
+		for i := f.maxBackups - 1; i > 0; i-- {
+			os.Rename(f.backup(i), f.backup(i+1))
+		}
+		err = os.Rename(f.path, f.backup(1))
+	} else {
+		err = os.Remove(f.path)
+	}
+
+	// keep writing to the old file if it could not be moved
+	if oerr := f.open(); oerr != nil {
+		return oerr
+	}
+	return err
+}
+
+func (f *RotatingFile) backup(i int) string {
+	return f.path + "." + strconv.Itoa(i)
+}
+
+// Close closes the file.
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.f == nil {
+		return nil
+	}
+	err := f.f.Close()
+	f.f = nil
+	return err
+}
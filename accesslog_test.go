@@ -0,0 +1,142 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+)
+
+func TestAccessLog(t *testing.T) {
+	t.Parallel()
+
+	e := &AccessLogEntry{
+		Time:       time.Date(2017, time.March, 1, 10, 20, 30, 0, time.UTC),
+		Protocol:   "http",
+		Client:     id.New([]byte("client")),
+		RemoteAddr: "192.0.2.1:1234",
+		Host:       "example.com",
+		Method:     "GET",
+		Path:       "/some/path?q=1",
+		Proto:      "HTTP/1.1",
+		Status:     200,
+		UserAgent:  "curl",
+		BytesIn:    10,
+		BytesOut:   20,
+		Duration:   1500 * time.Millisecond,
+	}
+	client := id.New([]byte("client")).String()
+
+	tests := []struct {
+		format   string
+		expected string
+	}{
+		{
+			AccessLogCommon,
+			`192.0.2.1 - - [01/Mar/2017:10:20:30 +0000] "GET /some/path?q=1 HTTP/1.1" 200 20 example.com ` + client + " 1500\n",
+		},
+		{
+			AccessLogCombined,
+			`192.0.2.1 - - [01/Mar/2017:10:20:30 +0000] "GET /some/path?q=1 HTTP/1.1" 200 20 "-" "curl" example.com ` + client + " 1500\n",
+		},
+	}
+
+	for _, tt := range tests {
+		var b bytes.Buffer
+		l, err := NewAccessLog(&b, tt.format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Log(e); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != tt.expected {
+			t.Errorf("%s: expected %q got %q", tt.format, tt.expected, b.String())
+		}
+	}
+
+	var b bytes.Buffer
+	l, err := NewAccessLog(&b, AccessLogJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Log(&AccessLogEntry{
+		Protocol:   "tcp",
+		RemoteAddr: "192.0.2.1:1234",
+		Host:       "0.0.0.0:2222",
+		BytesIn:    10,
+		BytesOut:   20,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(b.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m["protocol"] != "tcp" || m["host"] != "0.0.0.0:2222" || m["bytes_in"] != 10.0 || m["bytes_out"] != 20.0 {
+		t.Errorf("unexpected entry %s", b.String())
+	}
+	if _, ok := m["status"]; ok {
+		t.Errorf("unexpected status %s", b.String())
+	}
+
+	if _, err := NewAccessLog(&b, "foo"); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "tunnel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "access.log")
+	f, err := NewRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for _, s := range []string{"aaaaaa\n", "bbbbbb\n", "cccccc\n", "dddddd\n"} {
+		if _, err := f.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, expected := range map[string]string{
+		"access.log":   "dddddd\n",
+		"access.log.1": "cccccc\n",
+		"access.log.2": "bbbbbb\n",
+	} {
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != expected {
+			t.Errorf("%s: expected %q got %q", name, expected, b)
+		}
+	}
+
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Error("expected at most 2 backups")
+	}
+
+	names, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(names) != 3 {
+		t.Errorf("unexpected files %s", strings.Join(names, ", "))
+	}
+}
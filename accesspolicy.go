@@ -0,0 +1,183 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// AccessPolicy specifies server wide filtering of connections and requests by
+// source address. Addresses are CIDRs i.e. "10.0.0.0/8" or single IP addresses.
+type AccessPolicy struct {
+	// Allow specifies addresses allowed to access all tunnels, if empty
+	// any address is allowed.
+	Allow []string
+	// Deny specifies addresses denied access to all tunnels, it takes
+	// precedence over Allow.
+	Deny []string
+	// Override if enabled ignores allow and deny lists of tunnels, only the
+	// server lists are applied.
+	Override bool
+	// TrustedProxies specifies addresses of proxies in front of the server,
+	// X-Forwarded-For entries added by them are honoured when determining
+	// the source address of HTTP requests.
+	TrustedProxies []string
+}
+
+// accessControl is compiled AccessPolicy.
+type accessControl struct {
+	filter   *ipFilter
+	override bool
+	trusted  []*net.IPNet
+}
+
+func newAccessControl(p *AccessPolicy) (*accessControl, error) {
+	if p == nil {
+		return &accessControl{}, nil
+	}
+
+	f, err := newIPFilter(p.Allow, p.Deny)
+	if err != nil {
+		return nil, err
+	}
+	trusted, err := parseCIDRs(p.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("trusted proxies: %s", err)
+	}
+
+	return &accessControl{
+		filter:   f,
+		override: p.Override,
+		trusted:  trusted,
+	}, nil
+}
+
+// allowed returns true if ip is allowed by server policy and tunnel filter f.
+func (a *accessControl) allowed(f *ipFilter, ip net.IP) bool {
+	if !a.filter.allowed(ip) {
+		return false
+	}
+	if a.override {
+		return true
+	}
+	return f.allowed(ip)
+}
+
+// clientIP returns source address of request r, X-Forwarded-For entries are
+// honoured as long as they are added by trusted proxies. If an entry is not a
+// valid address the last valid one, or the peer address, is returned.
+func (a *accessControl) clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if len(a.trusted) == 0 {
+		return ip
+	}
+
+	var hops []string
+	for _, v := range r.Header["X-Forwarded-For"] {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0 && ip != nil && containsIP(a.trusted, ip); i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+	}
+
+	return ip
+}
+
+// ipFilter filters addresses by allow and deny lists, nil filter allows
+// everything.
+type ipFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// newIPFilter returns filter of allow and deny lists, if both are empty nil is
+// returned.
+func newIPFilter(allow, deny []string) (*ipFilter, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+
+	a, err := parseCIDRs(allow)
+	if err != nil {
+		return nil, fmt.Errorf("allow: %s", err)
+	}
+	d, err := parseCIDRs(deny)
+	if err != nil {
+		return nil, fmt.Errorf("deny: %s", err)
+	}
+
+	return &ipFilter{allow: a, deny: d}, nil
+}
+
+// allowed returns true if ip is not denied and is allowed or allow list is
+// empty. Unknown address i.e. of unix socket is denied as it can not be
+// checked against the lists.
+func (f *ipFilter) allowed(ip net.IP) bool {
+	if f == nil {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	if containsIP(f.deny, ip) {
+		return false
+	}
+	return len(f.allow) == 0 || containsIP(f.allow, ip)
+}
+
+func parseCIDRs(s []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(s))
+	for _, v := range s {
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", v)
+			}
+			bits := 8 * net.IPv6len
+			if v4 := ip.To4(); v4 != nil {
+				ip, bits = v4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// addrIP returns IP address of addr or nil if addr is not an IP address.
+func addrIP(addr net.Addr) net.IP {
+	switch v := addr.(type) {
+	case *net.TCPAddr:
+		return v.IP
+	case *net.UDPAddr:
+		return v.IP
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestAccessPolicy(t *testing.T) {
+	t.Parallel()
+
+	a, err := newAccessControl(&AccessPolicy{
+		Deny:           []string{"192.0.2.66"},
+		TrustedProxies: []string{"10.0.0.0/8"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := newIPFilter([]string{"192.0.2.0/24", "2001:db8::/32"}, []string{"192.0.2.13"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for ip, allowed := range map[string]bool{
+		"192.0.2.1":    true,
+		"2001:db8::1":  true,
+		"192.0.2.13":   false,
+		"192.0.2.66":   false,
+		"198.51.100.1": false,
+	} {
+		if a.allowed(f, net.ParseIP(ip)) != allowed {
+			t.Errorf("%s: expected allowed %v", ip, allowed)
+		}
+	}
+	if a.allowed(nil, net.ParseIP("192.0.2.66")) {
+		t.Error("server deny list ignored")
+	}
+	if a.allowed(f, nil) || a.allowed(nil, nil) {
+		t.Error("unknown address allowed")
+	}
+
+	for _, tt := range []struct {
+		remoteAddr string
+		xff        string
+		expected   string
+	}{
+		{"192.0.2.1:1234", "", "192.0.2.1"},
+		{"192.0.2.1:1234", "198.51.100.1", "192.0.2.1"},
+		{"10.0.0.1:1234", "198.51.100.1", "198.51.100.1"},
+		{"10.0.0.1:1234", "198.51.100.1, 10.0.0.2", "198.51.100.1"},
+		{"10.0.0.1:1234", "198.51.100.1, 192.0.2.1, 10.0.0.2", "192.0.2.1"},
+		{"10.0.0.1:1234", "garbage", "10.0.0.1"},
+		{"10.0.0.1:1234", "198.51.100.1, garbage, 10.0.0.2", "10.0.0.2"},
+		{"10.0.0.1:1234", "198.51.100.1,", "10.0.0.1"},
+	} {
+		r := &http.Request{RemoteAddr: tt.remoteAddr, Header: http.Header{}}
+		if tt.xff != "" {
+			r.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		if ip := a.clientIP(r); !ip.Equal(net.ParseIP(tt.expected)) {
+			t.Errorf("%s %q: expected %s got %s", tt.remoteAddr, tt.xff, tt.expected, ip)
+		}
+	}
+
+	if _, err := newIPFilter([]string{"not an address"}, nil); err == nil {
+		t.Error("expected error")
+	}
+}
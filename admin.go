@@ -0,0 +1,305 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+	"github.com/mmatczuk/go-http-tunnel/log"
+)
+
+// ClientInfo describes state of a subscribed client as reported by the admin
+// API.
+type ClientInfo struct {
+	ID           string     `json:"id"`
+	Name         string     `json:"name,omitempty"`
+	AllowedHosts []string   `json:"allowed_hosts,omitempty"`
+	Created      *time.Time `json:"created,omitempty"`
+	Connected    bool       `json:"connected"`
+	Conns        int        `json:"conns,omitempty"`
+	Hosts        []HostInfo `json:"hosts"`
+	Listeners    []string   `json:"listeners"`
+}
+
+// HostInfo describes HTTP host registered by a client.
+type HostInfo struct {
+	Host        string `json:"host"`
+	PathPrefix  string `json:"path_prefix,omitempty"`
+	StripPrefix bool   `json:"strip_prefix,omitempty"`
+	Auth        bool   `json:"auth"`
+	JWT         bool   `json:"jwt,omitempty"`
+}
+
+// PoolInfo describes clients serving a host and path prefix or a shared
+// listener.
+type PoolInfo struct {
+	Host       string       `json:"host,omitempty"`
+	PathPrefix string       `json:"path_prefix,omitempty"`
+	Addr       string       `json:"addr,omitempty"`
+	Clients    []PoolMember `json:"clients"`
+}
+
+// PoolMember describes a client in a pool.
+type PoolMember struct {
+	ID      string `json:"id"`
+	Streams int    `json:"streams"`
+}
+
+// AdminHandler is http.Handler exposing REST API for inspecting and managing
+// clients of a Server. The API is:
+//
+//	GET    /clients                   list subscribed clients
+//	GET    /clients/{id}              show client
+//	PUT    /clients/{id}              subscribe client, optional body
+//	                                  {"name": ..., "hosts": [...]} sets
+//	                                  name and allowed hosts
+//	DELETE /clients/{id}              unsubscribe and disconnect client
+//	POST   /clients/{id}/ping         measure client RTT
+//	POST   /clients/{id}/disconnect   close client control connection
+//	GET    /pools                     list hosts and listeners with clients
+//	                                  serving them
+//
+// Responses are JSON encoded.
+type AdminHandler struct {
+	server *Server
+	// token specifies optional bearer token, if set requests must carry
+	// "Authorization: Bearer <token>" header.
+	token  string
+	logger log.Logger
+}
+
+// NewAdminHandler creates a new AdminHandler for server s. If token is empty
+// requests are not authenticated and the handler shall be protected by other
+// means i.e. TLS client certificates.
+func NewAdminHandler(s *Server, token string, logger log.Logger) *AdminHandler {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+
+	return &AdminHandler{
+		server: s,
+		token:  token,
+		logger: logger,
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (h *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		h.error(w, errUnauthorised, http.StatusUnauthorized)
+		return
+	}
+
+	h.logger.Log(
+		"level", 2,
+		"action", "admin request",
+		"addr", r.RemoteAddr,
+		"method", r.Method,
+		"url", r.URL,
+	)
+
+	path := strings.Trim(r.URL.Path, "/")
+	if path == "pools" {
+		if r.Method != http.MethodGet {
+			h.error(w, errMethodNotAllowed, http.StatusMethodNotAllowed)
+			return
+		}
+		h.pools(w)
+		return
+	}
+
+	s := strings.Split(path, "/")
+	if s[0] != "clients" || len(s) > 3 {
+		h.error(w, errNotFound, http.StatusNotFound)
+		return
+	}
+
+	if len(s) == 1 {
+		if r.Method != http.MethodGet {
+			h.error(w, errMethodNotAllowed, http.StatusMethodNotAllowed)
+			return
+		}
+		h.list(w)
+		return
+	}
+
+	var identifier id.ID
+	if err := identifier.UnmarshalText([]byte(s[1])); err != nil {
+		h.error(w, err, http.StatusBadRequest)
+		return
+	}
+
+	action := r.Method
+	if len(s) == 3 {
+		if r.Method != http.MethodPost {
+			h.error(w, errMethodNotAllowed, http.StatusMethodNotAllowed)
+			return
+		}
+		action = s[2]
+	}
+
+	switch action {
+	case http.MethodGet:
+		h.show(w, identifier)
+	case http.MethodPut:
+		sub := &Subscription{}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(sub); err != nil {
+				h.error(w, err, http.StatusBadRequest)
+				return
+			}
+		}
+		sub.ID = identifier
+		if err := h.server.AddSubscription(sub); err != nil {
+			h.error(w, err, http.StatusInternalServerError)
+			return
+		}
+		h.show(w, identifier)
+	case http.MethodDelete:
+		if h.server.Unsubscribe(identifier) == nil {
+			h.error(w, errClientNotSubscribed, http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "ping":
+		d, err := h.server.Ping(identifier)
+		if err != nil {
+			h.error(w, err, http.StatusBadGateway)
+			return
+		}
+		h.json(w, map[string]interface{}{
+			"rtt":    d.String(),
+			"rtt_ns": d.Nanoseconds(),
+		})
+	case "disconnect":
+		if err := h.server.Disconnect(identifier); err != nil {
+			h.error(w, err, http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		if len(s) == 3 {
+			h.error(w, errNotFound, http.StatusNotFound)
+		} else {
+			h.error(w, errMethodNotAllowed, http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func (h *AdminHandler) authorized(r *http.Request) bool {
+	if h.token == "" {
+		return true
+	}
+
+	auth := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if !strings.HasPrefix(auth, prefix) {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(auth[len(prefix):]), []byte(h.token)) == 1
+}
+
+func (h *AdminHandler) list(w http.ResponseWriter) {
+	items := h.server.Subscribers()
+
+	clients := make([]*ClientInfo, 0, len(items))
+	for identifier, i := range items {
+		clients = append(clients, h.clientInfo(identifier, i))
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].ID < clients[j].ID
+	})
+
+	h.json(w, clients)
+}
+
+func (h *AdminHandler) pools(w http.ResponseWriter) {
+	pools := h.server.Pools()
+
+	v := make([]*PoolInfo, 0, len(pools))
+	for _, p := range pools {
+		pi := &PoolInfo{
+			Host:       p.Host,
+			PathPrefix: p.PathPrefix,
+			Addr:       p.Addr,
+			Clients:    make([]PoolMember, 0, len(p.Clients)),
+		}
+		for _, identifier := range p.Clients {
+			pi.Clients = append(pi.Clients, PoolMember{
+				ID:      identifier.String(),
+				Streams: h.server.balancer.active(identifier),
+			})
+		}
+		v = append(v, pi)
+	}
+
+	h.json(w, v)
+}
+
+func (h *AdminHandler) show(w http.ResponseWriter, identifier id.ID) {
+	i, ok := h.server.Subscribers()[identifier]
+	if !ok {
+		h.error(w, errClientNotSubscribed, http.StatusNotFound)
+		return
+	}
+
+	h.json(w, h.clientInfo(identifier, i))
+}
+
+func (h *AdminHandler) clientInfo(identifier id.ID, i *RegistryItem) *ClientInfo {
+	c := &ClientInfo{
+		ID:        identifier.String(),
+		Connected: h.server.IsConnected(identifier),
+		Conns:     h.server.connPool.Conns(identifier),
+		Hosts:     make([]HostInfo, 0, len(i.Hosts)),
+		Listeners: make([]string, 0, len(i.Listeners)),
+	}
+	if sub, ok := h.server.Subscription(identifier); ok {
+		c.Name = sub.Name
+		c.AllowedHosts = sub.Hosts
+		c.Created = &sub.Created
+	}
+	for _, ha := range i.Hosts {
+		c.Hosts = append(c.Hosts, HostInfo{
+			Host:        ha.Host,
+			PathPrefix:  ha.PathPrefix,
+			StripPrefix: ha.StripPrefix,
+			Auth:        ha.Auth != nil,
+			JWT:         ha.JWT,
+		})
+	}
+	for _, l := range i.Listeners {
+		c.Listeners = append(c.Listeners, l.Addr().String())
+	}
+
+	return c
+}
+
+func (h *AdminHandler) json(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		h.logger.Log(
+			"level", 0,
+			"msg", "admin response encoding failed",
+			"err", err,
+		)
+	}
+}
+
+func (h *AdminHandler) error(w http.ResponseWriter, err error, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error": err.Error(),
+	})
+}
@@ -0,0 +1,81 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+)
+
+func TestAdminHandler(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(&ServerConfig{Listener: l})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	h := NewAdminHandler(s, "token", nil)
+	identifier := id.New([]byte("client"))
+
+	do := func(method, path, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	tests := []struct {
+		method string
+		path   string
+		token  string
+		code   int
+	}{
+		{http.MethodGet, "/clients", "", http.StatusUnauthorized},
+		{http.MethodGet, "/clients", "invalid", http.StatusUnauthorized},
+		{http.MethodGet, "/foo", "token", http.StatusNotFound},
+		{http.MethodPost, "/clients", "token", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/clients/invalid", "token", http.StatusBadRequest},
+		{http.MethodGet, "/clients/" + identifier.String(), "token", http.StatusNotFound},
+		{http.MethodPut, "/clients/" + identifier.String(), "token", http.StatusOK},
+		{http.MethodGet, "/clients/" + identifier.String(), "token", http.StatusOK},
+		{http.MethodPost, "/clients/" + identifier.String() + "/ping", "token", http.StatusBadGateway},
+		{http.MethodPost, "/clients/" + identifier.String() + "/disconnect", "token", http.StatusNotFound},
+		{http.MethodPost, "/clients/" + identifier.String() + "/foo", "token", http.StatusNotFound},
+		{http.MethodDelete, "/clients/" + identifier.String(), "token", http.StatusNoContent},
+		{http.MethodDelete, "/clients/" + identifier.String(), "token", http.StatusNotFound},
+		{http.MethodGet, "/pools", "token", http.StatusOK},
+		{http.MethodPost, "/pools", "token", http.StatusMethodNotAllowed},
+	}
+
+	for i, tt := range tests {
+		if w := do(tt.method, tt.path, tt.token); w.Code != tt.code {
+			t.Errorf("[%d] %s %s expected %d got %d: %s", i, tt.method, tt.path, tt.code, w.Code, w.Body)
+		}
+	}
+
+	s.Subscribe(identifier)
+	w := do(http.MethodGet, "/clients", "token")
+	var clients []*ClientInfo
+	if err := json.NewDecoder(w.Body).Decode(&clients); err != nil {
+		t.Fatal(err)
+	}
+	if len(clients) != 1 || clients[0].ID != identifier.String() || clients[0].Connected {
+		t.Fatalf("unexpected clients %+v", clients)
+	}
+}
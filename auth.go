@@ -4,27 +4,490 @@
 
 package tunnel
 
-import "strings"
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
 
-// Auth holds user and password.
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// DefaultHtpasswdCheckInterval specifies how often HtpasswdFile checks the
+// file for changes.
+const DefaultHtpasswdCheckInterval = time.Second
+
+// DefaultAuthCacheTTL specifies how long a successful verification of bcrypt
+// or argon2 hash is remembered, browsers send credentials with every request.
+const DefaultAuthCacheTTL = time.Minute
+
+// Auth holds credentials of HTTP basic auth.
 type Auth struct {
+	// User and Password specify a single user, they are checked in
+	// addition to Users.
 	User     string
 	Password string
+	// Users maps user to password, the password may be plaintext or hash
+	// supported by htpasswd i.e. bcrypt, apr1 or SHA, or argon2 hash in
+	// PHC string format.
+	Users map[string]string
+	// File specifies optional htpasswd file with additional users.
+	File *HtpasswdFile
 }
 
-// NewAuth creates new auth from string representation "user:password".
+// NewAuth creates new auth from string representation, it's one or more
+// lines in htpasswd format "user:password". A single line is returned as
+// User and Password.
 func NewAuth(auth string) *Auth {
 	if auth == "" {
 		return nil
 	}
 
-	s := strings.SplitN(auth, ":", 2)
-	a := &Auth{
-		User: s[0],
+	users := parseHtpasswd(auth)
+	switch len(users) {
+	case 0:
+		return nil
+	case 1:
+		for user, password := range users {
+			return &Auth{
+				User:     user,
+				Password: password,
+			}
+		}
+	}
+
+	return &Auth{
+		Users: users,
+	}
+}
+
+// Verify returns true if password of user matches.
+func (a *Auth) Verify(user, password string) bool {
+	if a == nil {
+		return false
+	}
+
+	hash, ok := a.lookup(user)
+	if !ok {
+		return false
+	}
+
+	if !slowHash(hash) {
+		return verifyPassword(hash, password)
+	}
+
+	k := verifiedKey(user, hash, password)
+	if verified.ok(k) {
+		return true
+	}
+	if !verifyPassword(hash, password) {
+		return false
+	}
+	verified.add(k)
+
+	return true
+}
+
+func (a *Auth) lookup(user string) (string, bool) {
+	if (a.User != "" || a.Password != "") && a.User == user {
+		return a.Password, true
+	}
+	if hash, ok := a.Users[user]; ok {
+		return hash, true
+	}
+	if a.File != nil {
+		return a.File.lookup(user)
+	}
+
+	return "", false
+}
+
+// missingUser returns true if password is set for empty user.
+func (a *Auth) missingUser() bool {
+	if a.User == "" && a.Password != "" {
+		return true
+	}
+	_, ok := a.Users[""]
+
+	return ok
+}
+
+// checkCost returns error if bcrypt hash of any of the users is more
+// expensive to verify than maxBcryptCost.
+func (a *Auth) checkCost() error {
+	check := func(user, hash string) error {
+		h := bcryptHash(hash)
+		if h == nil {
+			return nil
+		}
+		cost, err := bcrypt.Cost(h)
+		if err != nil {
+			return fmt.Errorf("invalid bcrypt hash of user %q: %s", user, err)
+		}
+		if cost > maxBcryptCost {
+			return fmt.Errorf("bcrypt cost %d of user %q exceeds %d", cost, user, maxBcryptCost)
+		}
+		return nil
+	}
+
+	if a.Password != "" {
+		if err := check(a.User, a.Password); err != nil {
+			return err
+		}
+	}
+	for user, hash := range a.Users {
+		if err := check(user, hash); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func parseHtpasswd(s string) map[string]string {
+	users := make(map[string]string)
+
+	sc := bufio.NewScanner(strings.NewReader(s))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		v := strings.SplitN(line, ":", 2)
+		if len(v) > 1 {
+			users[v[0]] = v[1]
+		} else {
+			users[v[0]] = ""
+		}
+	}
+
+	return users
+}
+
+// verifyPassword returns true if password matches hash, hash that is not in
+// any of the supported formats is compared as plaintext.
+func verifyPassword(hash, password string) bool {
+	switch {
+	case bcryptHash(hash) != nil:
+		return verifyBcrypt(bcryptHash(hash), password)
+	case strings.HasPrefix(hash, "$argon2"):
+		return verifyArgon2(hash, password)
+	case strings.HasPrefix(hash, "$apr1$"):
+		return constantTimeEqual(hash, apr1(hash, password))
+	case strings.HasPrefix(hash, "{SHA}"):
+		h := sha1.Sum([]byte(password))
+		return constantTimeEqual(hash, "{SHA}"+base64.StdEncoding.EncodeToString(h[:]))
+	default:
+		return constantTimeEqual(hash, password)
+	}
+}
+
+func constantTimeEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// slowHash returns true if hash is bcrypt or argon2 hash.
+func slowHash(hash string) bool {
+	return bcryptHash(hash) != nil || strings.HasPrefix(hash, "$argon2")
+}
+
+// bcryptHash returns hash as accepted by bcrypt package or nil if it's not
+// a bcrypt hash.
+func bcryptHash(hash string) []byte {
+	if !strings.HasPrefix(hash, "$2a$") && !strings.HasPrefix(hash, "$2b$") && !strings.HasPrefix(hash, "$2y$") {
+		return nil
+	}
+	// bcrypt does not know $2y$, it's the same as $2a$
+	h := []byte(hash)
+	if h[2] == 'y' {
+		h[2] = 'a'
+	}
+
+	return h
+}
+
+// verifyBcrypt verifies bcrypt hash with cost of at most maxBcryptCost.
+func verifyBcrypt(hash []byte, password string) bool {
+	if cost, err := bcrypt.Cost(hash); err != nil || cost > maxBcryptCost {
+		return false
+	}
+
+	hashSem <- struct{}{}
+	err := bcrypt.CompareHashAndPassword(hash, []byte(password))
+	<-hashSem
+
+	return err == nil
+}
+
+// Bcrypt and argon2 hashes come from clients, the parameters are limited so
+// that verification does not exhaust server memory and CPU.
+const (
+	// maxBcryptCost limits bcrypt cost, each step doubles verification time.
+	maxBcryptCost = 12
+	// maxArgon2Memory limits memory in KiB a hash may require.
+	maxArgon2Memory = 256 << 10
+	// maxArgon2Iterations limits number of passes over the memory.
+	maxArgon2Iterations = 16
+	// maxArgon2Threads limits degree of parallelism.
+	maxArgon2Threads = 16
+	// minArgon2KeyLen is the shortest accepted key length in bytes.
+	minArgon2KeyLen = 16
+	// maxHashConcurrency limits number of bcrypt and argon2 verifications
+	// running at the same time, others wait.
+	maxHashConcurrency = 4
+)
+
+var hashSem = make(chan struct{}, maxHashConcurrency)
+
+// verifyArgon2 verifies argon2i or argon2id hash in PHC string format i.e.
+// $argon2id$v=19$m=65536,t=3,p=4$salt$hash.
+func verifyArgon2(hash, password string) bool {
+	v := strings.Split(hash, "$")
+	if len(v) != 6 {
+		return false
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(v[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+	var (
+		memory  uint32
+		iters   uint32
+		threads uint32
+	)
+	if _, err := fmt.Sscanf(v[3], "m=%d,t=%d,p=%d", &memory, &iters, &threads); err != nil {
+		return false
+	}
+	if memory > maxArgon2Memory {
+		return false
+	}
+	if iters < 1 || iters > maxArgon2Iterations {
+		return false
+	}
+	if threads < 1 || threads > maxArgon2Threads {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(v[4])
+	if err != nil {
+		return false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(v[5])
+	if err != nil || len(key) < minArgon2KeyLen {
+		return false
+	}
+
+	var f func(password, salt []byte, time, memory uint32, threads uint8, keyLen uint32) []byte
+	switch v[1] {
+	case "argon2id":
+		f = argon2.IDKey
+	case "argon2i":
+		f = argon2.Key
+	default:
+		return false
+	}
+
+	hashSem <- struct{}{}
+	k := f([]byte(password), salt, iters, memory, uint8(threads), uint32(len(key)))
+	<-hashSem
+
+	return subtle.ConstantTimeCompare(k, key) == 1
+}
+
+// maxVerifiedCacheSize limits number of remembered verifications.
+const maxVerifiedCacheSize = 4096
+
+var verified = &verifiedCache{
+	m: make(map[[sha256.Size]byte]time.Time),
+}
+
+// verifiedCache remembers successful verifications of slow hashes for
+// DefaultAuthCacheTTL. Keys are digests of user, hash and password so that
+// a changed hash or a different password is verified again.
+type verifiedCache struct {
+	mu sync.Mutex
+	m  map[[sha256.Size]byte]time.Time
+}
+
+func verifiedKey(user, hash, password string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(user + "\x00" + hash + "\x00" + password))
+}
+
+func (c *verifiedCache) ok(k [sha256.Size]byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t, ok := c.m[k]
+	if !ok {
+		return false
+	}
+	if time.Since(t) > DefaultAuthCacheTTL {
+		delete(c.m, k)
+		return false
+	}
+
+	return true
+}
+
+func (c *verifiedCache) add(k [sha256.Size]byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.m) >= maxVerifiedCacheSize {
+		for key, t := range c.m {
+			if time.Since(t) > DefaultAuthCacheTTL {
+				delete(c.m, key)
+			}
+		}
+		if len(c.m) >= maxVerifiedCacheSize {
+			c.m = make(map[[sha256.Size]byte]time.Time)
+		}
+	}
+	c.m[k] = time.Now()
+}
+
+const apr1Alphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// apr1 returns Apache MD5 hash of password with salt of hash.
+func apr1(hash, password string) string {
+	const magic = "$apr1$"
+
+	salt := strings.TrimPrefix(hash, magic)
+	if i := strings.IndexByte(salt, '$'); i >= 0 {
+		salt = salt[:i]
+	}
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alt := md5.New()
+	alt.Write(pw)
+	alt.Write([]byte(salt))
+	alt.Write(pw)
+	altSum := alt.Sum(nil)
+
+	h := md5.New()
+	h.Write(pw)
+	h.Write([]byte(magic + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		if i > 16 {
+			h.Write(altSum)
+		} else {
+			h.Write(altSum[:i])
+		}
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(pw[:1])
+		}
+	}
+	sum := h.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		h := md5.New()
+		if i&1 != 0 {
+			h.Write(pw)
+		} else {
+			h.Write(sum)
+		}
+		if i%3 != 0 {
+			h.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			h.Write(pw)
+		}
+		if i&1 != 0 {
+			h.Write(sum)
+		} else {
+			h.Write(pw)
+		}
+		sum = h.Sum(nil)
+	}
+
+	var b strings.Builder
+	b.WriteString(magic + salt + "$")
+	encode := func(v uint, n int) {
+		for ; n > 0; n-- {
+			b.WriteByte(apr1Alphabet[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, i := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint(sum[i[0]])<<16|uint(sum[i[1]])<<8|uint(sum[i[2]]), 4)
+	}
+	encode(uint(sum[11]), 2)
+
+	return b.String()
+}
+
+// HtpasswdFile is htpasswd file managed on the server, tunnels reference it
+// by name so that credentials are not sent by clients. The file is reloaded
+// when modified so users can be added and revoked without restarting server.
+type HtpasswdFile struct {
+	path string
+
+	mu      sync.Mutex
+	users   map[string]string
+	modTime time.Time
+	checked time.Time
+}
+
+// LoadHtpasswdFile loads htpasswd file from path.
+func LoadHtpasswdFile(path string) (*HtpasswdFile, error) {
+	f := &HtpasswdFile{
+		path: path,
+	}
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (f *HtpasswdFile) lookup(user string) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if time.Since(f.checked) > DefaultHtpasswdCheckInterval {
+		// keep serving the old users if the file is being replaced
+		f.reload()
+	}
+	hash, ok := f.users[user]
+
+	return hash, ok
+}
+
+// reload reads the file if it was modified, it must be called with mu held
+// or before the file is shared.
+func (f *HtpasswdFile) reload() error {
+	f.checked = time.Now()
+
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	if f.users != nil && fi.ModTime().Equal(f.modTime) {
+		return nil
 	}
-	if len(s) > 1 {
-		a.Password = s[1]
+
+	b, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return err
 	}
+	f.users = parseHtpasswd(string(b))
+	f.modTime = fi.ModTime()
 
-	return a
+	return nil
 }
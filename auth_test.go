@@ -5,8 +5,12 @@
 package tunnel
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestNewAuth(t *testing.T) {
@@ -18,6 +22,7 @@ func TestNewAuth(t *testing.T) {
 		{"user", &Auth{User: "user"}},
 		{"user:password", &Auth{User: "user", Password: "password"}},
 		{"user:pass:word", &Auth{User: "user", Password: "pass:word"}},
+		{"alice:a\n# comment\n\nbob:b\n", &Auth{Users: map[string]string{"alice": "a", "bob": "b"}}},
 	}
 
 	for _, tt := range tests {
@@ -26,3 +31,228 @@ func TestNewAuth(t *testing.T) {
 		}
 	}
 }
+
+func TestAuthVerify(t *testing.T) {
+	t.Parallel()
+
+	a := NewAuth(`plain:secret
+bcrypt:$2y$04$r0SDW468IYKWiBq3c0AcmuFLnwhoJdzr1.DaxvgjUouEpmJMTctCi
+apr1:$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/
+sha:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=
+argon2:$argon2id$v=19$m=64,t=1,p=1$c29tZXNhbHQ$4mqQiyq0VpIzuZmp+8eSF3YJ7Av58TkEJ4LIdOVsAc4`)
+
+	tests := []struct {
+		user     string
+		password string
+		ok       bool
+	}{
+		{"plain", "secret", true},
+		{"plain", "secreT", false},
+		{"bcrypt", "secret", true},
+		{"bcrypt", "other", false},
+		{"apr1", "secret", true},
+		{"apr1", "other", false},
+		{"sha", "secret", true},
+		{"sha", "other", false},
+		{"argon2", "secret", true},
+		{"argon2", "other", false},
+		{"unknown", "secret", false},
+	}
+
+	for _, tt := range tests {
+		if a.Verify(tt.user, tt.password) != tt.ok {
+			t.Errorf("%s:%s expected %v", tt.user, tt.password, tt.ok)
+		}
+	}
+}
+
+func TestAuthVerifyUserPassword(t *testing.T) {
+	t.Parallel()
+
+	a := &Auth{
+		User:     "user",
+		Password: "password",
+		Users:    map[string]string{"alice": "secret"},
+	}
+	if !a.Verify("user", "password") || !a.Verify("alice", "secret") {
+		t.Fatal("expected valid credentials")
+	}
+	if a.Verify("user", "secret") || a.Verify("", "password") {
+		t.Fatal("expected invalid credentials")
+	}
+	if (&Auth{User: "user"}).missingUser() || !(&Auth{Password: "password"}).missingUser() {
+		t.Fatal("missing user")
+	}
+}
+
+func TestVerifyArgon2Limits(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		hash string
+	}{
+		{"zero time", "$argon2id$v=19$m=64,t=0,p=1$c29tZXNhbHQ$4mqQiyq0VpIzuZmp+8eSF3YJ7Av58TkEJ4LIdOVsAc4"},
+		{"zero threads", "$argon2id$v=19$m=64,t=1,p=0$c29tZXNhbHQ$4mqQiyq0VpIzuZmp+8eSF3YJ7Av58TkEJ4LIdOVsAc4"},
+		{"threads overflow", "$argon2id$v=19$m=64,t=1,p=257$c29tZXNhbHQ$4mqQiyq0VpIzuZmp+8eSF3YJ7Av58TkEJ4LIdOVsAc4"},
+		{"short key", "$argon2id$v=19$m=64,t=1,p=1$c29tZXNhbHQ$aZ+P2Lqr+tk"},
+		{"too much time", "$argon2id$v=19$m=64,t=64,p=1$c29tZXNhbHQ$KUc6i8vC7y9jwuMqeJIMWBQb4o/PxGfZMLu2LNawodU"},
+		{"too many threads", "$argon2id$v=19$m=64,t=1,p=64$c29tZXNhbHQ$iVhl8aAxFZNfQAwkTavSob9InYXlYc/io37NCpHuBU8"},
+		{"too much memory", "$argon2id$v=19$m=1048576,t=1,p=1$c29tZXNhbHQ$4mqQiyq0VpIzuZmp+8eSF3YJ7Av58TkEJ4LIdOVsAc4"},
+	}
+	for _, tt := range tests {
+		if verifyArgon2(tt.hash, "secret") {
+			t.Errorf("%s: expected hash to be rejected", tt.name)
+		}
+	}
+}
+
+func TestVerifyArgon2Concurrency(t *testing.T) {
+	for i := 0; i < maxHashConcurrency; i++ {
+		hashSem <- struct{}{}
+	}
+
+	done := make(chan bool)
+	go func() {
+		done <- verifyArgon2("$argon2id$v=19$m=64,t=1,p=1$c29tZXNhbHQ$4mqQiyq0VpIzuZmp+8eSF3YJ7Av58TkEJ4LIdOVsAc4", "secret")
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("verification not limited")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	for i := 0; i < maxHashConcurrency; i++ {
+		<-hashSem
+	}
+	if !<-done {
+		t.Fatal("expected valid password")
+	}
+}
+
+func TestVerifyBcryptCost(t *testing.T) {
+	t.Parallel()
+
+	const (
+		hash    = "$2y$04$r0SDW468IYKWiBq3c0AcmuFLnwhoJdzr1.DaxvgjUouEpmJMTctCi"
+		tooSlow = "$2y$13$r0SDW468IYKWiBq3c0AcmuFLnwhoJdzr1.DaxvgjUouEpmJMTctCi"
+	)
+
+	if !verifyPassword(hash, "secret") {
+		t.Fatal("expected valid password")
+	}
+	if verifyPassword(tooSlow, "secret") {
+		t.Fatal("expected hash to be rejected")
+	}
+
+	if err := (&Auth{User: "a", Password: hash}).checkCost(); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&Auth{User: "a", Password: tooSlow}).checkCost(); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := (&Auth{Users: map[string]string{"a": hash, "b": tooSlow}}).checkCost(); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestVerifyBcryptConcurrency(t *testing.T) {
+	for i := 0; i < maxHashConcurrency; i++ {
+		hashSem <- struct{}{}
+	}
+
+	done := make(chan bool)
+	go func() {
+		done <- verifyPassword("$2y$04$r0SDW468IYKWiBq3c0AcmuFLnwhoJdzr1.DaxvgjUouEpmJMTctCi", "secret")
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("verification not limited")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	for i := 0; i < maxHashConcurrency; i++ {
+		<-hashSem
+	}
+	if !<-done {
+		t.Fatal("expected valid password")
+	}
+}
+
+func TestAuthVerifyCache(t *testing.T) {
+	a := &Auth{User: "cached", Password: "$2y$04$r0SDW468IYKWiBq3c0AcmuFLnwhoJdzr1.DaxvgjUouEpmJMTctCi"}
+	if !a.Verify("cached", "secret") {
+		t.Fatal("expected valid password")
+	}
+
+	// with verifications blocked only the remembered one succeeds
+	for i := 0; i < maxHashConcurrency; i++ {
+		hashSem <- struct{}{}
+	}
+	done := make(chan bool)
+	go func() {
+		done <- a.Verify("cached", "secret")
+	}()
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Fatal("expected valid password")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("verification not cached")
+	}
+	for i := 0; i < maxHashConcurrency; i++ {
+		<-hashSem
+	}
+
+	if a.Verify("cached", "other") {
+		t.Fatal("expected invalid password")
+	}
+	a.Password = "$2y$04$jWgqk5Y2aNf4TqHXnC9d5.6JkK4sVlh9Ms8c1zU/5hBf4k6b3a0xK"
+	if a.Verify("cached", "secret") {
+		t.Fatal("expected changed hash to be verified again")
+	}
+}
+
+func TestHtpasswdFile(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "tunnel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "reviewers")
+	if err := ioutil.WriteFile(path, []byte("alice:secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := LoadHtpasswdFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &Auth{Users: map[string]string{"owner": "pass"}, File: f}
+
+	if !a.Verify("owner", "pass") || !a.Verify("alice", "secret") {
+		t.Fatal("expected valid credentials")
+	}
+
+	// revoke alice
+	if err := ioutil.WriteFile(path, []byte("bob:secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	f.mu.Lock()
+	f.checked = time.Time{}
+	f.mu.Unlock()
+
+	if a.Verify("alice", "secret") || !a.Verify("bob", "secret") {
+		t.Fatal("file not reloaded")
+	}
+}
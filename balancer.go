@@ -0,0 +1,120 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+)
+
+// Pool selection policies, they define how a client is selected when several
+// clients serve the same host or listener.
+const (
+	PoolRoundRobin   = "round-robin"
+	PoolLeastStreams = "least-streams"
+)
+
+// balancer selects clients from pools and keeps track of number of active
+// streams of every client.
+type balancer struct {
+	policy string
+
+	mu      sync.Mutex
+	next    map[string]int
+	streams map[id.ID]int
+}
+
+func newBalancer(policy string) (*balancer, error) {
+	switch policy {
+	case "":
+		policy = PoolRoundRobin
+	case PoolRoundRobin, PoolLeastStreams:
+	default:
+		return nil, fmt.Errorf("unknown pool policy %q", policy)
+	}
+
+	return &balancer{
+		policy:  policy,
+		next:    make(map[string]int),
+		streams: make(map[id.ID]int),
+	}, nil
+}
+
+// pick returns index of the client selected from pool identified by key.
+func (b *balancer) pick(key string, pool []id.ID) int {
+	if len(pool) == 1 {
+		return 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	start := b.next[key] % len(pool)
+	b.next[key] = start + 1
+	if b.policy == PoolRoundRobin {
+		return start
+	}
+
+	k := start
+	for i := 1; i < len(pool); i++ {
+		j := (start + i) % len(pool)
+		if b.streams[pool[j]] < b.streams[pool[k]] {
+			k = j
+		}
+	}
+	return k
+}
+
+// acquire marks start of a stream of a client, release shall be called when
+// the stream is done.
+func (b *balancer) acquire(identifier id.ID) {
+	b.mu.Lock()
+	b.streams[identifier]++
+	b.mu.Unlock()
+}
+
+func (b *balancer) release(identifier id.ID) {
+	b.mu.Lock()
+	if b.streams[identifier]--; b.streams[identifier] <= 0 {
+		delete(b.streams, identifier)
+	}
+	b.mu.Unlock()
+}
+
+// active returns number of active streams of a client.
+func (b *balancer) active(identifier id.ID) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.streams[identifier]
+}
+
+// sharedListener is a listener shared by a pool of clients, it's closed when
+// all members close their handles.
+type sharedListener struct {
+	net.Listener
+	key  string
+	refs int
+}
+
+// poolListener is a handle of a pool member to a sharedListener.
+type poolListener struct {
+	*sharedListener
+	once  sync.Once
+	close func()
+}
+
+// Accept is not supported, connections are accepted from the shared listener.
+func (l *poolListener) Accept() (net.Conn, error) {
+	return nil, fmt.Errorf("accept on pool listener %s", l.key)
+}
+
+// Close releases the handle.
+func (l *poolListener) Close() error {
+	l.once.Do(l.close)
+	return nil
+}
@@ -5,6 +5,7 @@
 package tunnel
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
@@ -17,6 +18,7 @@ import (
 	"golang.org/x/net/http2"
 
 	"github.com/mmatczuk/go-http-tunnel/log"
+	"github.com/mmatczuk/go-http-tunnel/metrics"
 	"github.com/mmatczuk/go-http-tunnel/proto"
 )
 
@@ -40,6 +42,16 @@ type ClientConfig struct {
 	Proxy ProxyFunc
 	// Logger is optional logger. If nil logging is disabled.
 	Logger log.Logger
+	// Metrics specifies optional registry client metrics are added to.
+	Metrics *metrics.Registry
+	// TunnelOpened is optional callback invoked when server reports
+	// a tunnel opened, the tunnel has server assigned host and address.
+	TunnelOpened func(name string, t *proto.Tunnel)
+	// Connections specifies number of parallel control connections to
+	// the server, server sends new requests over the least loaded one and
+	// keeps tunnels open while at least one of them is alive. Lost
+	// connections are replaced. If zero one connection is used.
+	Connections int
 }
 
 // Client is responsible for creating connection to the server, handling control
@@ -48,12 +60,32 @@ type ClientConfig struct {
 type Client struct {
 	config *ClientConfig
 
-	conn           net.Conn
+	conns          map[net.Conn]struct{}
 	connMu         sync.Mutex
 	httpServer     *http2.Server
+	baseServer     *http.Server
+	served         chan struct{}
+	group          string
+	stopped        bool
+	stop           chan struct{}
 	serverErr      error
 	lastDisconnect time.Time
 	logger         log.Logger
+	metrics        *clientMetrics
+
+	tunnelsMu sync.Mutex
+	tunnels   map[string]*proto.Tunnel
+	opened    map[string]*proto.Tunnel
+	updates   *tunnelUpdates
+}
+
+// tunnelUpdates is the client end of ActionTunnels stream, it sends
+// proto.TunnelUpdate to server and dispatches proto.TunnelUpdateResult.
+type tunnelUpdates struct {
+	mu      sync.Mutex
+	enc     *json.Encoder
+	nextID  uint64
+	pending map[uint64]chan *proto.TunnelUpdateResult
 }
 
 // NewClient creates a new unconnected Client based on configuration. Caller
@@ -71,16 +103,34 @@ func NewClient(config *ClientConfig) (*Client, error) {
 	if config.Proxy == nil {
 		return nil, errors.New("missing Proxy")
 	}
+	if config.Connections < 0 || config.Connections > MaxClientConns {
+		return nil, fmt.Errorf("invalid Connections %d, at most %d are allowed", config.Connections, MaxClientConns)
+	}
 
 	logger := config.Logger
 	if logger == nil {
 		logger = log.NewNopLogger()
 	}
 
+	// tunnels may be added and removed at runtime, do not modify the map
+	// owned by caller
+	tunnels := make(map[string]*proto.Tunnel, len(config.Tunnels))
+	for name, t := range config.Tunnels {
+		tunnels[name] = t
+	}
+
 	c := &Client{
 		config:     config,
+		tunnels:    tunnels,
 		httpServer: &http2.Server{},
+		baseServer: &http.Server{},
+		stop:       make(chan struct{}),
 		logger:     logger,
+		metrics:    newClientMetrics(config.Metrics),
+	}
+	// base server is used only to send GOAWAY on Shutdown
+	if err := http2.ConfigureServer(c.baseServer, c.httpServer); err != nil {
+		return nil, err
 	}
 
 	return c, nil
@@ -96,20 +146,28 @@ func (c *Client) Start() error {
 		"action", "start",
 	)
 
-	for {
-		conn, err := c.connect()
+	for reconnect := false; ; reconnect = true {
+		conn, served, err := c.connect()
+		if err == errClientStopped {
+			return nil
+		}
 		if err != nil {
 			return err
 		}
+		if reconnect {
+			c.metrics.reconnects.Inc()
+		}
+		c.metrics.connected.Set(1)
 
-		c.httpServer.ServeConn(conn, &http2.ServeConnOpts{
-			Handler: http.HandlerFunc(c.serveHTTP),
-		})
+		// additional connections are opened after handshake
+		go c.serveConn(conn, served)
+		<-served
 
 		c.logger.Log(
 			"level", 1,
 			"action", "disconnected",
 		)
+		c.metrics.connected.Set(0)
 
 		c.connMu.Lock()
 		now := time.Now()
@@ -120,93 +178,164 @@ func (c *Client) Start() error {
 			err = fmt.Errorf("connection is being cut")
 		}
 
-		c.conn = nil
 		c.serverErr = nil
 		c.lastDisconnect = now
+		stopped := c.stopped
 		c.connMu.Unlock()
 
+		if stopped {
+			return nil
+		}
+
 		if err != nil {
 			return err
 		}
 	}
 }
 
-func (c *Client) connect() (net.Conn, error) {
+// connect opens the first control connection, served is closed when all
+// connections are lost.
+func (c *Client) connect() (conn net.Conn, served chan struct{}, err error) {
 	c.connMu.Lock()
-	defer c.connMu.Unlock()
-
-	if c.conn != nil {
-		return nil, fmt.Errorf("already connected")
+	if len(c.conns) > 0 {
+		c.connMu.Unlock()
+		return nil, nil, fmt.Errorf("already connected")
+	}
+	if c.stopped {
+		c.connMu.Unlock()
+		return nil, nil, errClientStopped
 	}
+	c.connMu.Unlock()
 
-	conn, err := c.dial()
+	// dial without the lock so that Stop and Shutdown are not blocked by
+	// backoff
+	conn, err = c.dial()
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to server: %s", err)
+		if err == errClientStopped {
+			return nil, nil, err
+		}
+		return nil, nil, fmt.Errorf("failed to connect to server: %s", err)
 	}
-	c.conn = conn
 
-	return conn, nil
-}
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
 
-func (c *Client) dial() (net.Conn, error) {
-	var (
-		network   = "tcp"
-		addr      = c.config.ServerAddr
-		tlsConfig = c.config.TLSClientConfig
-	)
+	if c.stopped {
+		conn.Close()
+		return nil, nil, errClientStopped
+	}
+	if len(c.conns) > 0 {
+		conn.Close()
+		return nil, nil, fmt.Errorf("already connected")
+	}
+	c.conns = map[net.Conn]struct{}{conn: {}}
+	c.served = make(chan struct{})
+	c.group = ""
 
-	doDial := func() (conn net.Conn, err error) {
-		c.logger.Log(
-			"level", 1,
-			"action", "dial",
-			"network", network,
-			"addr", addr,
-		)
+	return conn, c.served, nil
+}
 
-		if c.config.DialTLS != nil {
-			conn, err = c.config.DialTLS(network, addr, tlsConfig)
-		} else {
-			d := &net.Dialer{
-				Timeout: DefaultTimeout,
-			}
-			conn, err = d.Dial(network, addr)
+// connRetryInterval specifies how often client tries to replace a lost
+// control connection.
+const connRetryInterval = time.Second
 
-			if err == nil {
-				err = keepAlive(conn)
-			}
-			if err == nil {
-				conn = tls.Client(conn, tlsConfig)
-			}
-			if err == nil {
-				err = conn.(*tls.Conn).Handshake()
+// serveConn serves control connection conn, if conn is nil a new connection is
+// opened first. Connection lost while other connections are alive is replaced.
+func (c *Client) serveConn(conn net.Conn, served chan struct{}) {
+	for {
+		if conn == nil {
+			if conn = c.addConn(served); conn == nil {
+				return
 			}
 		}
 
-		if err != nil {
-			if conn != nil {
-				conn.Close()
-				conn = nil
-			}
+		c.httpServer.ServeConn(conn, &http2.ServeConnOpts{
+			BaseConfig: c.baseServer,
+			Handler:    http.HandlerFunc(c.serveHTTP),
+		})
 
-			c.logger.Log(
-				"level", 0,
-				"msg", "dial failed",
-				"network", network,
-				"addr", addr,
-				"err", err,
-			)
+		if !c.removeConn(conn, served) {
+			return
 		}
+		conn = nil
 
-		return
+		select {
+		case <-served:
+			return
+		case <-time.After(connRetryInterval):
+		}
+	}
+}
+
+// addConn opens additional control connection, it returns nil if all
+// connections were lost or client is stopped before it's connected.
+func (c *Client) addConn(served chan struct{}) net.Conn {
+	for {
+		conn, err := c.dialOnce()
+
+		c.connMu.Lock()
+		alive := !c.stopped && !isClosed(served)
+		if err == nil && alive {
+			c.conns[conn] = struct{}{}
+		}
+		c.connMu.Unlock()
+
+		if err == nil && alive {
+			return conn
+		}
+		if conn != nil {
+			conn.Close()
+		}
+		if !alive {
+			return nil
+		}
+
+		select {
+		case <-served:
+			return nil
+		case <-time.After(connRetryInterval):
+		}
+	}
+}
+
+// removeConn removes lost connection, it returns false if it was the last
+// connection or client is stopped.
+func (c *Client) removeConn(conn net.Conn, served chan struct{}) bool {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+
+	delete(c.conns, conn)
+	if len(c.conns) == 0 {
+		close(served)
+		return false
 	}
+	c.logger.Log(
+		"level", 1,
+		"action", "connection lost",
+		"conns", len(c.conns),
+	)
+
+	return !c.stopped
+}
 
+// isClosed returns true if ch is closed.
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *Client) dial() (net.Conn, error) {
 	b := c.config.Backoff
 	if b == nil {
-		return doDial()
+		return c.dialOnce()
 	}
 
 	for {
-		conn, err := doDial()
+		conn, err := c.dialOnce()
 
 		// success
 		if err == nil {
@@ -226,10 +355,67 @@ func (c *Client) dial() (net.Conn, error) {
 			"action", "backoff",
 			"sleep", d,
 		)
-		time.Sleep(d)
+		c.metrics.backoffs.Inc()
+		c.metrics.backoffSleep.Add(d.Seconds())
+		select {
+		case <-c.stop:
+			return nil, errClientStopped
+		case <-time.After(d):
+		}
 	}
 }
 
+func (c *Client) dialOnce() (conn net.Conn, err error) {
+	var (
+		network   = "tcp"
+		addr      = c.config.ServerAddr
+		tlsConfig = c.config.TLSClientConfig
+	)
+
+	c.logger.Log(
+		"level", 1,
+		"action", "dial",
+		"network", network,
+		"addr", addr,
+	)
+
+	if c.config.DialTLS != nil {
+		conn, err = c.config.DialTLS(network, addr, tlsConfig)
+	} else {
+		d := &net.Dialer{
+			Timeout: DefaultTimeout,
+		}
+		conn, err = d.Dial(network, addr)
+
+		if err == nil {
+			err = keepAlive(conn)
+		}
+		if err == nil {
+			conn = tls.Client(conn, tlsConfig)
+		}
+		if err == nil {
+			err = conn.(*tls.Conn).Handshake()
+		}
+	}
+
+	if err != nil {
+		if conn != nil {
+			conn.Close()
+			conn = nil
+		}
+
+		c.logger.Log(
+			"level", 0,
+			"msg", "dial failed",
+			"network", network,
+			"addr", addr,
+			"err", err,
+		)
+	}
+
+	return
+}
+
 func (c *Client) serveHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodConnect {
 		if r.Header.Get(proto.HeaderError) != "" {
@@ -240,6 +426,15 @@ func (c *Client) serveHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	switch r.Header.Get(proto.HeaderAction) {
+	case proto.ActionTunnels:
+		c.handleTunnelUpdates(w, r)
+		return
+	case proto.ActionOpened:
+		c.handleOpened(w, r)
+		return
+	}
+
 	msg, err := proto.ReadControlMessage(r)
 	if err != nil {
 		c.logger.Log(
@@ -257,7 +452,13 @@ func (c *Client) serveHTTP(w http.ResponseWriter, r *http.Request) {
 	)
 	switch msg.Action {
 	case proto.ActionProxy:
+		c.metrics.streams.With(msg.ForwardedProto).Inc()
 		c.config.Proxy(w, r.Body, msg)
+		c.metrics.streams.With(msg.ForwardedProto).Dec()
+	case proto.ActionProxyHTTP2:
+		c.metrics.streams.With(msg.ForwardedProto).Inc()
+		c.config.Proxy(w, &proxyRequest{r}, msg)
+		c.metrics.streams.With(msg.ForwardedProto).Dec()
 	default:
 		c.logger.Log(
 			"level", 0,
@@ -295,9 +496,34 @@ func (c *Client) handleHandshake(w http.ResponseWriter, r *http.Request) {
 		"addr", r.RemoteAddr,
 	)
 
+	offered := r.Header.Get(proto.HeaderConnGroup)
+
+	c.connMu.Lock()
+	group, served := c.group, c.served
+	if group == "" {
+		c.group = offered
+	}
+	c.connMu.Unlock()
+
+	// the first connection is established, additional connections join its
+	// group and only carry streams
+	if group != "" {
+		w.Header().Set(proto.HeaderConnGroup, group)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if offered != "" {
+		w.Header().Set(proto.HeaderConnGroup, offered)
+		for i := 1; i < c.config.Connections; i++ {
+			go c.serveConn(nil, served)
+		}
+	}
+
 	w.WriteHeader(http.StatusOK)
 
-	b, err := json.Marshal(c.config.Tunnels)
+	c.tunnelsMu.Lock()
+	b, err := json.Marshal(c.tunnels)
+	c.tunnelsMu.Unlock()
 	if err != nil {
 		c.logger.Log(
 			"level", 0,
@@ -309,7 +535,249 @@ func (c *Client) handleHandshake(w http.ResponseWriter, r *http.Request) {
 	w.Write(b)
 }
 
-// Stop disconnects client from server.
+func (c *Client) handleOpened(w http.ResponseWriter, r *http.Request) {
+	var opened map[string]*proto.Tunnel
+	if err := json.NewDecoder(r.Body).Decode(&opened); err != nil {
+		c.logger.Log(
+			"level", 1,
+			"msg", "opened tunnels decode failed",
+			"err", err,
+		)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.tunnelsMu.Lock()
+	c.opened = opened
+	c.tunnelsMu.Unlock()
+
+	for name, t := range opened {
+		c.tunnelOpened(name, t)
+	}
+}
+
+func (c *Client) tunnelOpened(name string, t *proto.Tunnel) {
+	c.logger.Log(
+		"level", 1,
+		"action", "tunnel opened",
+		"name", name,
+		"host", t.Host,
+		"addr", t.Addr,
+	)
+
+	if c.config.TunnelOpened != nil {
+		c.config.TunnelOpened(name, t)
+	}
+}
+
+// Tunnels returns tunnels opened by server with server assigned hosts and
+// addresses, it's empty until server reports opened tunnels.
+func (c *Client) Tunnels() map[string]*proto.Tunnel {
+	c.tunnelsMu.Lock()
+	defer c.tunnelsMu.Unlock()
+
+	m := make(map[string]*proto.Tunnel, len(c.opened))
+	for name, t := range c.opened {
+		m[name] = t
+	}
+	return m
+}
+
+func (c *Client) handleTunnelUpdates(w http.ResponseWriter, r *http.Request) {
+	c.logger.Log(
+		"level", 2,
+		"action", "tunnel updates",
+		"addr", r.RemoteAddr,
+	)
+
+	w.WriteHeader(http.StatusOK)
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+
+	u := &tunnelUpdates{
+		enc:     json.NewEncoder(flushWriter{w}),
+		pending: make(map[uint64]chan *proto.TunnelUpdateResult),
+	}
+
+	c.connMu.Lock()
+	c.updates = u
+	c.connMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		dec := json.NewDecoder(r.Body)
+		for {
+			var res proto.TunnelUpdateResult
+			if err := dec.Decode(&res); err != nil {
+				return
+			}
+
+			u.mu.Lock()
+			ch, ok := u.pending[res.ID]
+			delete(u.pending, res.ID)
+			u.mu.Unlock()
+
+			if ok {
+				ch <- &res
+			}
+		}
+	}()
+
+	// the stream is closed on shutdown so that it does not block GOAWAY
+	select {
+	case <-done:
+	case <-c.stop:
+	}
+
+	c.connMu.Lock()
+	if c.updates == u {
+		c.updates = nil
+	}
+	c.connMu.Unlock()
+
+	u.mu.Lock()
+	for id, ch := range u.pending {
+		close(ch)
+		delete(u.pending, id)
+	}
+	u.enc = nil
+	u.mu.Unlock()
+}
+
+// AddTunnel opens a new tunnel on server without reconnecting. If client is
+// not connected the tunnel is opened on next connect. The Proxy function must
+// be able to handle traffic of the new tunnel.
+func (c *Client) AddTunnel(name string, t *proto.Tunnel) error {
+	if t == nil {
+		return errors.New("missing tunnel")
+	}
+
+	opened, err := c.addTunnel(name, t)
+	if err != nil {
+		return err
+	}
+	if opened != nil {
+		c.tunnelOpened(name, opened)
+	}
+
+	return nil
+}
+
+func (c *Client) addTunnel(name string, t *proto.Tunnel) (*proto.Tunnel, error) {
+	c.tunnelsMu.Lock()
+	defer c.tunnelsMu.Unlock()
+
+	if _, ok := c.tunnels[name]; ok {
+		return nil, fmt.Errorf("tunnel %q already exists", name)
+	}
+
+	opened, err := c.updateTunnel(&proto.TunnelUpdate{
+		Action: proto.TunnelAdd,
+		Name:   name,
+		Tunnel: t,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c.tunnels[name] = t
+	if opened != nil {
+		if c.opened == nil {
+			c.opened = make(map[string]*proto.Tunnel)
+		}
+		c.opened[name] = opened
+	}
+
+	return opened, nil
+}
+
+// RemoveTunnel closes a tunnel on server without reconnecting.
+func (c *Client) RemoveTunnel(name string) error {
+	c.tunnelsMu.Lock()
+	defer c.tunnelsMu.Unlock()
+
+	if _, ok := c.tunnels[name]; !ok {
+		return fmt.Errorf("no such tunnel %q", name)
+	}
+
+	if _, err := c.updateTunnel(&proto.TunnelUpdate{
+		Action: proto.TunnelRemove,
+		Name:   name,
+	}); err != nil {
+		return err
+	}
+
+	delete(c.tunnels, name)
+	delete(c.opened, name)
+
+	return nil
+}
+
+// updateTunnel sends update to server and waits for the result, it returns
+// the tunnel opened by server if any. If client is not connected it returns
+// nil.
+func (c *Client) updateTunnel(update *proto.TunnelUpdate) (*proto.Tunnel, error) {
+	c.connMu.Lock()
+	connected, u := len(c.conns) > 0, c.updates
+	c.connMu.Unlock()
+
+	if !connected {
+		return nil, nil
+	}
+	if u == nil {
+		return nil, errTunnelUpdatesNotSupported
+	}
+
+	ch := make(chan *proto.TunnelUpdateResult, 1)
+
+	u.mu.Lock()
+	if u.enc == nil {
+		u.mu.Unlock()
+		return nil, errClientNotConnected
+	}
+	u.nextID++
+	update.ID = u.nextID
+	u.pending[update.ID] = ch
+	err := u.enc.Encode(update)
+	if err != nil {
+		delete(u.pending, update.ID)
+	}
+	u.mu.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	c.logger.Log(
+		"level", 1,
+		"action", "update tunnel",
+		"update", update.Action,
+		"name", update.Name,
+	)
+
+	select {
+	case res, ok := <-ch:
+		if !ok {
+			return nil, errClientNotConnected
+		}
+		if res.Error != "" {
+			return nil, fmt.Errorf("server error: %s", res.Error)
+		}
+		return res.Tunnel, nil
+	case <-time.After(DefaultTimeout):
+		u.mu.Lock()
+		delete(u.pending, update.ID)
+		u.mu.Unlock()
+		return nil, errors.New("tunnel update timeout")
+	}
+}
+
+// Stop disconnects client from server immediately, in-flight requests and
+// streams are aborted. Start returns after Stop. See Shutdown for graceful
+// stop.
 func (c *Client) Stop() {
 	c.connMu.Lock()
 	defer c.connMu.Unlock()
@@ -319,8 +787,47 @@ func (c *Client) Stop() {
 		"action", "stop",
 	)
 
-	if c.conn != nil {
-		c.conn.Close()
+	c.setStopped()
+	for conn := range c.conns {
+		conn.Close()
+	}
+}
+
+// Shutdown gracefully disconnects client from server. It sends HTTP/2 GOAWAY
+// so that server stops sending new requests and waits for in-flight requests
+// and TCP streams to finish, then the connection is closed and Start returns.
+// If ctx is done before that the connection is closed immediately and ctx
+// error is returned.
+func (c *Client) Shutdown(ctx context.Context) error {
+	c.connMu.Lock()
+	c.logger.Log(
+		"level", 1,
+		"action", "shutdown",
+	)
+	c.setStopped()
+	connected, served := len(c.conns) > 0, c.served
+	c.connMu.Unlock()
+
+	if !connected {
+		return nil
+	}
+
+	c.baseServer.Shutdown(ctx)
+
+	select {
+	case <-served:
+		return nil
+	case <-ctx.Done():
+		c.Stop()
+		return ctx.Err()
+	}
+}
+
+// setStopped prevents client from reconnecting, it must be called with connMu
+// held.
+func (c *Client) setStopped() {
+	if !c.stopped {
+		c.stopped = true
+		close(c.stop)
 	}
-	c.conn = nil
 }
@@ -5,6 +5,7 @@
 package tunnel
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"net"
@@ -84,3 +85,80 @@ func TestClient_DialBackoff(t *testing.T) {
 		t.Fatal("Error mismatch", err)
 	}
 }
+
+func TestClient_ShutdownDuringBackoff(t *testing.T) {
+	t.Parallel()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	b := tunnelmock.NewMockBackoff(ctrl)
+	b.EXPECT().NextBackOff().Return(time.Hour).AnyTimes()
+
+	dialed := make(chan struct{}, 1)
+	d := func(network, addr string, config *tls.Config) (net.Conn, error) {
+		select {
+		case dialed <- struct{}{}:
+		default:
+		}
+		return nil, errors.New("foobar")
+	}
+
+	c, err := NewClient(&ClientConfig{
+		ServerAddr:      "8.8.8.8",
+		TLSClientConfig: &tls.Config{},
+		DialTLS:         d,
+		Backoff:         b,
+		Tunnels:         map[string]*proto.Tunnel{"test": {}},
+		Proxy:           Proxy(ProxyFuncs{}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Start()
+	}()
+	<-dialed
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := c.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Start did not return")
+	}
+}
+
+func TestClient_AddTunnelConfig(t *testing.T) {
+	t.Parallel()
+
+	config := &ClientConfig{
+		ServerAddr:      "8.8.8.8",
+		TLSClientConfig: &tls.Config{},
+		Tunnels:         map[string]*proto.Tunnel{"test": {}},
+		Proxy:           Proxy(ProxyFuncs{}),
+	}
+	c, err := NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.AddTunnel("other", &proto.Tunnel{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RemoveTunnel("test"); err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Tunnels) != 1 || config.Tunnels["test"] == nil {
+		t.Fatalf("config modified %v", config.Tunnels)
+	}
+}
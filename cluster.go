@@ -0,0 +1,755 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+	"github.com/mmatczuk/go-http-tunnel/log"
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+// DefaultClusterInterval specifies how often cluster nodes publish their
+// state and load state of other nodes.
+const DefaultClusterInterval = 2 * time.Second
+
+// Headers of public requests and streams forwarded between cluster nodes,
+// headers with headerClusterPrefix are removed from public requests.
+const (
+	headerClusterPrefix       = "X-Tunnel-Cluster-"
+	headerClusterNode         = "X-Tunnel-Cluster-Node"
+	headerClusterSecret       = "X-Tunnel-Cluster-Secret"
+	headerClusterRemoteAddr   = "X-Tunnel-Cluster-Remote-Addr"
+	headerClusterProto        = "X-Tunnel-Cluster-Proto"
+	headerClusterForwardedFor = "X-Tunnel-Cluster-Forwarded-For"
+	// headerClusterNetwork is set on streams, it's tcp, udp or sni.
+	headerClusterNetwork = "X-Tunnel-Cluster-Network"
+	// headerClusterTarget is listener port or SNI host of stream.
+	headerClusterTarget = "X-Tunnel-Cluster-Target"
+)
+
+// clusterUpgrade is protocol of connection upgrade carrying TCP, SNI and UDP
+// streams between nodes.
+const clusterUpgrade = "tunnel-cluster"
+
+// ClusterConfig defines configuration of a cluster node. Nodes share state
+// through Store, each node publishes clients connected to it and hosts and
+// listeners of their tunnels. Public HTTP requests, SNI connections and
+// connections to TCP and UDP listeners of clients connected to other nodes
+// are forwarded to them, hosts and listeners owned by other nodes can not be
+// registered unless all parties enable pool.
+type ClusterConfig struct {
+	// NodeID is unique name of the node.
+	NodeID string
+	// Addr is address other nodes forward requests and streams to,
+	// Server.ClusterHandler must be served there over TLS.
+	Addr string
+	// TLSConfig specifies TLS configuration used to connect other nodes.
+	TLSConfig *tls.Config
+	// Secret is shared by all nodes, it authenticates forwarded requests.
+	Secret string
+	// Store specifies store of node states shared by the nodes.
+	Store ClusterStore
+	// Interval specifies how often the node publishes its state, if zero
+	// DefaultClusterInterval is used.
+	Interval time.Duration
+	// TTL specifies how long node state is valid since it was published,
+	// state of nodes that stopped publishing is ignored. If zero three
+	// intervals are used.
+	TTL time.Duration
+}
+
+// ClusterNode is state of a cluster node.
+type ClusterNode struct {
+	// ID is unique name of the node.
+	ID string `json:"id"`
+	// Addr is address of the node requests are forwarded to.
+	Addr string `json:"addr"`
+	// Clients are clients connected to the node.
+	Clients []id.ID `json:"clients,omitempty"`
+	// Hosts are HTTP and SNI hosts of the connected clients.
+	Hosts []*ClusterHost `json:"hosts,omitempty"`
+	// Listeners are TCP and UDP listeners of the connected clients.
+	Listeners []*ClusterListener `json:"listeners,omitempty"`
+	// Updated is the time the state was published.
+	Updated time.Time `json:"updated"`
+}
+
+// ClusterHost is HTTP or SNI host served by a cluster node.
+type ClusterHost struct {
+	Host       string `json:"host"`
+	PathPrefix string `json:"path_prefix,omitempty"`
+	Pool       bool   `json:"pool,omitempty"`
+	SNI        bool   `json:"sni,omitempty"`
+}
+
+// ClusterListener is TCP or UDP listener of a cluster node.
+type ClusterListener struct {
+	Protocol string `json:"protocol,omitempty"`
+	Addr     string `json:"addr"`
+	Pool     bool   `json:"pool,omitempty"`
+}
+
+// ClusterStore shares state of cluster nodes.
+type ClusterStore interface {
+	// Put publishes state of a node replacing the previous one.
+	Put(n *ClusterNode) error
+	// Delete removes state of a node, it's not an error if the node is
+	// unknown.
+	Delete(nodeID string) error
+	// Nodes returns state of all nodes.
+	Nodes() ([]*ClusterNode, error)
+}
+
+// nodeIDRegexp matches valid node IDs, they are used as file names.
+var nodeIDRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// FileClusterStore is ClusterStore keeping state of every node in a JSON file
+// named after the node in a directory shared by the nodes i.e. over NFS.
+type FileClusterStore struct {
+	dir string
+}
+
+// NewFileClusterStore creates a new FileClusterStore for dir, the directory
+// is created if it does not exist.
+func NewFileClusterStore(dir string) (*FileClusterStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &FileClusterStore{
+		dir: dir,
+	}, nil
+}
+
+// Put implements ClusterStore.
+func (s *FileClusterStore) Put(n *ClusterNode) error {
+	if !nodeIDRegexp.MatchString(n.ID) {
+		return fmt.Errorf("invalid node ID %q", n.ID)
+	}
+
+	b, err := json.MarshalIndent(n, "", "  ")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	// other nodes must never read a partially written file
+	f, err := ioutil.TempFile(s.dir, "."+n.ID+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), s.path(n.ID)); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return nil
+}
+
+// Delete implements ClusterStore.
+func (s *FileClusterStore) Delete(nodeID string) error {
+	if !nodeIDRegexp.MatchString(nodeID) {
+		return fmt.Errorf("invalid node ID %q", nodeID)
+	}
+
+	err := os.Remove(s.path(nodeID))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Nodes implements ClusterStore.
+func (s *FileClusterStore) Nodes() ([]*ClusterNode, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var nodes []*ClusterNode
+	for _, fi := range files {
+		name := fi.Name()
+		if fi.IsDir() || strings.HasPrefix(name, ".") || filepath.Ext(name) != ".json" {
+			continue
+		}
+
+		b, err := ioutil.ReadFile(filepath.Join(s.dir, name))
+		if os.IsNotExist(err) {
+			// node left
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var n ClusterNode
+		if err := json.Unmarshal(b, &n); err != nil {
+			return nil, fmt.Errorf("invalid node file %s: %s", name, err)
+		}
+		nodes = append(nodes, &n)
+	}
+
+	return nodes, nil
+}
+
+func (s *FileClusterStore) path(nodeID string) string {
+	return filepath.Join(s.dir, nodeID+".json")
+}
+
+// cluster publishes state of the node and routes requests to other nodes.
+type cluster struct {
+	config   *ClusterConfig
+	interval time.Duration
+	ttl      time.Duration
+	// state returns current state of the node.
+	state func() *ClusterNode
+	// synced is called after state of other nodes is loaded.
+	synced    func()
+	transport *http.Transport
+	logger    log.Logger
+
+	notify chan struct{}
+
+	mu sync.RWMutex
+	// nodes are alive nodes other than this node.
+	nodes []*ClusterNode
+}
+
+func newCluster(config *ClusterConfig, state func() *ClusterNode, logger log.Logger) (*cluster, error) {
+	if !nodeIDRegexp.MatchString(config.NodeID) {
+		return nil, fmt.Errorf("invalid node ID %q", config.NodeID)
+	}
+	if config.Addr == "" {
+		return nil, errors.New("missing address")
+	}
+	if config.TLSConfig == nil {
+		return nil, errors.New("missing TLSConfig")
+	}
+	if config.Secret == "" {
+		return nil, errors.New("missing secret")
+	}
+	if config.Store == nil {
+		return nil, errors.New("missing store")
+	}
+
+	interval := config.Interval
+	if interval <= 0 {
+		interval = DefaultClusterInterval
+	}
+	ttl := config.TTL
+	if ttl <= 0 {
+		ttl = 3 * interval
+	}
+
+	return &cluster{
+		config:   config,
+		interval: interval,
+		ttl:      ttl,
+		state:    state,
+		// HTTP/1.1 is used so that streams can upgrade connections
+		transport: &http.Transport{
+			Proxy:               nil,
+			DialContext:         (&net.Dialer{Timeout: DefaultTimeout}).DialContext,
+			TLSClientConfig:     config.TLSConfig,
+			TLSHandshakeTimeout: DefaultTimeout,
+			MaxIdleConnsPerHost: 100,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		logger: logger,
+		notify: make(chan struct{}, 1),
+	}, nil
+}
+
+// run publishes state of the node every interval and whenever it changes
+// until ctx is done, then the state is removed from the store.
+func (c *cluster) run(ctx context.Context) {
+	t := time.NewTicker(c.interval)
+	defer t.Stop()
+
+	for {
+		c.sync()
+
+		select {
+		case <-ctx.Done():
+			if err := c.config.Store.Delete(c.config.NodeID); err != nil {
+				c.logger.Log(
+					"level", 0,
+					"msg", "cluster node delete failed",
+					"node", c.config.NodeID,
+					"err", err,
+				)
+			}
+			return
+		case <-t.C:
+		case <-c.notify:
+		}
+	}
+}
+
+// changed schedules publishing state of the node.
+func (c *cluster) changed() {
+	if c == nil {
+		return
+	}
+
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
+
+// sync publishes state of the node and loads state of other nodes.
+func (c *cluster) sync() {
+	n := c.state()
+	n.ID = c.config.NodeID
+	n.Addr = c.config.Addr
+	n.Updated = time.Now()
+
+	if err := c.config.Store.Put(n); err != nil {
+		c.logger.Log(
+			"level", 0,
+			"msg", "cluster node publish failed",
+			"node", n.ID,
+			"err", err,
+		)
+	}
+
+	nodes, err := c.config.Store.Nodes()
+	if err != nil {
+		c.logger.Log(
+			"level", 0,
+			"msg", "cluster nodes load failed",
+			"err", err,
+		)
+		return
+	}
+
+	alive := make([]*ClusterNode, 0, len(nodes))
+	for _, v := range nodes {
+		if v.ID != n.ID && time.Since(v.Updated) < c.ttl {
+			alive = append(alive, v)
+		}
+	}
+
+	c.mu.Lock()
+	c.nodes = alive
+	c.mu.Unlock()
+
+	if c.synced != nil {
+		c.synced()
+	}
+}
+
+// lookup returns node serving HTTP host and path, nodes are matched in the
+// same order as tunnels in registry. If several nodes serve the host one is
+// selected at random.
+func (c *cluster) lookup(hostPort, path string) *ClusterNode {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for _, k := range clusterHostKeys(hostPort) {
+		var (
+			match  []*ClusterNode
+			prefix = -1
+		)
+		for _, n := range c.nodes {
+			for _, h := range n.Hosts {
+				p := cleanPathPrefix(h.PathPrefix)
+				if h.SNI || hostKey(h.Host) != k || !pathHasPrefix(path, p) {
+					continue
+				}
+				if len(p) > prefix {
+					match, prefix = nil, len(p)
+				}
+				if len(p) == prefix {
+					match = append(match, n)
+				}
+			}
+		}
+		if len(match) > 0 {
+			return match[rand.Intn(len(match))]
+		}
+	}
+
+	return nil
+}
+
+// lookupSNI returns node serving SNI host, exact host is preferred over
+// wildcards.
+func (c *cluster) lookupSNI(host string) *ClusterNode {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for _, k := range clusterHostKeys(host) {
+		var match []*ClusterNode
+		for _, n := range c.nodes {
+			for _, h := range n.Hosts {
+				if h.SNI && hostKey(h.Host) == k {
+					match = append(match, n)
+				}
+			}
+		}
+		if len(match) > 0 {
+			return match[rand.Intn(len(match))]
+		}
+	}
+
+	return nil
+}
+
+// clusterHostKeys returns host followed by wildcard hosts matching it from the
+// most specific one.
+func clusterHostKeys(hostPort string) []string {
+	host := hostKey(hostPort)
+	keys := []string{host}
+	labels := strings.Split(host, ".")
+	for i := 1; i < len(labels)-1; i++ {
+		keys = append(keys, "*."+strings.Join(labels[i:], "."))
+	}
+	return keys
+}
+
+// lookupListener returns node with listener of network, udp or tcp, on port.
+func (c *cluster) lookupListener(network, port string) *ClusterNode {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var match []*ClusterNode
+	for _, n := range c.nodes {
+		for _, l := range n.Listeners {
+			if listenerNetwork(l.Protocol) == network && listenerPort(l.Addr) == port {
+				match = append(match, n)
+				break
+			}
+		}
+	}
+	if len(match) == 0 {
+		return nil
+	}
+
+	return match[rand.Intn(len(match))]
+}
+
+// listeners returns TCP and UDP listeners of other nodes.
+func (c *cluster) listeners() []*ClusterListener {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var listeners []*ClusterListener
+	for _, n := range c.nodes {
+		for _, l := range n.Listeners {
+			if listenerNetwork(l.Protocol) != "" {
+				listeners = append(listeners, l)
+			}
+		}
+	}
+
+	return listeners
+}
+
+// listenerNetwork returns network, tcp or udp, of listener of tunnel
+// protocol, it returns empty string for listeners that can not be reached
+// through other nodes.
+func listenerNetwork(protocol string) string {
+	switch protocol {
+	case proto.TCP, proto.TCP4, proto.TCP6:
+		return proto.TCP
+	case proto.UDP:
+		return proto.UDP
+	default:
+		return ""
+	}
+}
+
+// listenerPort returns port of listener address.
+func listenerPort(addr string) string {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return ""
+	}
+	return port
+}
+
+// checkTunnel returns error if host or listener of t is owned by other node,
+// addr is the requested listener address.
+func (c *cluster) checkTunnel(t *registryTunnel, addr string) error {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for _, n := range c.nodes {
+		if h := t.host; h != nil {
+			host, prefix := hostKey(h.Host), cleanPathPrefix(h.PathPrefix)
+			for _, v := range n.Hosts {
+				if v.SNI {
+					continue
+				}
+				k := hostKey(v.Host)
+				if k == host && cleanPathPrefix(v.PathPrefix) == prefix && (!h.Pool || !v.Pool) {
+					return fmt.Errorf("host %q is occupied by node %s", h.Host+h.PathPrefix, n.ID)
+				}
+				if k != host && hostsOverlap(host, k) {
+					return fmt.Errorf("host %q overlaps with %q of node %s", h.Host, k, n.ID)
+				}
+			}
+		}
+		if t.sni != "" {
+			host := hostKey(t.sni)
+			for _, v := range n.Hosts {
+				if v.SNI && hostsOverlap(host, hostKey(v.Host)) {
+					return fmt.Errorf("host %q overlaps with %q of node %s", t.sni, v.Host, n.ID)
+				}
+			}
+		}
+		// allocated ports are not checked, nodes allocate them
+		// independently
+		if _, port, err := net.SplitHostPort(addr); err == nil && port != "0" && port != "" && (t.listener != nil || t.pool != "") {
+			for _, v := range n.Listeners {
+				if t.tunnel != nil && v.Protocol != "" && listenerNetwork(t.tunnel.Protocol) != listenerNetwork(v.Protocol) {
+					continue
+				}
+				if _, p, _ := net.SplitHostPort(v.Addr); p == port && (t.pool == "" || !v.Pool) {
+					return fmt.Errorf("port %s is occupied by node %s", port, n.ID)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// stripClusterHeaders removes cluster headers from h, public requests must
+// not be able to pretend they were forwarded.
+func stripClusterHeaders(h http.Header) {
+	for k := range h {
+		if strings.HasPrefix(k, headerClusterPrefix) {
+			delete(h, k)
+		}
+	}
+}
+
+// accept verifies request forwarded by other node and restores address and
+// scheme of the user, ok is false if r was not sent by a node. For streams
+// network and target are returned. Cluster headers are removed.
+func (c *cluster) accept(r *http.Request) (network, target string, ok bool) {
+	h := r.Header
+	secret := h.Get(headerClusterSecret)
+	remoteAddr := h.Get(headerClusterRemoteAddr)
+	scheme := h.Get(headerClusterProto)
+	node := h.Get(headerClusterNode)
+	network = h.Get(headerClusterNetwork)
+	target = h.Get(headerClusterTarget)
+	forwardedFor, forwarded := h[headerClusterForwardedFor]
+	stripClusterHeaders(h)
+
+	if c == nil || secret == "" {
+		return "", "", false
+	}
+	if !constantTimeEqual(secret, c.config.Secret) {
+		c.logger.Log(
+			"level", 1,
+			"msg", "invalid cluster secret",
+			"addr", r.RemoteAddr,
+			"node", node,
+		)
+		return "", "", false
+	}
+
+	if remoteAddr != "" {
+		r.RemoteAddr = remoteAddr
+	}
+	r.URL.Scheme = scheme
+	if forwarded {
+		h["X-Forwarded-For"] = forwardedFor
+	} else {
+		h.Del("X-Forwarded-For")
+	}
+
+	return network, target, true
+}
+
+// forward proxies public request r to node n.
+func (c *cluster) forward(w http.ResponseWriter, r *http.Request, n *ClusterNode, errorHandler func(w http.ResponseWriter, r *http.Request, err error)) {
+	scheme := r.URL.Scheme
+	if scheme == "" {
+		if r.TLS != nil {
+			scheme = "https"
+		} else {
+			scheme = "http"
+		}
+	}
+
+	p := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = "https"
+			req.URL.Host = n.Addr
+			req.Header.Set(headerClusterNode, c.config.NodeID)
+			req.Header.Set(headerClusterSecret, c.config.Secret)
+			req.Header.Set(headerClusterRemoteAddr, r.RemoteAddr)
+			req.Header.Set(headerClusterProto, scheme)
+			// user address is added by the receiving node, X-Forwarded-For
+			// is passed in cluster header and set to nil so that it's
+			// not appended here
+			if v, ok := req.Header["X-Forwarded-For"]; ok {
+				req.Header[headerClusterForwardedFor] = v
+			}
+			req.Header["X-Forwarded-For"] = nil
+		},
+		Transport:     c.transport,
+		FlushInterval: -1,
+		ErrorHandler:  errorHandler,
+	}
+
+	c.logger.Log(
+		"level", 2,
+		"action", "cluster forward",
+		"host", r.Host,
+		"node", n.ID,
+	)
+
+	p.ServeHTTP(w, r)
+}
+
+// stream forwards connection accepted for network and target, SNI host or
+// listener port, to node n and closes conn when done.
+func (c *cluster) stream(conn net.Conn, n *ClusterNode, network, target string) {
+	defer conn.Close()
+
+	logger := log.NewContext(c.logger).With(
+		"network", network,
+		"target", target,
+		"node", n.ID,
+		"remoteAddr", conn.RemoteAddr(),
+	)
+	logger.Log(
+		"level", 2,
+		"action", "cluster stream",
+	)
+
+	req, err := http.NewRequest(http.MethodGet, "https://"+n.Addr+"/", nil)
+	if err != nil {
+		logger.Log(
+			"level", 0,
+			"msg", "cluster stream failed",
+			"err", err,
+		)
+		return
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", clusterUpgrade)
+	req.Header.Set(headerClusterNode, c.config.NodeID)
+	req.Header.Set(headerClusterSecret, c.config.Secret)
+	req.Header.Set(headerClusterRemoteAddr, conn.RemoteAddr().String())
+	req.Header.Set(headerClusterNetwork, network)
+	req.Header.Set(headerClusterTarget, target)
+
+	resp, err := c.transport.RoundTrip(req)
+	if err != nil {
+		logger.Log(
+			"level", 0,
+			"msg", "cluster stream failed",
+			"err", err,
+		)
+		return
+	}
+	rwc, ok := resp.Body.(io.ReadWriteCloser)
+	if resp.StatusCode != http.StatusSwitchingProtocols || !ok {
+		resp.Body.Close()
+		logger.Log(
+			"level", 0,
+			"msg", "cluster stream failed",
+			"err", fmt.Errorf("status %s", resp.Status),
+		)
+		return
+	}
+	defer rwc.Close()
+
+	done := make(chan struct{})
+	go func() {
+		transfer(rwc, conn, log.NewContext(logger).With("dir", "user to node"))
+		rwc.Close()
+		close(done)
+	}()
+	transfer(conn, rwc, log.NewContext(logger).With("dir", "node to user"))
+	conn.Close()
+	<-done
+}
+
+// clusterConn is stream forwarded by other node, it reads bytes buffered by
+// HTTP server and returns address of the user as RemoteAddr.
+type clusterConn struct {
+	net.Conn
+	r      io.Reader
+	remote net.Addr
+}
+
+func (c *clusterConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *clusterConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// clusterRemoteAddr parses address of the user of stream of network,
+// fallback is returned if addr is invalid.
+func clusterRemoteAddr(network, addr string, fallback net.Addr) net.Addr {
+	if network == proto.UDP {
+		if a, err := net.ResolveUDPAddr("udp", addr); err == nil {
+			return a
+		}
+		return fallback
+	}
+	if a, err := net.ResolveTCPAddr("tcp", addr); err == nil {
+		return a
+	}
+	return fallback
+}
@@ -0,0 +1,245 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/log"
+)
+
+func TestFileClusterStore(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "cluster")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewFileClusterStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Put(&ClusterNode{ID: "../a"}); err == nil {
+		t.Fatal("expected error")
+	}
+
+	a := &ClusterNode{
+		ID:        "a",
+		Addr:      "10.0.0.1:7000",
+		Hosts:     []*ClusterHost{{Host: "foo.com", PathPrefix: "/api"}},
+		Listeners: []*ClusterListener{{Addr: "0.0.0.0:2222"}},
+		Updated:   time.Now(),
+	}
+	if err := s.Put(a); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(&ClusterNode{ID: "b", Addr: "10.0.0.2:7000"}); err != nil {
+		t.Fatal(err)
+	}
+	a.Addr = "10.0.0.3:7000"
+	if err := s.Put(a); err != nil {
+		t.Fatal(err)
+	}
+
+	nodes, err := s.Nodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 2 {
+		t.Fatalf("expected 2 nodes got %d", len(nodes))
+	}
+	if n := nodes[0]; n.ID != "a" || n.Addr != "10.0.0.3:7000" || len(n.Hosts) != 1 || n.Hosts[0].PathPrefix != "/api" || len(n.Listeners) != 1 {
+		t.Fatalf("unexpected node %+v", n)
+	}
+
+	if err := s.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if nodes, err = s.Nodes(); err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 1 || nodes[0].ID != "b" {
+		t.Fatalf("unexpected nodes %+v", nodes)
+	}
+}
+
+func testCluster(t *testing.T, nodes ...*ClusterNode) *cluster {
+	dir, err := ioutil.TempDir("", "cluster")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	store, err := NewFileClusterStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range nodes {
+		if err := store.Put(n); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, err := newCluster(&ClusterConfig{
+		NodeID:    "self",
+		Addr:      "127.0.0.1:7000",
+		Secret:    "secret",
+		Store:     store,
+		TLSConfig: &tls.Config{},
+	}, func() *ClusterNode { return &ClusterNode{} }, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.sync()
+
+	return c
+}
+
+func TestClusterLookup(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	c := testCluster(t,
+		&ClusterNode{ID: "a", Updated: now, Hosts: []*ClusterHost{
+			{Host: "foo.com"},
+			{Host: "*.bar.com"},
+			{Host: "tls.com", SNI: true},
+		}},
+		&ClusterNode{ID: "b", Updated: now, Hosts: []*ClusterHost{
+			{Host: "foo.com", PathPrefix: "/api"},
+			{Host: "x.bar.com"},
+		}},
+		&ClusterNode{ID: "dead", Updated: now.Add(-time.Hour), Hosts: []*ClusterHost{
+			{Host: "dead.com"},
+		}},
+	)
+
+	tests := []struct {
+		host string
+		path string
+		node string
+	}{
+		{"foo.com", "/", "a"},
+		{"FOO.com:8080", "/api/v1", "b"},
+		{"foo.com", "/apiv1", "a"},
+		{"x.bar.com", "/", "b"},
+		{"y.bar.com", "/", "a"},
+		{"tls.com", "/", ""},
+		{"dead.com", "/", ""},
+		{"self.com", "/", ""},
+	}
+	for _, tt := range tests {
+		var node string
+		if n := c.lookup(tt.host, tt.path); n != nil {
+			node = n.ID
+		}
+		if node != tt.node {
+			t.Errorf("%s%s: expected node %q got %q", tt.host, tt.path, tt.node, node)
+		}
+	}
+
+	var nilCluster *cluster
+	if nilCluster.lookup("foo.com", "/") != nil {
+		t.Error("nil cluster lookup")
+	}
+}
+
+func TestClusterCheckTunnel(t *testing.T) {
+	t.Parallel()
+
+	c := testCluster(t, &ClusterNode{ID: "a", Updated: time.Now(),
+		Hosts: []*ClusterHost{
+			{Host: "foo.com"},
+			{Host: "pool.com", Pool: true},
+			{Host: "*.bar.com"},
+			{Host: "tls.com", SNI: true},
+		},
+		Listeners: []*ClusterListener{
+			{Addr: "[::]:2222"},
+			{Addr: "[::]:3333", Pool: true},
+		},
+	})
+
+	tests := []struct {
+		name string
+		rt   *registryTunnel
+		addr string
+		ok   bool
+	}{
+		{"host", &registryTunnel{host: &HostAuth{Host: "foo.com"}}, "", false},
+		{"prefix", &registryTunnel{host: &HostAuth{Host: "foo.com", PathPrefix: "/api"}}, "", true},
+		{"pool", &registryTunnel{host: &HostAuth{Host: "pool.com", Pool: true}}, "", true},
+		{"not pool", &registryTunnel{host: &HostAuth{Host: "pool.com"}}, "", false},
+		{"wildcard", &registryTunnel{host: &HostAuth{Host: "x.bar.com"}}, "", false},
+		{"free host", &registryTunnel{host: &HostAuth{Host: "baz.com"}}, "", true},
+		{"sni", &registryTunnel{sni: "tls.com"}, "", false},
+		{"port", &registryTunnel{listener: &udpListener{}}, "0.0.0.0:2222", false},
+		{"any port", &registryTunnel{listener: &udpListener{}}, ":0", true},
+		{"shared port", &registryTunnel{pool: "tcp://:3333"}, ":3333", true},
+		{"free port", &registryTunnel{listener: &udpListener{}}, ":4444", true},
+	}
+	for _, tt := range tests {
+		err := c.checkTunnel(tt.rt, tt.addr)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		}
+	}
+}
+
+func TestClusterAccept(t *testing.T) {
+	t.Parallel()
+
+	c := testCluster(t)
+
+	r := httptest.NewRequest(http.MethodGet, "http://foo.com/", nil)
+	r.Header.Set(headerClusterSecret, "secret")
+	r.Header.Set(headerClusterRemoteAddr, "1.2.3.4:5678")
+	r.Header.Set(headerClusterProto, "https")
+	r.Header.Set(headerClusterForwardedFor, "10.0.0.1")
+	r.Header.Set("X-Forwarded-For", "10.0.0.2")
+	if network, _, ok := c.accept(r); !ok || network != "" {
+		t.Fatal("forwarded request not accepted")
+	}
+	if r.RemoteAddr != "1.2.3.4:5678" || r.URL.Scheme != "https" || r.Header.Get(headerClusterSecret) != "" {
+		t.Fatalf("unexpected request %+v", r)
+	}
+	if v := r.Header["X-Forwarded-For"]; len(v) != 1 || v[0] != "10.0.0.1" {
+		t.Fatalf("unexpected X-Forwarded-For %v", v)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "http://foo.com/", nil)
+	r.Header.Set(headerClusterSecret, "secret")
+	r.Header.Set(headerClusterNetwork, "tcp")
+	r.Header.Set(headerClusterTarget, "2222")
+	r.Header.Set("X-Forwarded-For", "10.0.0.2")
+	if network, target, ok := c.accept(r); !ok || network != "tcp" || target != "2222" {
+		t.Fatalf("stream not accepted %s %s", network, target)
+	}
+	if r.Header.Get("X-Forwarded-For") != "" {
+		t.Fatal("X-Forwarded-For not removed")
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "http://foo.com/", nil)
+	r.Header.Set(headerClusterSecret, "guess")
+	r.Header.Set(headerClusterRemoteAddr, "1.2.3.4:5678")
+	if _, _, ok := c.accept(r); ok {
+		t.Fatal("invalid secret accepted")
+	}
+	if r.RemoteAddr == "1.2.3.4:5678" || r.Header.Get(headerClusterRemoteAddr) != "" {
+		t.Fatalf("unexpected request %+v", r)
+	}
+}
@@ -7,11 +7,14 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
+	"net"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"gopkg.in/yaml.v2"
 
+	"github.com/mmatczuk/go-http-tunnel"
 	"github.com/mmatczuk/go-http-tunnel/proto"
 )
 
@@ -23,6 +26,10 @@ const (
 	DefaultBackoffMaxTime     = 15 * time.Minute
 )
 
+// DefaultShutdownTimeout specifies how long in-flight requests are drained on
+// SIGINT or SIGTERM.
+const DefaultShutdownTimeout = 30 * time.Second
+
 // BackoffConfig defines behavior of staggering reconnection retries.
 type BackoffConfig struct {
 	Interval    time.Duration `yaml:"interval"`
@@ -31,23 +38,67 @@ type BackoffConfig struct {
 	MaxTime     time.Duration `yaml:"max_time"`
 }
 
+// InspectConfig defines request inspector configuration.
+type InspectConfig struct {
+	Addr        string `yaml:"addr,omitempty"`
+	Capacity    int    `yaml:"capacity,omitempty"`
+	MaxBodySize int64  `yaml:"max_body_size,omitempty"`
+	Token       string `yaml:"token,omitempty"`
+}
+
+// autoHost is HTTP tunnel host requesting server assigned host.
+const autoHost = "auto"
+
+// PROXY protocol versions of TCP and SNI tunnels.
+const (
+	proxyProtocolV1 = "v1"
+	proxyProtocolV2 = "v2"
+)
+
 // Tunnel defines a tunnel.
 type Tunnel struct {
-	Protocol   string `yaml:"proto,omitempty"`
-	Addr       string `yaml:"addr,omitempty"`
-	Auth       string `yaml:"auth,omitempty"`
-	Host       string `yaml:"host,omitempty"`
-	RemoteAddr string `yaml:"remote_addr,omitempty"`
+	Protocol      string        `yaml:"proto,omitempty"`
+	Addr          string        `yaml:"addr,omitempty"`
+	Auth          string        `yaml:"auth,omitempty"`
+	AuthFile      string        `yaml:"auth_file,omitempty"`
+	JWT           bool          `yaml:"jwt,omitempty"`
+	Host          string        `yaml:"host,omitempty"`
+	RemoteAddr    string        `yaml:"remote_addr,omitempty"`
+	PathPrefix    string        `yaml:"path_prefix,omitempty"`
+	StripPrefix   bool          `yaml:"strip_prefix,omitempty"`
+	Pool          bool          `yaml:"pool,omitempty"`
+	HTTP2         bool          `yaml:"http2,omitempty"`
+	FlushInterval time.Duration `yaml:"flush_interval,omitempty"`
+	ProxyProto    string        `yaml:"proxy_protocol,omitempty"`
+	Allow         []string      `yaml:"allow,omitempty"`
+	Deny          []string      `yaml:"deny,omitempty"`
+
+	RequestHeaders  []*HeaderRule `yaml:"request_headers,omitempty"`
+	ResponseHeaders []*HeaderRule `yaml:"response_headers,omitempty"`
+}
+
+// HeaderRule defines rewrite rule of HTTP request or response header.
+type HeaderRule struct {
+	Action string `yaml:"action"`
+	Name   string `yaml:"name"`
+	Value  string `yaml:"value,omitempty"`
 }
 
 // ClientConfig is a tunnel client configuration.
 type ClientConfig struct {
-	ServerAddr string             `yaml:"server_addr"`
-	TLSCrt     string             `yaml:"tls_crt"`
-	TLSKey     string             `yaml:"tls_key"`
-	RootCA     string             `yaml:"root_ca"`
-	Backoff    BackoffConfig      `yaml:"backoff"`
-	Tunnels    map[string]*Tunnel `yaml:"tunnels"`
+	ServerAddr  string             `yaml:"server_addr"`
+	TLSCrt      string             `yaml:"tls_crt"`
+	TLSKey      string             `yaml:"tls_key"`
+	RootCA      string             `yaml:"root_ca"`
+	Backoff     BackoffConfig      `yaml:"backoff"`
+	Tunnels     map[string]*Tunnel `yaml:"tunnels"`
+	MetricsAddr string             `yaml:"metrics_addr,omitempty"`
+	Inspect     InspectConfig      `yaml:"inspect,omitempty"`
+	// ShutdownTimeout specifies how long in-flight requests are drained
+	// on shutdown.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout,omitempty"`
+	// Connections specifies number of parallel connections to server.
+	Connections int `yaml:"connections,omitempty"`
 }
 
 func loadClientConfigFromFile(file string) (*ClientConfig, error) {
@@ -65,6 +116,7 @@ func loadClientConfigFromFile(file string) (*ClientConfig, error) {
 			MaxInterval: DefaultBackoffMaxInterval,
 			MaxTime:     DefaultBackoffMaxTime,
 		},
+		ShutdownTimeout: DefaultShutdownTimeout,
 	}
 
 	if err = yaml.Unmarshal(buf, &c); err != nil {
@@ -77,6 +129,9 @@ func loadClientConfigFromFile(file string) (*ClientConfig, error) {
 	if c.ServerAddr, err = normalizeAddress(c.ServerAddr); err != nil {
 		return nil, fmt.Errorf("server_addr: %s", err)
 	}
+	if c.Connections < 0 || c.Connections > tunnel.MaxClientConns {
+		return nil, fmt.Errorf("connections: must be between 1 and %d", tunnel.MaxClientConns)
+	}
 
 	for name, t := range c.Tunnels {
 		switch t.Protocol {
@@ -84,7 +139,7 @@ func loadClientConfigFromFile(file string) (*ClientConfig, error) {
 			if err := validateHTTP(t); err != nil {
 				return nil, fmt.Errorf("%s %s", name, err)
 			}
-		case proto.TCP, proto.TCP4, proto.TCP6:
+		case proto.TCP, proto.TCP4, proto.TCP6, proto.UDP:
 			if err := validateTCP(t); err != nil {
 				return nil, fmt.Errorf("%s %s", name, err)
 			}
@@ -95,6 +150,12 @@ func loadClientConfigFromFile(file string) (*ClientConfig, error) {
 		default:
 			return nil, fmt.Errorf("%s invalid protocol %q", name, t.Protocol)
 		}
+		if err := validateCIDRs(t.Allow); err != nil {
+			return nil, fmt.Errorf("%s allow: %s", name, err)
+		}
+		if err := validateCIDRs(t.Deny); err != nil {
+			return nil, fmt.Errorf("%s deny: %s", name, err)
+		}
 	}
 
 	return &c, nil
@@ -102,8 +163,10 @@ func loadClientConfigFromFile(file string) (*ClientConfig, error) {
 
 func validateHTTP(t *Tunnel) error {
 	var err error
-	if t.Host == "" {
-		return fmt.Errorf("host: missing")
+	if t.Host == autoHost {
+		t.Host = ""
+	} else if err = validateHost(t.Host); err != nil {
+		return fmt.Errorf("host: %s", err)
 	}
 	if t.Addr == "" {
 		return fmt.Errorf("addr: missing")
@@ -111,20 +174,66 @@ func validateHTTP(t *Tunnel) error {
 	if t.Addr, err = normalizeURL(t.Addr); err != nil {
 		return fmt.Errorf("addr: %s", err)
 	}
+	if err = validatePathPrefix(t.PathPrefix); err != nil {
+		return fmt.Errorf("path_prefix: %s", err)
+	}
+	if t.StripPrefix && t.PathPrefix == "" {
+		return fmt.Errorf("strip_prefix: requires path_prefix")
+	}
+	if t.JWT && (t.Auth != "" || t.AuthFile != "") {
+		return fmt.Errorf("jwt: exclusive with auth")
+	}
+	if err = tunnel.ValidateHeaderRules(headerRules(t.RequestHeaders)); err != nil {
+		return fmt.Errorf("request_headers: %s", err)
+	}
+	if err = tunnel.ValidateHeaderRules(headerRules(t.ResponseHeaders)); err != nil {
+		return fmt.Errorf("response_headers: %s", err)
+	}
 
 	// unexpected
 
 	if t.RemoteAddr != "" {
 		return fmt.Errorf("remote_addr: unexpected")
 	}
+	if t.ProxyProto != "" {
+		return fmt.Errorf("proxy_protocol: unexpected")
+	}
 
 	return nil
 }
 
+func validateCIDRs(s []string) error {
+	for _, v := range s {
+		if strings.Contains(v, "/") {
+			if _, _, err := net.ParseCIDR(v); err != nil {
+				return err
+			}
+		} else if net.ParseIP(v) == nil {
+			return fmt.Errorf("invalid address %q", v)
+		}
+	}
+	return nil
+}
+
+func validatePathPrefix(prefix string) error {
+	if prefix == "" {
+		return nil
+	}
+	if !strings.HasPrefix(prefix, "/") {
+		return fmt.Errorf("must start with /")
+	}
+	if strings.ContainsAny(prefix, "?#") {
+		return fmt.Errorf("must not contain query or fragment")
+	}
+	return nil
+}
+
 func validateTCP(t *Tunnel) error {
 	var err error
-	if t.RemoteAddr, err = normalizeAddress(t.RemoteAddr); err != nil {
-		return fmt.Errorf("remote_addr: %s", err)
+	if t.RemoteAddr != "" {
+		if t.RemoteAddr, err = normalizeAddress(t.RemoteAddr); err != nil {
+			return fmt.Errorf("remote_addr: %s", err)
+		}
 	}
 	if t.Addr == "" {
 		return fmt.Errorf("addr: missing")
@@ -132,6 +241,9 @@ func validateTCP(t *Tunnel) error {
 	if t.Addr, err = normalizeAddress(t.Addr); err != nil {
 		return fmt.Errorf("addr: %s", err)
 	}
+	if err = validateProxyProtocol(t.ProxyProto); err != nil {
+		return fmt.Errorf("proxy_protocol: %s", err)
+	}
 
 	// unexpected
 
@@ -141,14 +253,41 @@ func validateTCP(t *Tunnel) error {
 	if t.Auth != "" {
 		return fmt.Errorf("auth: unexpected")
 	}
+	if t.AuthFile != "" {
+		return fmt.Errorf("auth_file: unexpected")
+	}
+	if t.JWT {
+		return fmt.Errorf("jwt: unexpected")
+	}
+	if t.PathPrefix != "" {
+		return fmt.Errorf("path_prefix: unexpected")
+	}
+	if len(t.RequestHeaders) > 0 {
+		return fmt.Errorf("request_headers: unexpected")
+	}
+	if len(t.ResponseHeaders) > 0 {
+		return fmt.Errorf("response_headers: unexpected")
+	}
+	if t.HTTP2 {
+		return fmt.Errorf("http2: unexpected")
+	}
+	if t.FlushInterval != 0 {
+		return fmt.Errorf("flush_interval: unexpected")
+	}
+	if t.Protocol == proto.UDP && t.Pool {
+		return fmt.Errorf("pool: unexpected")
+	}
+	if t.Protocol == proto.UDP && t.ProxyProto != "" {
+		return fmt.Errorf("proxy_protocol: unexpected")
+	}
 
 	return nil
 }
 
 func validateSNI(t *Tunnel) error {
 	var err error
-	if t.Host == "" {
-		return fmt.Errorf("host: missing")
+	if err = validateHost(t.Host); err != nil {
+		return fmt.Errorf("host: %s", err)
 	}
 	if t.Addr == "" {
 		return fmt.Errorf("addr: missing")
@@ -156,6 +295,9 @@ func validateSNI(t *Tunnel) error {
 	if t.Addr, err = normalizeAddress(t.Addr); err != nil {
 		return fmt.Errorf("addr: %s", err)
 	}
+	if err = validateProxyProtocol(t.ProxyProto); err != nil {
+		return fmt.Errorf("proxy_protocol: %s", err)
+	}
 
 	// unexpected
 
@@ -165,6 +307,69 @@ func validateSNI(t *Tunnel) error {
 	if t.Auth != "" {
 		return fmt.Errorf("auth: unexpected")
 	}
+	if t.AuthFile != "" {
+		return fmt.Errorf("auth_file: unexpected")
+	}
+	if t.JWT {
+		return fmt.Errorf("jwt: unexpected")
+	}
+	if t.PathPrefix != "" {
+		return fmt.Errorf("path_prefix: unexpected")
+	}
+	if len(t.RequestHeaders) > 0 {
+		return fmt.Errorf("request_headers: unexpected")
+	}
+	if len(t.ResponseHeaders) > 0 {
+		return fmt.Errorf("response_headers: unexpected")
+	}
+	if t.Pool {
+		return fmt.Errorf("pool: unexpected")
+	}
+	if t.HTTP2 {
+		return fmt.Errorf("http2: unexpected")
+	}
+	if t.FlushInterval != 0 {
+		return fmt.Errorf("flush_interval: unexpected")
+	}
+
+	return nil
+}
+
+// headerRules converts rules to protocol format.
+func headerRules(rules []*HeaderRule) []proto.HeaderRule {
+	if len(rules) == 0 {
+		return nil
+	}
+
+	v := make([]proto.HeaderRule, len(rules))
+	for i, r := range rules {
+		v[i] = proto.HeaderRule{
+			Action: r.Action,
+			Name:   r.Name,
+			Value:  r.Value,
+		}
+	}
+	return v
+}
+
+func validateProxyProtocol(v string) error {
+	switch v {
+	case "", proxyProtocolV1, proxyProtocolV2:
+		return nil
+	default:
+		return fmt.Errorf("invalid version %q, expected %s or %s", v, proxyProtocolV1, proxyProtocolV2)
+	}
+}
 
+func validateHost(host string) error {
+	if host == "" {
+		return fmt.Errorf("missing")
+	}
+	if !strings.Contains(host, "*") {
+		return nil
+	}
+	if !strings.HasPrefix(host, "*.") || strings.Contains(host[2:], "*") || !strings.Contains(host[2:], ".") {
+		return fmt.Errorf("invalid wildcard, expected form *.example.com")
+	}
 	return nil
 }
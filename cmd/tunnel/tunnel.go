@@ -5,14 +5,19 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
 	"io/ioutil"
 	"net"
+	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"sort"
+	"strings"
+	"syscall"
 
 	"gopkg.in/yaml.v2"
 
@@ -20,6 +25,7 @@ import (
 	"github.com/mmatczuk/go-http-tunnel"
 	"github.com/mmatczuk/go-http-tunnel/id"
 	"github.com/mmatczuk/go-http-tunnel/log"
+	"github.com/mmatczuk/go-http-tunnel/metrics"
 	"github.com/mmatczuk/go-http-tunnel/proto"
 )
 
@@ -95,18 +101,74 @@ func main() {
 	}
 	logger.Log("config", string(b))
 
+	registry := metrics.NewRegistry()
+
+	var inspector *tunnel.Inspector
+	if config.Inspect.Addr != "" {
+		inspector = tunnel.NewInspector(config.Inspect.Capacity, config.Inspect.MaxBodySize, logger)
+		inspector.Addr = config.Inspect.Addr
+		inspector.Token = config.Inspect.Token
+	}
+
 	client, err := tunnel.NewClient(&tunnel.ClientConfig{
 		ServerAddr:      config.ServerAddr,
 		TLSClientConfig: tlsconf,
 		Backoff:         expBackoff(config.Backoff),
+		Connections:     config.Connections,
 		Tunnels:         tunnels(config.Tunnels),
-		Proxy:           proxy(config.Tunnels, logger),
+		Proxy:           proxy(config.Tunnels, inspector, logger),
 		Logger:          logger,
+		Metrics:         registry,
+		TunnelOpened:    printTunnel,
 	})
 	if err != nil {
 		fatal("failed to create client: %s", err)
 	}
 
+	if config.MetricsAddr != "" {
+		go func() {
+			logger.Log(
+				"level", 1,
+				"action", "start metrics",
+				"addr", config.MetricsAddr,
+			)
+
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", registry)
+
+			fatal("failed to start metrics: %s", http.ListenAndServe(config.MetricsAddr, mux))
+		}()
+	}
+
+	if inspector != nil {
+		go func() {
+			logger.Log(
+				"level", 1,
+				"action", "start inspector",
+				"addr", config.Inspect.Addr,
+			)
+
+			fatal("failed to start inspector: %s", http.ListenAndServe(config.Inspect.Addr, inspector))
+		}()
+	}
+
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+
+		ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+		defer cancel()
+
+		if err := client.Shutdown(ctx); err != nil {
+			logger.Log(
+				"level", 0,
+				"msg", "shutdown timed out",
+				"err", err,
+			)
+		}
+	}()
+
 	if err := client.Start(); err != nil {
 		fatal("failed to start tunnels: %s", err)
 	}
@@ -161,38 +223,104 @@ func tunnels(m map[string]*Tunnel) map[string]*proto.Tunnel {
 			Protocol: t.Protocol,
 			Host:     t.Host,
 			Auth:     t.Auth,
+			AuthFile: t.AuthFile,
+			JWT:      t.JWT,
 			Addr:     t.RemoteAddr,
+
+			PathPrefix:  t.PathPrefix,
+			StripPrefix: t.StripPrefix,
+			Pool:        t.Pool,
+			HTTP2:       t.HTTP2,
+			Allow:       t.Allow,
+			Deny:        t.Deny,
+
+			RequestHeaders:  headerRules(t.RequestHeaders),
+			ResponseHeaders: headerRules(t.ResponseHeaders),
 		}
 	}
 
 	return p
 }
 
-func proxy(m map[string]*Tunnel, logger log.Logger) tunnel.ProxyFunc {
+func proxy(m map[string]*Tunnel, inspector *tunnel.Inspector, logger log.Logger) tunnel.ProxyFunc {
 	httpURL := make(map[string]*url.URL)
 	tcpAddr := make(map[string]string)
+	udpAddr := make(map[string]string)
+	named := make(map[string]tunnel.ProxyFunc)
 
-	for _, t := range m {
+	httpLogger := log.NewContext(logger).WithPrefix("proxy", "HTTP")
+	tcpLogger := log.NewContext(logger).WithPrefix("proxy", "TCP")
+	udpLogger := log.NewContext(logger).WithPrefix("proxy", "UDP")
+
+	for name, t := range m {
 		switch t.Protocol {
 		case proto.HTTP:
 			u, err := url.Parse(t.Addr)
 			if err != nil {
 				fatal("invalid tunnel address: %s", err)
 			}
-			httpURL[t.Host] = u
+			if t.Host != "" {
+				httpURL[t.Host+strings.TrimRight(t.PathPrefix, "/")] = u
+			}
+			p := tunnel.NewHTTPProxy(u, httpLogger)
+			p.Inspector = inspector
+			if t.HTTP2 {
+				p.EnableHTTP2()
+			}
+			if t.FlushInterval != 0 {
+				p.FlushInterval = t.FlushInterval
+			}
+			named[name] = p.Proxy
 		case proto.TCP, proto.TCP4, proto.TCP6:
 			tcpAddr[t.RemoteAddr] = t.Addr
+			p := tunnel.NewTCPProxy(t.Addr, tcpLogger)
+			p.ProxyProtocol = proxyProtocol(t.ProxyProto)
+			named[name] = p.Proxy
+		case proto.UDP:
+			udpAddr[t.RemoteAddr] = t.Addr
+			named[name] = tunnel.NewUDPProxy(t.Addr, udpLogger).Proxy
 		case proto.SNI:
 			tcpAddr[t.Host] = t.Addr
+			p := tunnel.NewTCPProxy(t.Addr, tcpLogger)
+			p.ProxyProtocol = proxyProtocol(t.ProxyProto)
+			named[name] = p.Proxy
 		}
 	}
 
+	httpProxy := tunnel.NewMultiHTTPProxy(httpURL, httpLogger)
+	httpProxy.Inspector = inspector
+
 	return tunnel.Proxy(tunnel.ProxyFuncs{
-		HTTP: tunnel.NewMultiHTTPProxy(httpURL, log.NewContext(logger).WithPrefix("proxy", "HTTP")).Proxy,
-		TCP:  tunnel.NewMultiTCPProxy(tcpAddr, log.NewContext(logger).WithPrefix("proxy", "TCP")).Proxy,
+		HTTP:    httpProxy.Proxy,
+		TCP:     tunnel.NewMultiTCPProxy(tcpAddr, tcpLogger).Proxy,
+		UDP:     tunnel.NewMultiUDPProxy(udpAddr, udpLogger).Proxy,
+		Tunnels: named,
 	})
 }
 
+func proxyProtocol(v string) int {
+	switch v {
+	case proxyProtocolV1:
+		return tunnel.ProxyProtocolV1
+	case proxyProtocolV2:
+		return tunnel.ProxyProtocolV2
+	default:
+		return 0
+	}
+}
+
+// printTunnel prints public address of a tunnel opened by server.
+func printTunnel(name string, t *proto.Tunnel) {
+	switch t.Protocol {
+	case proto.HTTP:
+		fmt.Printf("%s\thttp://%s%s\n", name, t.Host, t.PathPrefix)
+	case proto.SNI:
+		fmt.Printf("%s\t%s\n", name, t.Host)
+	default:
+		fmt.Printf("%s\t%s\n", name, t.Addr)
+	}
+}
+
 func fatal(format string, a ...interface{}) {
 	fmt.Fprintf(os.Stderr, format, a...)
 	fmt.Fprint(os.Stderr, "\n")
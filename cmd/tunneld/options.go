@@ -8,6 +8,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"time"
 )
 
 const usage1 string = `Usage: tunneld [OPTIONS]
@@ -18,8 +19,20 @@ const usage2 string = `
 Example:
 	tunneld
 	tunneld -clients YMBKT3V-ESUTZ2Z-7MRILIJ-T35FHGO-D2DHO7D-FXMGSSR-V4LBSZX-BNDONQ4
+	tunneld -clientsFile /var/lib/tunneld/clients.json
 	tunneld -httpAddr :8080 -httpsAddr ""
 	tunneld -httpsAddr "" -sniAddr ":443" -rootCA client_root.crt -tlsCrt server.crt -tlsKey server.key
+	tunneld -adminAddr 127.0.0.1:5224 -adminToken secret
+	tunneld -metricsAddr 127.0.0.1:9090
+	tunneld -domain tunnel.example.com
+	tunneld -tcpPorts 10000-20000 -tcpBind 0.0.0.0
+	tunneld -deny 192.0.2.0/24 -trustedProxies 10.0.0.1
+	tunneld -proxyProtocol 10.0.0.0/8
+	tunneld -accessLog /var/log/tunneld/access.log -accessLogFormat json
+	tunneld -errorPages /etc/tunneld/errors
+	tunneld -authFiles reviewers=/etc/tunneld/reviewers.htpasswd
+	tunneld -headerRules /etc/tunneld/headers.json
+	tunneld -jwtJWKS https://auth.example.com/.well-known/jwks.json -jwtIssuers https://auth.example.com/ -jwtAudiences tunnel
 
 Author:
 	Written by M. Matczuk (mmatczuk@gmail.com)
@@ -38,16 +51,50 @@ func init() {
 
 // options specify arguments read command line arguments.
 type options struct {
-	httpAddr   string
-	httpsAddr  string
-	tunnelAddr string
-	sniAddr    string
-	tlsCrt     string
-	tlsKey     string
-	rootCA     string
-	clients    string
-	logLevel   int
-	version    bool
+	httpAddr    string
+	httpsAddr   string
+	tunnelAddr  string
+	sniAddr     string
+	tlsCrt      string
+	tlsKey      string
+	rootCA      string
+	clients     string
+	clientsFile string
+	adminAddr   string
+	adminToken  string
+	adminCA     string
+	metricsAddr string
+	poolPolicy  string
+	domain      string
+	tcpPorts    string
+	tcpBind     string
+	allow       string
+	deny        string
+	override    bool
+	trusted     string
+	proxyProto  string
+	accessLog   string
+	logFormat   string
+	logMaxSize  int
+	logBackups  int
+	errorPages  string
+	jwtJWKS     string
+	jwtIssuers  string
+	jwtAuds     string
+	jwtCookie   string
+	jwtClaims   string
+	jwtRules    string
+	authFiles   string
+	headerRules string
+	flush       time.Duration
+	clusterNode string
+	clusterAddr string
+	clusterKey  string
+	clusterDir  string
+	clusterCA   string
+	shutdown    time.Duration
+	logLevel    int
+	version     bool
 }
 
 func parseArgs() *options {
@@ -58,21 +105,89 @@ func parseArgs() *options {
 	tlsCrt := flag.String("tlsCrt", "server.crt", "Path to a TLS certificate file")
 	tlsKey := flag.String("tlsKey", "server.key", "Path to a TLS key file")
 	rootCA := flag.String("rootCA", "", "Path to the trusted certificate chian used for client certificate authentication, if empty any client certificate is accepted")
-	clients := flag.String("clients", "", "Comma-separated list of tunnel client ids, if empty accept all clients")
+	clients := flag.String("clients", "", "Comma-separated list of tunnel client ids, if empty and -clientsFile is not set accept all clients")
+	clientsFile := flag.String("clientsFile", "", "Path to JSON file storing subscribed clients and their metadata, it's updated on changes made at runtime and reloaded when edited")
+	adminAddr := flag.String("adminAddr", "", "Address listening for admin API HTTPS connections, empty string to disable")
+	adminToken := flag.String("adminToken", "", "Bearer token required by admin API")
+	adminCA := flag.String("adminCA", "", "Path to the trusted certificate chain used for admin API client certificate authentication")
+	metricsAddr := flag.String("metricsAddr", "", "Address listening for Prometheus metrics HTTP requests at /metrics, empty string to disable")
+	poolPolicy := flag.String("poolPolicy", "round-robin", "Policy of selecting a client when several clients serve the same tunnel, round-robin or least-streams")
+	domain := flag.String("domain", "", "Base domain of server assigned hosts, if set HTTP tunnels without host get a random subdomain")
+	tcpPorts := flag.String("tcpPorts", "", "Range of ports TCP tunnels may listen on i.e. 10000-20000, free port is allocated if client requests port 0, empty string to allow any port")
+	tcpBind := flag.String("tcpBind", "", "Comma-separated list of addresses TCP tunnels may bind to, the first one is the default, empty string to allow any address")
+	allow := flag.String("allow", "", "Comma-separated list of CIDRs or IP addresses allowed to access tunnels, empty string to allow any address")
+	deny := flag.String("deny", "", "Comma-separated list of CIDRs or IP addresses denied access to tunnels")
+	override := flag.Bool("overrideAccess", false, "Ignore allow and deny lists of tunnels, apply only -allow and -deny")
+	trusted := flag.String("trustedProxies", "", "Comma-separated list of CIDRs or IP addresses of proxies in front of the server, X-Forwarded-For added by them is honoured")
+	proxyProto := flag.String("proxyProtocol", "", "Comma-separated list of CIDRs or IP addresses of load balancers sending PROXY protocol v1 or v2 header to public HTTP, HTTPS, SNI and TCP listeners")
+	accessLog := flag.String("accessLog", "", "Path to access log of public HTTP requests and TCP connections, empty string to disable")
+	logFormat := flag.String("accessLogFormat", "common", "Format of access log, common, combined or json")
+	logMaxSize := flag.Int("accessLogMaxSize", 100, "Size in megabytes after which access log is rotated, 0 to disable rotation")
+	logBackups := flag.Int("accessLogMaxBackups", 5, "Number of rotated access log files to keep")
+	errorPages := flag.String("errorPages", "", "Path to directory with custom error page templates of HTTP tunnels, empty string to use built-in pages")
+	jwtJWKS := flag.String("jwtJWKS", "", "Path or URL of JSON Web Key Set used to validate JWT bearer tokens of HTTP tunnels, empty string to disable JWT authentication")
+	jwtIssuers := flag.String("jwtIssuers", "", "Comma-separated list of accepted JWT issuers, empty string to accept any issuer")
+	jwtAuds := flag.String("jwtAudiences", "", "Comma-separated list of accepted JWT audiences, empty string to skip audience check")
+	jwtCookie := flag.String("jwtCookie", "", "Name of cookie JWT is read from if request has no Authorization header")
+	jwtClaims := flag.String("jwtClaims", "sub", "Comma-separated list of JWT claims forwarded to clients as X-Jwt-Claim-<name> headers")
+	jwtRules := flag.String("jwtRules", "", "Path to JSON file with per host rules of required JWT claims i.e. [{\"host\": \"*.example.com\", \"claims\": {\"groups\": [\"dev\"]}}]")
+	authFiles := flag.String("authFiles", "", "Comma-separated list of htpasswd files HTTP tunnels may reference with auth_file, in form name=path, files are reloaded when modified")
+	headerRules := flag.String("headerRules", "", "Path to JSON file with header rewrite rules of HTTP tunnels per host i.e. [{\"host\": \"*.example.com\", \"response\": [{\"action\": \"set\", \"name\": \"Strict-Transport-Security\", \"value\": \"max-age=31536000\"}]}]")
+	flush := flag.Duration("flushInterval", 0, "Flush interval of HTTP responses, negative to flush after every write, responses of unknown length i.e. server-sent events are always flushed immediately")
+	clusterNode := flag.String("clusterNode", "", "Unique name of the node in cluster, if empty host name is used")
+	clusterAddr := flag.String("clusterAddr", "", "Address listening for requests and connections forwarded by other cluster nodes over TLS with the server certificate, it must be reachable by them, empty string to disable clustering")
+	clusterKey := flag.String("clusterSecret", "", "Secret shared by cluster nodes, it authenticates forwarded requests")
+	clusterDir := flag.String("clusterDir", "", "Path to directory shared by cluster nodes i.e. over NFS, nodes publish there their clients, hosts and listeners")
+	clusterCA := flag.String("clusterCA", "", "Path to the trusted certificate chain used to verify certificates of other cluster nodes, if empty system roots are used")
+	shutdown := flag.Duration("shutdownTimeout", 30*time.Second, "Time given to in-flight requests and TCP streams to finish on SIGINT or SIGTERM")
 	logLevel := flag.Int("log-level", 1, "Level of messages to log, 0-3")
 	version := flag.Bool("version", false, "Prints tunneld version")
 	flag.Parse()
 
 	return &options{
-		httpAddr:   *httpAddr,
-		httpsAddr:  *httpsAddr,
-		tunnelAddr: *tunnelAddr,
-		sniAddr:    *sniAddr,
-		tlsCrt:     *tlsCrt,
-		tlsKey:     *tlsKey,
-		rootCA:     *rootCA,
-		clients:    *clients,
-		logLevel:   *logLevel,
-		version:    *version,
+		httpAddr:    *httpAddr,
+		httpsAddr:   *httpsAddr,
+		tunnelAddr:  *tunnelAddr,
+		sniAddr:     *sniAddr,
+		tlsCrt:      *tlsCrt,
+		tlsKey:      *tlsKey,
+		rootCA:      *rootCA,
+		clients:     *clients,
+		clientsFile: *clientsFile,
+		adminAddr:   *adminAddr,
+		adminToken:  *adminToken,
+		adminCA:     *adminCA,
+		metricsAddr: *metricsAddr,
+		poolPolicy:  *poolPolicy,
+		domain:      *domain,
+		tcpPorts:    *tcpPorts,
+		tcpBind:     *tcpBind,
+		allow:       *allow,
+		deny:        *deny,
+		override:    *override,
+		trusted:     *trusted,
+		proxyProto:  *proxyProto,
+		accessLog:   *accessLog,
+		logFormat:   *logFormat,
+		logMaxSize:  *logMaxSize,
+		logBackups:  *logBackups,
+		errorPages:  *errorPages,
+		jwtJWKS:     *jwtJWKS,
+		jwtIssuers:  *jwtIssuers,
+		jwtAuds:     *jwtAuds,
+		jwtCookie:   *jwtCookie,
+		jwtClaims:   *jwtClaims,
+		jwtRules:    *jwtRules,
+		authFiles:   *authFiles,
+		headerRules: *headerRules,
+		flush:       *flush,
+		clusterNode: *clusterNode,
+		clusterAddr: *clusterAddr,
+		clusterKey:  *clusterKey,
+		clusterDir:  *clusterDir,
+		clusterCA:   *clusterCA,
+		shutdown:    *shutdown,
+		logLevel:    *logLevel,
+		version:     *version,
 	}
 }
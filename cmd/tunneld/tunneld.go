@@ -5,19 +5,30 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 
 	"github.com/mmatczuk/go-http-tunnel"
 	"github.com/mmatczuk/go-http-tunnel/id"
 	"github.com/mmatczuk/go-http-tunnel/log"
+	"github.com/mmatczuk/go-http-tunnel/metrics"
 )
 
 func main() {
@@ -28,7 +39,7 @@ func main() {
 		return
 	}
 
-	fmt.Println(banner)
+	fmt.Print(banner)
 
 	logger := log.NewFilterLogger(log.NewStdLogger(), opts.logLevel)
 
@@ -37,21 +48,81 @@ func main() {
 		fatal("failed to configure tls: %s", err)
 	}
 
-	autoSubscribe := opts.clients == ""
+	listenPolicy, err := listenPolicy(opts)
+	if err != nil {
+		fatal("failed to configure listen policy: %s", err)
+	}
+
+	accessLog, err := accessLog(opts)
+	if err != nil {
+		fatal("failed to configure access log: %s", err)
+	}
+
+	var errorPages *tunnel.ErrorPages
+	if opts.errorPages != "" {
+		if errorPages, err = tunnel.LoadErrorPages(opts.errorPages); err != nil {
+			fatal("failed to load error pages: %s", err)
+		}
+	}
+
+	jwtConfig, err := jwtConfig(opts)
+	if err != nil {
+		fatal("failed to configure JWT authentication: %s", err)
+	}
+
+	authFiles, err := authFiles(opts)
+	if err != nil {
+		fatal("failed to load auth files: %s", err)
+	}
+
+	headerRules, err := headerRules(opts)
+	if err != nil {
+		fatal("failed to load header rules: %s", err)
+	}
+
+	autoSubscribe := opts.clients == "" && opts.clientsFile == ""
+
+	var store tunnel.SubscriptionStore
+	if opts.clientsFile != "" {
+		if store, err = tunnel.NewFileSubscriptionStore(opts.clientsFile); err != nil {
+			fatal("failed to load clients file: %s", err)
+		}
+	}
+
+	cluster, err := clusterConfig(opts)
+	if err != nil {
+		fatal("failed to configure cluster: %s", err)
+	}
+
+	registry := metrics.NewRegistry()
 
 	// setup server
 	server, err := tunnel.NewServer(&tunnel.ServerConfig{
-		Addr:          opts.tunnelAddr,
-		SNIAddr:       opts.sniAddr,
-		AutoSubscribe: autoSubscribe,
-		TLSConfig:     tlsconf,
-		Logger:        logger,
+		Addr:              opts.tunnelAddr,
+		SNIAddr:           opts.sniAddr,
+		AutoSubscribe:     autoSubscribe,
+		SubscriptionStore: store,
+		TLSConfig:         tlsconf,
+		Logger:            logger,
+		Metrics:           registry,
+		PoolPolicy:        opts.poolPolicy,
+		Domain:            opts.domain,
+		ListenPolicy:      listenPolicy,
+		AccessPolicy:      accessPolicy(opts),
+		AccessLog:         accessLog,
+		ErrorPages:        errorPages,
+		JWT:               jwtConfig,
+		AuthFiles:         authFiles,
+		ProxyProtocol:     splitList(opts.proxyProto),
+		HeaderRules:       headerRules,
+		FlushInterval:     opts.flush,
+		Cluster:           cluster,
 	})
 	if err != nil {
 		fatal("failed to create server: %s", err)
 	}
 
-	if !autoSubscribe {
+	if opts.clients != "" {
 		for _, c := range strings.Split(opts.clients, ",") {
 			if c == "" {
 				fatal("empty client id")
@@ -65,8 +136,18 @@ func main() {
 		}
 	}
 
+	// public HTTP servers are shut down with server
+	var public []*http.Server
+
 	// start HTTP
 	if opts.httpAddr != "" {
+		// h2c allows gRPC clients without TLS
+		s := &http.Server{
+			Addr:    opts.httpAddr,
+			Handler: h2c.NewHandler(server, &http2.Server{}),
+		}
+		public = append(public, s)
+
 		go func() {
 			logger.Log(
 				"level", 1,
@@ -74,12 +155,25 @@ func main() {
 				"addr", opts.httpAddr,
 			)
 
-			fatal("failed to start HTTP: %s", http.ListenAndServe(opts.httpAddr, server))
+			l, err := listen(opts.httpAddr, opts, logger)
+			if err != nil {
+				fatal("failed to start HTTP: %s", err)
+			}
+			if err := s.Serve(l); err != http.ErrServerClosed {
+				fatal("failed to start HTTP: %s", err)
+			}
 		}()
 	}
 
 	// start HTTPS
 	if opts.httpsAddr != "" {
+		s := &http.Server{
+			Addr:    opts.httpsAddr,
+			Handler: server,
+		}
+		http2.ConfigureServer(s, nil)
+		public = append(public, s)
+
 		go func() {
 			logger.Log(
 				"level", 1,
@@ -87,17 +181,158 @@ func main() {
 				"addr", opts.httpsAddr,
 			)
 
+			l, err := listen(opts.httpsAddr, opts, logger)
+			if err != nil {
+				fatal("failed to start HTTPS: %s", err)
+			}
+			if err := s.ServeTLS(l, opts.tlsCrt, opts.tlsKey); err != http.ErrServerClosed {
+				fatal("failed to start HTTPS: %s", err)
+			}
+		}()
+	}
+
+	// start cluster, requests and connections forwarded by other nodes are
+	// authenticated with the cluster secret, streams upgrade HTTP/1.1
+	// connections so HTTP/2 is disabled
+	if cluster != nil {
+		s := &http.Server{
+			Addr:         opts.clusterAddr,
+			Handler:      server.ClusterHandler(),
+			TLSNextProto: map[string]func(*http.Server, *tls.Conn, http.Handler){},
+		}
+		public = append(public, s)
+
+		go func() {
+			logger.Log(
+				"level", 1,
+				"action", "start cluster",
+				"addr", opts.clusterAddr,
+				"node", cluster.NodeID,
+			)
+
+			if err := s.ListenAndServeTLS(opts.tlsCrt, opts.tlsKey); err != http.ErrServerClosed {
+				fatal("failed to start cluster: %s", err)
+			}
+		}()
+	}
+
+	// start metrics
+	if opts.metricsAddr != "" {
+		go func() {
+			logger.Log(
+				"level", 1,
+				"action", "start metrics",
+				"addr", opts.metricsAddr,
+			)
+
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", registry)
+
+			fatal("failed to start metrics: %s", http.ListenAndServe(opts.metricsAddr, mux))
+		}()
+	}
+
+	// start admin API
+	if opts.adminAddr != "" {
+		adminconf, err := adminTLSConfig(opts)
+		if err != nil {
+			fatal("failed to configure admin tls: %s", err)
+		}
+
+		go func() {
+			logger.Log(
+				"level", 1,
+				"action", "start admin",
+				"addr", opts.adminAddr,
+			)
+
 			s := &http.Server{
-				Addr:    opts.httpsAddr,
-				Handler: server,
+				Addr:      opts.adminAddr,
+				Handler:   tunnel.NewAdminHandler(server, opts.adminToken, logger),
+				TLSConfig: adminconf,
 			}
-			http2.ConfigureServer(s, nil)
 
-			fatal("failed to start HTTPS: %s", s.ListenAndServeTLS(opts.tlsCrt, opts.tlsKey))
+			fatal("failed to start admin: %s", s.ListenAndServeTLS("", ""))
 		}()
 	}
 
-	server.Start()
+	go server.Start()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+
+	shutdown(server, public, opts.shutdown, logger)
+}
+
+// shutdown stops public HTTP servers and tunnel server waiting at most timeout
+// for in-flight requests and TCP streams.
+func shutdown(server *tunnel.Server, public []*http.Server, timeout time.Duration, logger log.Logger) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, s := range public {
+		wg.Add(1)
+		go func(s *http.Server) {
+			defer wg.Done()
+			s.Shutdown(ctx)
+		}(s)
+	}
+
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Log(
+			"level", 0,
+			"msg", "shutdown timed out",
+			"err", err,
+		)
+	}
+	wg.Wait()
+}
+
+// listen opens public listener, it reads PROXY protocol header from load
+// balancers if -proxyProtocol is set.
+func listen(addr string, opts *options, logger log.Logger) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if opts.proxyProto == "" {
+		return l, nil
+	}
+
+	return tunnel.NewProxyProtocolListener(l, splitList(opts.proxyProto), logger)
+}
+
+func adminTLSConfig(opts *options) (*tls.Config, error) {
+	if opts.adminToken == "" && opts.adminCA == "" {
+		return nil, fmt.Errorf("adminToken or adminCA must be set")
+	}
+
+	cert, err := tls.LoadX509KeyPair(opts.tlsCrt, opts.tlsKey)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if opts.adminCA != "" {
+		roots := x509.NewCertPool()
+		rootPEM, err := ioutil.ReadFile(opts.adminCA)
+		if err != nil {
+			return nil, err
+		}
+		if ok := roots.AppendCertsFromPEM(rootPEM); !ok {
+			return nil, fmt.Errorf("no certificates found in %q", opts.adminCA)
+		}
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+		c.ClientCAs = roots
+	}
+
+	return c, nil
 }
 
 func tlsConfig(opts *options) (*tls.Config, error) {
@@ -136,6 +371,180 @@ func tlsConfig(opts *options) (*tls.Config, error) {
 	}, nil
 }
 
+func listenPolicy(opts *options) (*tunnel.ListenPolicy, error) {
+	if opts.tcpPorts == "" && opts.tcpBind == "" {
+		return nil, nil
+	}
+
+	p := &tunnel.ListenPolicy{}
+	if opts.tcpPorts != "" {
+		r := strings.SplitN(opts.tcpPorts, "-", 2)
+		if len(r) != 2 {
+			return nil, fmt.Errorf("invalid port range %q, expected form min-max", opts.tcpPorts)
+		}
+		var err error
+		if p.MinPort, err = strconv.Atoi(r[0]); err != nil {
+			return nil, fmt.Errorf("invalid port range %q: %s", opts.tcpPorts, err)
+		}
+		if p.MaxPort, err = strconv.Atoi(r[1]); err != nil {
+			return nil, fmt.Errorf("invalid port range %q: %s", opts.tcpPorts, err)
+		}
+	}
+	if opts.tcpBind != "" {
+		p.BindAddrs = strings.Split(opts.tcpBind, ",")
+	}
+
+	return p, nil
+}
+
+func accessPolicy(opts *options) *tunnel.AccessPolicy {
+	if opts.allow == "" && opts.deny == "" && opts.trusted == "" && !opts.override {
+		return nil
+	}
+
+	return &tunnel.AccessPolicy{
+		Allow:          splitList(opts.allow),
+		Deny:           splitList(opts.deny),
+		Override:       opts.override,
+		TrustedProxies: splitList(opts.trusted),
+	}
+}
+
+func accessLog(opts *options) (*tunnel.AccessLog, error) {
+	if opts.accessLog == "" {
+		return nil, nil
+	}
+
+	f, err := tunnel.NewRotatingFile(opts.accessLog, int64(opts.logMaxSize)<<20, opts.logBackups)
+	if err != nil {
+		return nil, err
+	}
+
+	return tunnel.NewAccessLog(f, opts.logFormat)
+}
+
+func jwtConfig(opts *options) (*tunnel.JWTConfig, error) {
+	if opts.jwtJWKS == "" {
+		if opts.jwtRules != "" {
+			return nil, errors.New("-jwtRules requires -jwtJWKS")
+		}
+		return nil, nil
+	}
+
+	c := &tunnel.JWTConfig{
+		JWKS:          opts.jwtJWKS,
+		Issuers:       splitList(opts.jwtIssuers),
+		Audiences:     splitList(opts.jwtAuds),
+		Cookie:        opts.jwtCookie,
+		ForwardClaims: splitList(opts.jwtClaims),
+	}
+	if opts.jwtRules != "" {
+		b, err := ioutil.ReadFile(opts.jwtRules)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(b, &c.Rules); err != nil {
+			return nil, fmt.Errorf("invalid rules file: %s", err)
+		}
+	}
+
+	return c, nil
+}
+
+func authFiles(opts *options) (map[string]*tunnel.HtpasswdFile, error) {
+	if opts.authFiles == "" {
+		return nil, nil
+	}
+
+	m := make(map[string]*tunnel.HtpasswdFile)
+	for _, v := range splitList(opts.authFiles) {
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid auth file %q, expected form name=path", v)
+		}
+		f, err := tunnel.LoadHtpasswdFile(kv[1])
+		if err != nil {
+			return nil, err
+		}
+		m[kv[0]] = f
+	}
+
+	return m, nil
+}
+
+func headerRules(opts *options) ([]*tunnel.HeaderRules, error) {
+	if opts.headerRules == "" {
+		return nil, nil
+	}
+
+	b, err := ioutil.ReadFile(opts.headerRules)
+	if err != nil {
+		return nil, err
+	}
+	var rules []*tunnel.HeaderRules
+	if err := json.Unmarshal(b, &rules); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+func clusterConfig(opts *options) (*tunnel.ClusterConfig, error) {
+	if opts.clusterAddr == "" {
+		return nil, nil
+	}
+	if opts.clusterDir == "" {
+		return nil, fmt.Errorf("missing cluster directory")
+	}
+	if opts.clusterKey == "" {
+		return nil, fmt.Errorf("missing cluster secret")
+	}
+
+	node := opts.clusterNode
+	if node == "" {
+		h, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		node = h
+	}
+
+	store, err := tunnel.NewFileClusterStore(opts.clusterDir)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if opts.clusterCA != "" {
+		roots := x509.NewCertPool()
+		rootPEM, err := ioutil.ReadFile(opts.clusterCA)
+		if err != nil {
+			return nil, err
+		}
+		if ok := roots.AppendCertsFromPEM(rootPEM); !ok {
+			return nil, fmt.Errorf("no certificates found in %q", opts.clusterCA)
+		}
+		c.RootCAs = roots
+	}
+
+	return &tunnel.ClusterConfig{
+		NodeID:    node,
+		Addr:      opts.clusterAddr,
+		TLSConfig: c,
+		Secret:    opts.clusterKey,
+		Store:     store,
+	}, nil
+}
+
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
 func fatal(format string, a ...interface{}) {
 	fmt.Fprintf(os.Stderr, format, a...)
 	fmt.Fprint(os.Stderr, "\n")
@@ -0,0 +1,287 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bytes"
+	"encoding/json"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+)
+
+// Error classes of HTTP tunnels, every class has its own status code and
+// error page.
+const (
+	// ErrorUnknownHost is returned with 404 if no tunnel serves the host.
+	ErrorUnknownHost = "unknown_host"
+	// ErrorAuthRequired is returned with 401 if tunnel requires basic
+	// auth credentials or a valid JWT.
+	ErrorAuthRequired = "auth_required"
+	// ErrorForbidden is returned with 403 if the source address is not
+	// allowed to access tunnel.
+	ErrorForbidden = "forbidden"
+	// ErrorBackendUnreachable is returned with 502 if client can not reach
+	// the local backend.
+	ErrorBackendUnreachable = "backend_unreachable"
+	// ErrorClientOffline is returned with 503 if client serving the host
+	// is not connected.
+	ErrorClientOffline = "client_offline"
+	// ErrorTimeout is returned with 504 if client or backend timed out.
+	ErrorTimeout = "timeout"
+)
+
+var errorClasses = map[string]struct {
+	status  int
+	message string
+}{
+	ErrorUnknownHost:        {http.StatusNotFound, "There is no tunnel for this host."},
+	ErrorAuthRequired:       {http.StatusUnauthorized, "Authentication is required to access this tunnel."},
+	ErrorForbidden:          {http.StatusForbidden, "Access to this tunnel is not allowed from your address."},
+	ErrorBackendUnreachable: {http.StatusBadGateway, "The tunnel is up but the service behind it is unreachable."},
+	ErrorClientOffline:      {http.StatusServiceUnavailable, "The tunnel is offline, try again later."},
+	ErrorTimeout:            {http.StatusGatewayTimeout, "The service behind the tunnel did not respond in time."},
+}
+
+// ErrorPageData is passed to error page templates.
+type ErrorPageData struct {
+	Class      string
+	Status     int
+	StatusText string
+	Message    string
+	Host       string
+	Path       string
+}
+
+const (
+	defaultHTMLErrorPage = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Status}} {{.StatusText}}</title></head>
+<body>
+<h1>{{.Status}} {{.StatusText}}</h1>
+<p>{{.Message}}</p>
+</body>
+</html>
+`
+	defaultJSONErrorPage = `{"error":{{json .Class}},"status":{{.Status}},"message":{{json .Message}}}
+`
+)
+
+// errorTemplate renders an error page.
+type errorTemplate interface {
+	Execute(w *bytes.Buffer, data *ErrorPageData) error
+}
+
+type htmlErrorTemplate struct{ *htmltemplate.Template }
+
+func (t htmlErrorTemplate) Execute(w *bytes.Buffer, data *ErrorPageData) error {
+	return t.Template.Execute(w, data)
+}
+
+type jsonErrorTemplate struct{ *texttemplate.Template }
+
+func (t jsonErrorTemplate) Execute(w *bytes.Buffer, data *ErrorPageData) error {
+	return t.Template.Execute(w, data)
+}
+
+var jsonFuncs = texttemplate.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+func parseErrorTemplate(name, text string) (errorTemplate, error) {
+	if strings.HasSuffix(name, ".json") {
+		t, err := texttemplate.New(name).Funcs(jsonFuncs).Parse(text)
+		if err != nil {
+			return nil, err
+		}
+		return jsonErrorTemplate{t}, nil
+	}
+
+	t, err := htmltemplate.New(name).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return htmlErrorTemplate{t}, nil
+}
+
+var defaultErrorPages = func() map[string]errorTemplate {
+	h, _ := parseErrorTemplate("default.html", defaultHTMLErrorPage)
+	j, _ := parseErrorTemplate("default.json", defaultJSONErrorPage)
+	return map[string]errorTemplate{".html": h, ".json": j}
+}()
+
+// ErrorPages holds custom error page templates. Templates are named after
+// error class and format i.e. "client_offline.html" or "unknown_host.json",
+// HTML templates use html/template and JSON templates text/template with json
+// function, both are executed with ErrorPageData. JSON is sent if the client
+// accepts "application/json", otherwise HTML. Templates are selected per host,
+// wildcard host i.e. "*.example.com" or global templates and fall back to the
+// built-in pages.
+type ErrorPages struct {
+	// templates maps host, empty for global, to templates by file name.
+	templates map[string]map[string]errorTemplate
+}
+
+// LoadErrorPages loads templates from dir, global templates are read from
+// dir and templates of a host from a subdirectory named after the host i.e.
+// dir/demo.example.com/client_offline.html.
+func LoadErrorPages(dir string) (*ErrorPages, error) {
+	p := &ErrorPages{
+		templates: make(map[string]map[string]errorTemplate),
+	}
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		host, name := filepath.Split(rel)
+		host = strings.ToLower(strings.Trim(filepath.ToSlash(host), "/"))
+		if strings.Contains(host, "/") {
+			return nil
+		}
+
+		ext := filepath.Ext(name)
+		if ext != ".html" && ext != ".json" {
+			return nil
+		}
+		if _, ok := errorClasses[strings.TrimSuffix(name, ext)]; !ok {
+			return nil
+		}
+
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return p.Add(host, name, string(b))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Add adds template of an error class for host, if host is empty the template
+// is global. Name is error class followed by ".html" or ".json".
+func (p *ErrorPages) Add(host, name, text string) error {
+	t, err := parseErrorTemplate(name, text)
+	if err != nil {
+		return err
+	}
+
+	if p.templates == nil {
+		p.templates = make(map[string]map[string]errorTemplate)
+	}
+	m := p.templates[host]
+	if m == nil {
+		m = make(map[string]errorTemplate)
+		p.templates[host] = m
+	}
+	m[name] = t
+
+	return nil
+}
+
+func (p *ErrorPages) template(host, name string) errorTemplate {
+	if p == nil {
+		return nil
+	}
+	if t := p.templates[host][name]; t != nil {
+		return t
+	}
+	// same wildcards as registry match
+	labels := strings.Split(host, ".")
+	for i := 1; i < len(labels)-1; i++ {
+		if t := p.templates["*."+strings.Join(labels[i:], ".")][name]; t != nil {
+			return t
+		}
+	}
+	return p.templates[""][name]
+}
+
+// errorClass returns error class of an error returned by roundTrip.
+func errorClass(err error) string {
+	switch err {
+	case errClientNotSubscribed:
+		return ErrorUnknownHost
+	case errUnauthorised, errInvalidToken:
+		return ErrorAuthRequired
+	case errForbidden:
+		return ErrorForbidden
+	case errClientNotConnected:
+		return ErrorClientOffline
+	}
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return ErrorTimeout
+	}
+	return ErrorClientOffline
+}
+
+// writeError writes error page of error class to w and returns the status
+// code, error is returned if the template failed and the built-in page was
+// written instead.
+func (p *ErrorPages) writeError(w http.ResponseWriter, r *http.Request, class string) (int, error) {
+	c, ok := errorClasses[class]
+	if !ok {
+		c = errorClasses[ErrorBackendUnreachable]
+	}
+
+	ext, contentType := ".html", "text/html; charset=utf-8"
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		ext, contentType = ".json", "application/json"
+	}
+
+	host := strings.ToLower(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	t := p.template(host, class+ext)
+	if t == nil {
+		t = defaultErrorPages[ext]
+	}
+
+	var b bytes.Buffer
+	err := t.Execute(&b, &ErrorPageData{
+		Class:      class,
+		Status:     c.status,
+		StatusText: http.StatusText(c.status),
+		Message:    c.message,
+		Host:       host,
+		Path:       r.URL.Path,
+	})
+	if err != nil {
+		b.Reset()
+		defaultErrorPages[ext].Execute(&b, &ErrorPageData{
+			Class:      class,
+			Status:     c.status,
+			StatusText: http.StatusText(c.status),
+			Message:    c.message,
+		})
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(c.status)
+	w.Write(b.Bytes())
+
+	return c.status, err
+}
@@ -0,0 +1,89 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestErrorPages(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "tunnel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Mkdir(filepath.Join(dir, "demo.example.com"), 0755)
+	os.Mkdir(filepath.Join(dir, "*.example.com"), 0755)
+	for name, text := range map[string]string{
+		"client_offline.html":                  "global {{.Status}} {{.Host}}",
+		"demo.example.com/client_offline.html": "demo {{.Path}}",
+		"*.example.com/client_offline.html":    "wildcard {{.Host}}",
+		"ignored.html":                         "{{",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p, err := LoadErrorPages(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		pages  *ErrorPages
+		host   string
+		path   string
+		accept string
+		class  string
+		status int
+		body   string
+	}{
+		{p, "other.com:8080", "/", "", ErrorClientOffline, http.StatusServiceUnavailable, "global 503 other.com"},
+		{p, "demo.example.com", "/<b>", "", ErrorClientOffline, http.StatusServiceUnavailable, "demo /&lt;b&gt;"},
+		{p, "a.b.example.com", "/", "", ErrorClientOffline, http.StatusServiceUnavailable, "wildcard a.b.example.com"},
+		{p, "example.com", "/", "", ErrorClientOffline, http.StatusServiceUnavailable, "global 503 example.com"},
+		{p, "demo.example.com", "/", "", ErrorUnknownHost, http.StatusNotFound, "There is no tunnel for this host."},
+		{nil, "demo.example.com", "/", "", ErrorTimeout, http.StatusGatewayTimeout, "<h1>504 Gateway Timeout</h1>"},
+		{nil, "demo.example.com", "/", "application/json", ErrorBackendUnreachable, http.StatusBadGateway, `"error":"backend_unreachable"`},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "http://"+tt.host+tt.path, nil)
+		r.Header.Set("Accept", tt.accept)
+		w := httptest.NewRecorder()
+
+		status, err := tt.pages.writeError(w, r, tt.class)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != tt.status || w.Code != tt.status {
+			t.Errorf("%s %s: expected status %d got %d", tt.host, tt.class, tt.status, w.Code)
+		}
+		if !strings.Contains(w.Body.String(), tt.body) {
+			t.Errorf("%s %s: expected %q in %q", tt.host, tt.class, tt.body, w.Body.String())
+		}
+		if tt.accept != "" {
+			var v map[string]interface{}
+			if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil {
+				t.Errorf("invalid JSON %q: %s", w.Body.String(), err)
+			}
+		}
+	}
+
+	if err := p.Add("", "timeout.html", "{{"); err == nil {
+		t.Error("expected error")
+	}
+}
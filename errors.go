@@ -10,6 +10,15 @@ var (
 	errClientNotSubscribed    = errors.New("client not subscribed")
 	errClientNotConnected     = errors.New("client not connected")
 	errClientAlreadyConnected = errors.New("client already connected")
+	errServerClosed           = errors.New("server closed")
+	errClientStopped          = errors.New("client stopped")
+
+	errTunnelUpdatesNotSupported = errors.New("tunnel updates not supported by server")
 
 	errUnauthorised = errors.New("unauthorised")
+	errInvalidToken = errors.New("invalid token")
+	errForbidden    = errors.New("forbidden")
+
+	errNotFound         = errors.New("not found")
+	errMethodNotAllowed = errors.New("method not allowed")
 )
@@ -8,6 +8,7 @@ require (
 	github.com/felixge/tcpkeepalive v0.0.0-20160804073959-5bb0b2dea91e
 	github.com/golang/mock v1.2.0
 	github.com/inconshreveable/go-vhost v0.0.0-20160627193104-06d84117953b
+	golang.org/x/crypto v0.21.0
 	golang.org/x/net v0.23.0
 	gopkg.in/yaml.v2 v2.2.2
 )
@@ -0,0 +1,182 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+	"unicode/utf8"
+)
+
+// HAR 1.2 types, see http://www.softwareishard.com/blog/har-12-spec/.
+type (
+	har struct {
+		Log harLog `json:"log"`
+	}
+
+	harLog struct {
+		Version string     `json:"version"`
+		Creator harCreator `json:"creator"`
+		Entries []harEntry `json:"entries"`
+	}
+
+	harCreator struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	}
+
+	harEntry struct {
+		StartedDateTime string      `json:"startedDateTime"`
+		Time            float64     `json:"time"`
+		Request         harRequest  `json:"request"`
+		Response        harResponse `json:"response"`
+		Cache           struct{}    `json:"cache"`
+		Timings         harTimings  `json:"timings"`
+	}
+
+	harRequest struct {
+		Method      string         `json:"method"`
+		URL         string         `json:"url"`
+		HTTPVersion string         `json:"httpVersion"`
+		Cookies     []harNameValue `json:"cookies"`
+		Headers     []harNameValue `json:"headers"`
+		QueryString []harNameValue `json:"queryString"`
+		PostData    *harPostData   `json:"postData,omitempty"`
+		HeadersSize int            `json:"headersSize"`
+		BodySize    int64          `json:"bodySize"`
+	}
+
+	harResponse struct {
+		Status      int            `json:"status"`
+		StatusText  string         `json:"statusText"`
+		HTTPVersion string         `json:"httpVersion"`
+		Cookies     []harNameValue `json:"cookies"`
+		Headers     []harNameValue `json:"headers"`
+		Content     harContent     `json:"content"`
+		RedirectURL string         `json:"redirectURL"`
+		HeadersSize int            `json:"headersSize"`
+		BodySize    int64          `json:"bodySize"`
+	}
+
+	harNameValue struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+
+	harPostData struct {
+		MimeType string `json:"mimeType"`
+		Text     string `json:"text"`
+	}
+
+	harContent struct {
+		Size     int64  `json:"size"`
+		MimeType string `json:"mimeType"`
+		Text     string `json:"text,omitempty"`
+		Encoding string `json:"encoding,omitempty"`
+	}
+
+	harTimings struct {
+		Send    float64 `json:"send"`
+		Wait    float64 `json:"wait"`
+		Receive float64 `json:"receive"`
+	}
+)
+
+// newHAR converts exchanges to HAR, entries are sorted from the oldest.
+func newHAR(exchanges []*Exchange) *har {
+	h := &har{
+		Log: harLog{
+			Version: "1.2",
+			Creator: harCreator{Name: "go-http-tunnel", Version: "1"},
+			Entries: make([]harEntry, 0, len(exchanges)),
+		},
+	}
+
+	exchanges = append([]*Exchange(nil), exchanges...)
+	sort.SliceStable(exchanges, func(i, j int) bool {
+		return exchanges[i].Time.Before(exchanges[j].Time)
+	})
+	for _, x := range exchanges {
+		h.Log.Entries = append(h.Log.Entries, newHAREntry(x))
+	}
+
+	return h
+}
+
+func newHAREntry(x *Exchange) harEntry {
+	ms := x.Duration.Seconds() * 1000
+
+	e := harEntry{
+		StartedDateTime: x.Time.UTC().Format(time.RFC3339Nano),
+		Time:            ms,
+		Request: harRequest{
+			Method:      x.Request.Method,
+			URL:         x.Request.URL,
+			HTTPVersion: x.Request.Proto,
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(x.Request.Header),
+			QueryString: []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    x.Request.Size,
+		},
+		Response: harResponse{
+			Status:      x.Response.Status,
+			StatusText:  http.StatusText(x.Response.Status),
+			HTTPVersion: x.Request.Proto,
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(x.Response.Header),
+			Content: harContent{
+				Size:     x.Response.Size,
+				MimeType: x.Response.Header.Get("Content-Type"),
+			},
+			RedirectURL: x.Response.Header.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    x.Response.Size,
+		},
+		Timings: harTimings{Wait: ms},
+	}
+
+	if u, err := url.Parse(x.Request.URL); err == nil {
+		for k, vv := range u.Query() {
+			for _, v := range vv {
+				e.Request.QueryString = append(e.Request.QueryString, harNameValue{k, v})
+			}
+		}
+	}
+
+	if len(x.Request.Body) > 0 {
+		e.Request.PostData = &harPostData{
+			MimeType: x.Request.Header.Get("Content-Type"),
+			Text:     string(x.Request.Body),
+		}
+	}
+
+	if b := x.Response.Body; len(b) > 0 {
+		if utf8.Valid(b) {
+			e.Response.Content.Text = string(b)
+		} else {
+			e.Response.Content.Text = base64.StdEncoding.EncodeToString(b)
+			e.Response.Content.Encoding = "base64"
+		}
+	}
+
+	return e
+}
+
+func harHeaders(h http.Header) []harNameValue {
+	v := []harNameValue{}
+	for k, vv := range h {
+		for _, s := range vv {
+			v = append(v, harNameValue{k, s})
+		}
+	}
+	sort.Slice(v, func(i, j int) bool {
+		return v[i].Name < v[j].Name
+	})
+	return v
+}
@@ -0,0 +1,77 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+// HeaderRules specifies header rewrite rules of hosts configured on the
+// server. They are applied after rules of the tunnel so they take precedence
+// i.e. security headers like Strict-Transport-Security can be enforced.
+type HeaderRules struct {
+	// Host specifies host the rules apply to, it may be a wildcard like
+	// "*.example.com", if empty the rules apply to all hosts.
+	Host string
+	// Request specifies rules of request headers.
+	Request []proto.HeaderRule
+	// Response specifies rules of response headers.
+	Response []proto.HeaderRule
+}
+
+// ValidateHeaderRules returns error if any of rules is invalid.
+func ValidateHeaderRules(rules []proto.HeaderRule) error {
+	for _, r := range rules {
+		if r.Name == "" {
+			return fmt.Errorf("missing header name")
+		}
+		switch r.Action {
+		case proto.HeaderSet, proto.HeaderAdd, proto.HeaderRemove:
+		case proto.HeaderRename:
+			if r.Value == "" {
+				return fmt.Errorf("rename %s: missing new name", r.Name)
+			}
+		default:
+			return fmt.Errorf("%s: invalid action %q", r.Name, r.Action)
+		}
+	}
+	return nil
+}
+
+// headerVars returns replacer of placeholders in header rule values.
+func headerVars(remoteAddr, clientID, host string) *strings.Replacer {
+	return strings.NewReplacer(
+		"{remote_addr}", remoteAddr,
+		"{client_id}", clientID,
+		"{host}", host,
+	)
+}
+
+// rewriteHeaders applies rules to h in order.
+func rewriteHeaders(h http.Header, rules []proto.HeaderRule, vars *strings.Replacer) {
+	for _, r := range rules {
+		switch r.Action {
+		case proto.HeaderSet:
+			h.Set(r.Name, vars.Replace(r.Value))
+		case proto.HeaderAdd:
+			h.Add(r.Name, vars.Replace(r.Value))
+		case proto.HeaderRemove:
+			h.Del(r.Name)
+		case proto.HeaderRename:
+			v := h[http.CanonicalHeaderKey(r.Name)]
+			if len(v) == 0 {
+				continue
+			}
+			h.Del(r.Name)
+			for _, s := range v {
+				h.Add(r.Value, s)
+			}
+		}
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+func TestRewriteHeaders(t *testing.T) {
+	rules := []proto.HeaderRule{
+		{Action: proto.HeaderSet, Name: "X-Real-Ip", Value: "{remote_addr}"},
+		{Action: proto.HeaderAdd, Name: "Via", Value: "tunnel {client_id}"},
+		{Action: proto.HeaderRemove, Name: "x-powered-by"},
+		{Action: proto.HeaderRename, Name: "X-Old", Value: "X-New"},
+		{Action: proto.HeaderRename, Name: "X-Missing", Value: "X-Other"},
+		{Action: proto.HeaderSet, Name: "Content-Security-Policy", Value: "default-src 'self' {host}"},
+	}
+	if err := ValidateHeaderRules(rules); err != nil {
+		t.Fatal(err)
+	}
+
+	h := http.Header{
+		"X-Real-Ip":    {"spoofed"},
+		"Via":          {"1.1 lb"},
+		"X-Powered-By": {"PHP"},
+		"X-Old":        {"a", "b"},
+	}
+	rewriteHeaders(h, rules, headerVars("192.0.2.1", "ID", "demo.example.com"))
+
+	expected := http.Header{
+		"X-Real-Ip":               {"192.0.2.1"},
+		"Via":                     {"1.1 lb", "tunnel ID"},
+		"X-New":                   {"a", "b"},
+		"Content-Security-Policy": {"default-src 'self' demo.example.com"},
+	}
+	if !reflect.DeepEqual(h, expected) {
+		t.Fatalf("expected %v got %v", expected, h)
+	}
+}
+
+func TestValidateHeaderRules(t *testing.T) {
+	tests := []proto.HeaderRule{
+		{Action: proto.HeaderSet},
+		{Action: "replace", Name: "X-Foo"},
+		{Action: proto.HeaderRename, Name: "X-Foo"},
+	}
+
+	for _, tt := range tests {
+		if err := ValidateHeaderRules([]proto.HeaderRule{tt}); err == nil {
+			t.Errorf("%+v: expected error", tt)
+		}
+	}
+}
@@ -7,6 +7,8 @@ package tunnel
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
+	"errors"
 	"io"
 	"net"
 	"net/http"
@@ -14,6 +16,8 @@ import (
 	"net/url"
 	"path"
 
+	"golang.org/x/net/http2"
+
 	"github.com/mmatczuk/go-http-tunnel/log"
 	"github.com/mmatczuk/go-http-tunnel/proto"
 )
@@ -29,9 +33,12 @@ type HTTPProxy struct {
 	// * host and port
 	// * port
 	// * host
+	// * tunnel host, the wildcard host request was matched with
 	localURLMap map[string]*url.URL
 	// logger is the proxy logger.
 	logger log.Logger
+	// Inspector specifies optional Inspector capturing proxied requests.
+	Inspector *Inspector
 }
 
 // NewHTTPProxy creates a new direct HTTPProxy, everything will be proxied to
@@ -46,6 +53,7 @@ func NewHTTPProxy(localURL *url.URL, logger log.Logger) *HTTPProxy {
 		logger:   logger,
 	}
 	p.ReverseProxy.Director = p.Director
+	p.ReverseProxy.ErrorHandler = p.ErrorHandler
 
 	return p
 }
@@ -62,6 +70,7 @@ func NewMultiHTTPProxy(localURLMap map[string]*url.URL, logger log.Logger) *HTTP
 		logger:      logger,
 	}
 	p.ReverseProxy.Director = p.Director
+	p.ReverseProxy.ErrorHandler = p.ErrorHandler
 
 	return p
 }
@@ -89,30 +98,182 @@ func (p *HTTPProxy) Proxy(w io.Writer, r io.ReadCloser, msg *proto.ControlMessag
 		)
 	}
 
-	req, err := http.ReadRequest(bufio.NewReader(r))
-	if err != nil {
-		p.logger.Log(
-			"level", 0,
-			"msg", "failed to read request",
-			"ctrlMsg", msg,
-			"err", err,
-		)
-		return
+	var (
+		req *http.Request
+		br  *bufio.Reader
+		err error
+	)
+	if pr, ok := r.(*proxyRequest); ok {
+		req = pr.userRequest(msg)
+	} else {
+		br = bufio.NewReader(r)
+		req, err = http.ReadRequest(br)
+		if err != nil {
+			p.logger.Log(
+				"level", 0,
+				"msg", "failed to read request",
+				"ctrlMsg", msg,
+				"err", err,
+			)
+			return
+		}
 	}
 
 	setXForwardedFor(req.Header, msg.RemoteAddr)
 	req.URL.Host = msg.ForwardedHost
+	if msg.TunnelHost != "" || msg.PathPrefix != "" {
+		req = req.WithContext(context.WithValue(req.Context(), ctrlMsgKey{}, msg))
+	}
+	if len(req.Trailer) > 0 {
+		req = req.WithContext(context.WithValue(req.Context(), trailerKey{}, req.Trailer))
+	}
+
+	if br != nil && upgradeType(req.Header) != "" {
+		p.proxyUpgrade(rw, br, req, msg)
+		return
+	}
+
+	if p.Inspector != nil {
+		p.Inspector.serve(p, rw, req, msg, 0)
+		return
+	}
 
 	p.ServeHTTP(rw, req)
 }
 
+// proxyUpgrade proxies connection upgrade request i.e. WebSocket handshake
+// over a raw connection to the local service. Response of the service and
+// data that follows it are streamed back as is, server reads the response and
+// switches protocols of the user connection, r carries the user data.
+func (p *HTTPProxy) proxyUpgrade(w http.ResponseWriter, r io.Reader, req *http.Request, msg *proto.ControlMessage) {
+	p.Director(req)
+	if req.URL.Scheme == "" {
+		p.ErrorHandler(w, req, errors.New("no target"))
+		return
+	}
+
+	local, err := dialURL(req.URL)
+	if err != nil {
+		p.ErrorHandler(w, req, err)
+		return
+	}
+	defer local.Close()
+
+	if err := req.Write(local); err != nil {
+		p.ErrorHandler(w, req, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		transfer(flushWriter{w}, local, log.NewContext(p.logger).With(
+			"dst", msg.ForwardedHost,
+			"src", req.URL.Host,
+		))
+		close(done)
+	}()
+
+	transfer(local, r, log.NewContext(p.logger).With(
+		"dst", req.URL.Host,
+		"src", msg.ForwardedHost,
+	))
+
+	// let local service know there is nothing more to read so that the
+	// stream finishes when it closes the connection
+	if c, ok := local.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+	}
+
+	<-done
+}
+
+// dialURL connects to host of HTTP or HTTPS URL u.
+func dialURL(u *url.URL) (net.Conn, error) {
+	host, port := u.Hostname(), u.Port()
+	d := &net.Dialer{Timeout: DefaultTimeout}
+
+	if u.Scheme == proto.HTTPS {
+		if port == "" {
+			port = "443"
+		}
+		return tls.DialWithDialer(d, "tcp", net.JoinHostPort(host, port), &tls.Config{ServerName: host})
+	}
+
+	if port == "" {
+		port = "80"
+	}
+	return d.Dial("tcp", net.JoinHostPort(host, port))
+}
+
+// userRequest returns the user request server passed as HTTP/2 request.
+func (r *proxyRequest) userRequest(msg *proto.ControlMessage) *http.Request {
+	req := r.WithContext(r.Context())
+	req.Header = cloneHeader(r.Header)
+	proto.DeleteFromHeader(req.Header)
+	u := *r.URL
+	req.URL = &u
+	req.Host = msg.ForwardedHost
+	// the address is the server, X-Forwarded-For is set from msg
+	req.RemoteAddr = ""
+
+	return req
+}
+
+// EnableHTTP2 makes proxy talk HTTP/2 to local services, h2c with prior
+// knowledge for HTTP URLs and HTTP/2 over TLS for HTTPS URLs, and flush
+// responses immediately so that streaming calls i.e. gRPC work.
+func (p *HTTPProxy) EnableHTTP2() {
+	p.Transport = &http2Transport{
+		h2c: &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return net.DialTimeout(network, addr, DefaultTimeout)
+			},
+		},
+		h2: &http2.Transport{},
+	}
+	p.FlushInterval = -1
+}
+
+// http2Transport sends requests with HTTP scheme over h2c.
+type http2Transport struct {
+	h2c *http2.Transport
+	h2  *http2.Transport
+}
+
+func (t *http2Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.URL.Scheme == proto.HTTP {
+		return t.h2c.RoundTrip(r)
+	}
+	return t.h2.RoundTrip(r)
+}
+
+// ctrlMsgKey is request context key holding ControlMessage the request was
+// received with.
+type ctrlMsgKey struct{}
+
+// trailerKey is request context key holding trailers of the request, they are
+// set when the body is read so ReverseProxy copy of the request must share
+// them.
+type trailerKey struct{}
+
 // Director is ReverseProxy Director it changes request URL so that the request
 // is correctly routed based on localURL and localURLMap. If no URL can be found
 // the request is canceled.
 func (p *HTTPProxy) Director(req *http.Request) {
 	orig := *req.URL
 
-	target := p.localURLFor(req.URL)
+	var tunnelHost, pathPrefix string
+	if msg, ok := req.Context().Value(ctrlMsgKey{}).(*proto.ControlMessage); ok {
+		tunnelHost, pathPrefix = msg.TunnelHost, msg.PathPrefix
+	}
+
+	target := p.localURLFor(req.URL, tunnelHost, pathPrefix)
 	if target == nil {
 		p.logger.Log(
 			"level", 1,
@@ -143,6 +304,10 @@ func (p *HTTPProxy) Director(req *http.Request) {
 
 	req.Host = req.URL.Host
 
+	if t, ok := req.Context().Value(trailerKey{}).(http.Header); ok {
+		req.Trailer = t
+	}
+
 	p.logger.Log(
 		"level", 2,
 		"action", "url rewrite",
@@ -151,6 +316,26 @@ func (p *HTTPProxy) Director(req *http.Request) {
 	)
 }
 
+// ErrorHandler is ReverseProxy ErrorHandler it responds with 502 or 504 on
+// timeout and marks the response with proto.HeaderProxyError so that server
+// can replace it with an error page.
+func (p *HTTPProxy) ErrorHandler(w http.ResponseWriter, req *http.Request, err error) {
+	p.logger.Log(
+		"level", 0,
+		"msg", "backend request failed",
+		"url", req.URL,
+		"err", err,
+	)
+
+	status := http.StatusBadGateway
+	if e, ok := err.(net.Error); (ok && e.Timeout()) || err == context.DeadlineExceeded {
+		status = http.StatusGatewayTimeout
+	}
+
+	w.Header().Set(proto.HeaderProxyError, err.Error())
+	w.WriteHeader(status)
+}
+
 func singleJoiningSlash(a, b string) string {
 	if a == "" || a == "/" {
 		return b
@@ -162,11 +347,25 @@ func singleJoiningSlash(a, b string) string {
 	return path.Join(a, b)
 }
 
-func (p *HTTPProxy) localURLFor(u *url.URL) *url.URL {
+func (p *HTTPProxy) localURLFor(u *url.URL, tunnelHost, pathPrefix string) *url.URL {
 	if len(p.localURLMap) == 0 {
 		return p.localURL
 	}
 
+	// try host and tunnel host with path prefix
+	if pathPrefix != "" {
+		host := u.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if addr := p.localURLMap[host+pathPrefix]; addr != nil {
+			return addr
+		}
+		if addr := p.localURLMap[tunnelHost+pathPrefix]; tunnelHost != "" && addr != nil {
+			return addr
+		}
+	}
+
 	// try host and port
 	hostPort := u.Host
 	if addr := p.localURLMap[hostPort]; addr != nil {
@@ -184,5 +383,10 @@ func (p *HTTPProxy) localURLFor(u *url.URL) *url.URL {
 		return addr
 	}
 
+	// try tunnel host i.e. wildcard
+	if addr := p.localURLMap[tunnelHost]; tunnelHost != "" && addr != nil {
+		return addr
+	}
+
 	return p.localURL
 }
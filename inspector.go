@@ -0,0 +1,474 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/log"
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+// Inspector defaults.
+const (
+	DefaultInspectorCapacity    = 100
+	DefaultInspectorMaxBodySize = 1 << 20
+)
+
+var (
+	errExchangeNotFound = errors.New("no such request")
+	errBodyTruncated    = errors.New("request body was truncated, it cannot be replayed")
+	errInspectorHost    = errors.New("host not allowed")
+	errCrossOrigin      = errors.New("cross origin request, use the web UI or token")
+)
+
+// HeaderInspectorToken is header carrying Inspector token.
+const HeaderInspectorToken = "X-Inspector-Token"
+
+// Exchange is a captured HTTP request and response.
+type Exchange struct {
+	ID         uint64            `json:"id"`
+	Time       time.Time         `json:"time"`
+	Duration   time.Duration     `json:"duration"`
+	RemoteAddr string            `json:"remote_addr,omitempty"`
+	Tunnel     string            `json:"tunnel,omitempty"`
+	Request    *CapturedRequest  `json:"request"`
+	Response   *CapturedResponse `json:"response"`
+	// ReplayOf is set for replayed requests, it's ID of the original
+	// exchange.
+	ReplayOf uint64 `json:"replay_of,omitempty"`
+
+	proxy *HTTPProxy
+	msg   *proto.ControlMessage
+}
+
+// CapturedRequest is a captured HTTP request.
+type CapturedRequest struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Proto  string      `json:"proto"`
+	Header http.Header `json:"header"`
+	CapturedBody
+}
+
+// CapturedResponse is a captured HTTP response.
+type CapturedResponse struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	CapturedBody
+}
+
+// CapturedBody holds body up to size limit of Inspector.
+type CapturedBody struct {
+	Body []byte `json:"body"`
+	// Size is the size of the whole body.
+	Size int64 `json:"size"`
+	// Truncated is true if Body holds only a part of the body.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// Inspector captures HTTP requests and responses passing through HTTPProxy
+// into a bounded in-memory ring, the oldest exchanges are dropped when the
+// ring is full. It is http.Handler serving a web UI and JSON API:
+//
+//	GET    /                           web UI
+//	GET    /api/requests               list captured requests, newest first
+//	DELETE /api/requests               clear captured requests
+//	GET    /api/requests/{id}          show captured request
+//	POST   /api/requests/{id}/replay   replay request against local backend
+//	GET    /api/har                    export captured requests as HAR
+//
+// Requests with Host other than an IP address, localhost or the host of Addr
+// are rejected to protect against DNS rebinding. Replay and clear must be sent
+// by the web UI, from the same origin, or carry Token in X-Inspector-Token
+// header.
+type Inspector struct {
+	// Addr is the address the inspector is served on.
+	Addr string
+	// Token if set allows replay and clear requests from other origins
+	// i.e. curl.
+	Token string
+
+	capacity    int
+	maxBodySize int64
+	logger      log.Logger
+
+	mu        sync.Mutex
+	exchanges []*Exchange
+	next      int
+	lastID    uint64
+}
+
+// NewInspector creates Inspector keeping up to capacity exchanges with bodies
+// up to maxBodySize bytes. If capacity or maxBodySize is 0 the defaults are
+// used.
+func NewInspector(capacity int, maxBodySize int64, logger log.Logger) *Inspector {
+	if capacity <= 0 {
+		capacity = DefaultInspectorCapacity
+	}
+	if maxBodySize <= 0 {
+		maxBodySize = DefaultInspectorMaxBodySize
+	}
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+
+	return &Inspector{
+		capacity:    capacity,
+		maxBodySize: maxBodySize,
+		logger:      logger,
+	}
+}
+
+// serve serves request r with proxy p capturing the request and response.
+func (i *Inspector) serve(p *HTTPProxy, w http.ResponseWriter, r *http.Request, msg *proto.ControlMessage, replayOf uint64) *Exchange {
+	x := &Exchange{
+		Time:       time.Now(),
+		RemoteAddr: msg.RemoteAddr,
+		Tunnel:     msg.TunnelName,
+		Request: &CapturedRequest{
+			Method: r.Method,
+			URL:    publicURL(r, msg),
+			Proto:  r.Proto,
+			Header: cloneHeader(r.Header),
+		},
+		ReplayOf: replayOf,
+		proxy:    p,
+		msg:      msg,
+	}
+
+	reqBody := newCaptureReader(r.Body, i.maxBodySize)
+	r.Body = reqBody
+	cw := &captureResponseWriter{ResponseWriter: w, capture: capture{limit: i.maxBodySize}}
+
+	p.ServeHTTP(cw, r)
+
+	x.Duration = time.Since(x.Time)
+	x.Request.CapturedBody = reqBody.captured()
+	x.Response = cw.captured()
+
+	i.add(x)
+
+	return x
+}
+
+func (i *Inspector) add(x *Exchange) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.lastID++
+	x.ID = i.lastID
+
+	if len(i.exchanges) < i.capacity {
+		i.exchanges = append(i.exchanges, x)
+		return
+	}
+	i.exchanges[i.next] = x
+	i.next = (i.next + 1) % i.capacity
+}
+
+// Exchanges returns captured exchanges, newest first.
+func (i *Inspector) Exchanges() []*Exchange {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	v := make([]*Exchange, 0, len(i.exchanges))
+	for j := len(i.exchanges) - 1; j >= 0; j-- {
+		v = append(v, i.exchanges[(i.next+j)%len(i.exchanges)])
+	}
+	return v
+}
+
+// Exchange returns captured exchange by ID.
+func (i *Inspector) Exchange(id uint64) (*Exchange, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for _, x := range i.exchanges {
+		if x.ID == id {
+			return x, true
+		}
+	}
+	return nil, false
+}
+
+// Clear removes all captured exchanges.
+func (i *Inspector) Clear() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.exchanges = nil
+	i.next = 0
+}
+
+// Replay sends captured request with a given ID to the local backend again,
+// the replayed exchange is captured and returned.
+func (i *Inspector) Replay(id uint64) (*Exchange, error) {
+	x, ok := i.Exchange(id)
+	if !ok {
+		return nil, errExchangeNotFound
+	}
+	if x.Request.Truncated {
+		return nil, errBodyTruncated
+	}
+
+	r, err := http.NewRequest(x.Request.Method, x.Request.URL, bytes.NewReader(x.Request.Body))
+	if err != nil {
+		return nil, err
+	}
+	r.Header = cloneHeader(x.Request.Header)
+	r.URL.Host = x.msg.ForwardedHost
+	if x.msg.TunnelHost != "" || x.msg.PathPrefix != "" {
+		r = r.WithContext(context.WithValue(r.Context(), ctrlMsgKey{}, x.msg))
+	}
+
+	i.logger.Log(
+		"level", 1,
+		"action", "replay request",
+		"id", id,
+		"url", x.Request.URL,
+	)
+
+	return i.serve(x.proxy, newDiscardResponseWriter(), r, x.msg, id), nil
+}
+
+func publicURL(r *http.Request, msg *proto.ControlMessage) string {
+	scheme := msg.ForwardedProto
+	if scheme == "" {
+		scheme = proto.HTTP
+	}
+	return scheme + "://" + msg.ForwardedHost + r.URL.RequestURI()
+}
+
+// ServeHTTP implements http.Handler.
+func (i *Inspector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !i.allowedHost(r.Host) {
+		i.error(w, errInspectorHost, http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead && !i.allowedOrigin(r) {
+		i.error(w, errCrossOrigin, http.StatusForbidden)
+		return
+	}
+
+	path := strings.Trim(r.URL.Path, "/")
+
+	switch {
+	case path == "":
+		if r.Method != http.MethodGet {
+			i.error(w, errMethodNotAllowed, http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, inspectorUI)
+	case path == "api/har":
+		if r.Method != http.MethodGet {
+			i.error(w, errMethodNotAllowed, http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Disposition", `attachment; filename="tunnel.har"`)
+		i.json(w, newHAR(i.Exchanges()))
+	case path == "api/requests":
+		switch r.Method {
+		case http.MethodGet:
+			i.json(w, i.Exchanges())
+		case http.MethodDelete:
+			i.Clear()
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			i.error(w, errMethodNotAllowed, http.StatusMethodNotAllowed)
+		}
+	case strings.HasPrefix(path, "api/requests/"):
+		s := strings.Split(strings.TrimPrefix(path, "api/requests/"), "/")
+		if len(s) > 2 || (len(s) == 2 && s[1] != "replay") {
+			i.error(w, errNotFound, http.StatusNotFound)
+			return
+		}
+		id, err := strconv.ParseUint(s[0], 10, 64)
+		if err != nil {
+			i.error(w, err, http.StatusBadRequest)
+			return
+		}
+
+		if len(s) == 1 {
+			if r.Method != http.MethodGet {
+				i.error(w, errMethodNotAllowed, http.StatusMethodNotAllowed)
+				return
+			}
+			x, ok := i.Exchange(id)
+			if !ok {
+				i.error(w, errExchangeNotFound, http.StatusNotFound)
+				return
+			}
+			i.json(w, x)
+			return
+		}
+
+		if r.Method != http.MethodPost {
+			i.error(w, errMethodNotAllowed, http.StatusMethodNotAllowed)
+			return
+		}
+		x, err := i.Replay(id)
+		switch err {
+		case nil:
+			i.json(w, x)
+		case errExchangeNotFound:
+			i.error(w, err, http.StatusNotFound)
+		default:
+			i.error(w, err, http.StatusBadRequest)
+		}
+	default:
+		i.error(w, errNotFound, http.StatusNotFound)
+	}
+}
+
+// allowedHost returns true if host is an IP address, localhost or the host of
+// Addr. Names pointing to the inspector through DNS rebinding do not pass.
+func (i *Inspector) allowedHost(hostPort string) bool {
+	host := hostKey(hostPort)
+	if host == "localhost" || net.ParseIP(strings.Trim(host, "[]")) != nil {
+		return true
+	}
+	h, _, err := net.SplitHostPort(i.Addr)
+	return err == nil && h != "" && strings.EqualFold(h, host)
+}
+
+// allowedOrigin returns true if r is sent from the inspector origin or has
+// valid token.
+func (i *Inspector) allowedOrigin(r *http.Request) bool {
+	if i.Token != "" && constantTimeEqual(r.Header.Get(HeaderInspectorToken), i.Token) {
+		return true
+	}
+	origin := r.Header.Get("Origin")
+	return origin != "" && strings.EqualFold(origin, "http://"+r.Host)
+}
+
+func (i *Inspector) json(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		i.logger.Log(
+			"level", 0,
+			"msg", "inspector encode failed",
+			"err", err,
+		)
+	}
+}
+
+func (i *Inspector) error(w http.ResponseWriter, err error, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+// capture copies up to limit bytes and counts all bytes.
+type capture struct {
+	mu        sync.Mutex
+	limit     int64
+	buf       bytes.Buffer
+	size      int64
+	truncated bool
+}
+
+func (c *capture) write(p []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.size += int64(len(p))
+	if n := c.limit - int64(c.buf.Len()); n < int64(len(p)) {
+		p = p[:n]
+		c.truncated = true
+	}
+	c.buf.Write(p)
+}
+
+func (c *capture) captured() CapturedBody {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return CapturedBody{
+		Body:      append([]byte(nil), c.buf.Bytes()...),
+		Size:      c.size,
+		Truncated: c.truncated,
+	}
+}
+
+type captureReader struct {
+	io.ReadCloser
+	capture
+}
+
+func newCaptureReader(r io.ReadCloser, limit int64) *captureReader {
+	if r == nil {
+		r = ioutil.NopCloser(bytes.NewReader(nil))
+	}
+	return &captureReader{ReadCloser: r, capture: capture{limit: limit}}
+}
+
+func (r *captureReader) Read(p []byte) (n int, err error) {
+	n, err = r.ReadCloser.Read(p)
+	r.write(p[:n])
+	return
+}
+
+type captureResponseWriter struct {
+	http.ResponseWriter
+	capture
+	status int
+	header http.Header
+}
+
+func (w *captureResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+		w.header = cloneHeader(w.ResponseWriter.Header())
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *captureResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.write(p)
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *captureResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *captureResponseWriter) captured() *CapturedResponse {
+	return &CapturedResponse{
+		Status:       w.status,
+		Header:       w.header,
+		CapturedBody: w.capture.captured(),
+	}
+}
+
+// discardResponseWriter is http.ResponseWriter discarding the response.
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func newDiscardResponseWriter() *discardResponseWriter {
+	return &discardResponseWriter{header: make(http.Header)}
+}
+
+func (w *discardResponseWriter) Header() http.Header         { return w.header }
+func (w *discardResponseWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (w *discardResponseWriter) WriteHeader(int)             {}
@@ -0,0 +1,178 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+func TestInspector(t *testing.T) {
+	t.Parallel()
+
+	var hits int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusCreated)
+		io.Copy(w, r.Body)
+	}))
+	defer backend.Close()
+
+	u, _ := url.Parse(backend.URL)
+	p := NewHTTPProxy(u, nil)
+	p.Inspector = NewInspector(2, 8, nil)
+
+	do := func(body string) {
+		var b bytes.Buffer
+		r := httptest.NewRequest(http.MethodPost, "/hook?x=1", strings.NewReader(body))
+		r.Write(&b)
+		p.Proxy(httptest.NewRecorder(), ioutil.NopCloser(&b), &proto.ControlMessage{
+			ForwardedHost:  "example.com",
+			ForwardedProto: proto.HTTP,
+		})
+	}
+	do("first")
+	do("second")
+	do("long body exceeding limit")
+
+	xs := p.Inspector.Exchanges()
+	if len(xs) != 2 {
+		t.Fatalf("expected 2 exchanges got %d", len(xs))
+	}
+	if xs[0].ID != 3 || xs[1].ID != 2 {
+		t.Fatalf("unexpected order %d %d", xs[0].ID, xs[1].ID)
+	}
+
+	x := xs[1]
+	if x.Request.URL != "http://example.com/hook?x=1" || x.Request.Method != http.MethodPost {
+		t.Errorf("unexpected request %s %s", x.Request.Method, x.Request.URL)
+	}
+	if string(x.Request.Body) != "second" || x.Response.Status != http.StatusCreated || string(x.Response.Body) != "second" {
+		t.Errorf("unexpected exchange %+v %+v", x.Request, x.Response)
+	}
+
+	if b := xs[0].Response; !b.Truncated || string(b.Body) != "long bod" || b.Size != 25 {
+		t.Errorf("expected truncated body got %+v", b.CapturedBody)
+	}
+
+	// replay
+	p.Inspector.Token = "token"
+	h := httptest.NewServer(p.Inspector)
+	defer h.Close()
+
+	post := func(path string, header http.Header) *http.Response {
+		r, _ := http.NewRequest(http.MethodPost, h.URL+path, nil)
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	for _, header := range []http.Header{
+		nil,
+		{"Origin": {"http://evil.com"}},
+		{HeaderInspectorToken: {"guess"}},
+	} {
+		resp := post("/api/requests/2/replay", header)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("%v: expected replay to be forbidden got %s", header, resp.Status)
+		}
+	}
+	if atomic.LoadInt32(&hits) != 3 {
+		t.Fatalf("expected 3 backend hits got %d", hits)
+	}
+
+	resp := post("/api/requests/2/replay", http.Header{"Origin": {h.URL}})
+	var replayed Exchange
+	json.NewDecoder(resp.Body).Decode(&replayed)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || replayed.ReplayOf != 2 || string(replayed.Response.Body) != "second" {
+		t.Fatalf("unexpected replay %s %+v", resp.Status, replayed)
+	}
+	if atomic.LoadInt32(&hits) != 4 {
+		t.Fatalf("expected 4 backend hits got %d", hits)
+	}
+
+	resp = post("/api/requests/3/replay", http.Header{HeaderInspectorToken: {"token"}})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected truncated request not to be replayed got %s", resp.Status)
+	}
+
+	// HAR
+	resp, err := http.Get(h.URL + "/api/har")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v har
+	json.NewDecoder(resp.Body).Decode(&v)
+	resp.Body.Close()
+	if len(v.Log.Entries) != 2 || v.Log.Version != "1.2" {
+		t.Fatalf("unexpected HAR %+v", v)
+	}
+	if e := v.Log.Entries[0]; e.Request.PostData == nil || e.Request.PostData.Text != "long bod" || e.Response.Status != http.StatusCreated {
+		t.Errorf("unexpected HAR entry %+v", e)
+	}
+
+	// DNS rebinding
+	r, _ := http.NewRequest(http.MethodGet, h.URL+"/api/requests", nil)
+	r.Host = "rebind.example.com"
+	resp, err = http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected foreign host to be forbidden got %s", resp.Status)
+	}
+
+	// clear
+	r, _ = http.NewRequest(http.MethodDelete, h.URL+"/api/requests", nil)
+	r.Header.Set(HeaderInspectorToken, "token")
+	resp, err = http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(p.Inspector.Exchanges()) != 0 {
+		t.Fatal("expected no exchanges")
+	}
+}
+
+func TestInspectorAllowedHost(t *testing.T) {
+	t.Parallel()
+
+	i := NewInspector(0, 0, nil)
+	i.Addr = "inspect.lan:4040"
+
+	for host, allowed := range map[string]bool{
+		"localhost:4040":     true,
+		"127.0.0.1:4040":     true,
+		"[::1]:4040":         true,
+		"192.168.1.2":        true,
+		"INSPECT.lan:4040":   true,
+		"rebind.example.com": false,
+		"localhost.evil.com": false,
+	} {
+		if i.allowedHost(host) != allowed {
+			t.Errorf("%s: expected allowed %v", host, allowed)
+		}
+	}
+}
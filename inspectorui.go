@@ -0,0 +1,106 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+// inspectorUI is a single page web UI of Inspector using its JSON API.
+const inspectorUI = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>tunnel inspector</title>
+<style>
+body { font-family: sans-serif; margin: 0; display: flex; height: 100vh; }
+#list { width: 40%; overflow-y: auto; border-right: 1px solid #ccc; }
+#detail { flex: 1; overflow-y: auto; padding: 0 1em; }
+#toolbar { padding: .5em; border-bottom: 1px solid #ccc; }
+.row { padding: .4em .5em; border-bottom: 1px solid #eee; cursor: pointer; font-family: monospace; }
+.row:hover, .row.selected { background: #eef; }
+.err { color: #b00; }
+pre { background: #f6f6f6; padding: .5em; white-space: pre-wrap; word-break: break-all; }
+</style>
+</head>
+<body>
+<div id="list">
+<div id="toolbar">
+<button onclick="load()">Refresh</button>
+<button onclick="clearAll()">Clear</button>
+<a href="api/har" download="tunnel.har">Export HAR</a>
+</div>
+<div id="rows"></div>
+</div>
+<div id="detail"><p>Select a request.</p></div>
+<script>
+var selected = null;
+
+function text(s) {
+	var d = document.createElement("div");
+	d.textContent = s;
+	return d.innerHTML;
+}
+
+function body(b) {
+	if (!b.body) {
+		return "";
+	}
+	var s = atob(b.body);
+	return "<pre>" + text(s) + (b.truncated ? "\n... truncated, " + b.size + " bytes total" : "") + "</pre>";
+}
+
+function headers(h) {
+	var s = "";
+	for (var k in h || {}) {
+		h[k].forEach(function(v) { s += k + ": " + v + "\n"; });
+	}
+	return "<pre>" + text(s) + "</pre>";
+}
+
+function load() {
+	fetch("api/requests").then(function(r) { return r.json(); }).then(function(xs) {
+		document.getElementById("rows").innerHTML = xs.map(function(x) {
+			var cls = "row" + (x.response.status >= 400 ? " err" : "") + (x.id === selected ? " selected" : "");
+			return "<div class='" + cls + "' onclick='show(" + x.id + ")'>" +
+				x.response.status + " " + text(x.request.method) + " " + text(x.request.url) +
+				(x.replay_of ? " (replay of " + x.replay_of + ")" : "") + "</div>";
+		}).join("");
+	});
+}
+
+function show(id) {
+	selected = id;
+	fetch("api/requests/" + id).then(function(r) { return r.json(); }).then(function(x) {
+		document.getElementById("detail").innerHTML =
+			"<h3>" + text(x.request.method + " " + x.request.url) + "</h3>" +
+			"<p>" + new Date(x.time).toLocaleString() + ", " + (x.duration / 1e6).toFixed(1) + " ms" +
+			" <button onclick='replay(" + x.id + ")'>Replay</button></p>" +
+			"<h4>Request</h4>" + headers(x.request.header) + body(x.request) +
+			"<h4>Response " + x.response.status + "</h4>" + headers(x.response.header) + body(x.response);
+		load();
+	});
+}
+
+function replay(id) {
+	fetch("api/requests/" + id + "/replay", {method: "POST"}).then(function(r) { return r.json(); }).then(function(x) {
+		if (x.error) {
+			alert(x.error);
+			return;
+		}
+		show(x.id);
+	});
+}
+
+function clearAll() {
+	fetch("api/requests", {method: "DELETE"}).then(function() {
+		selected = null;
+		document.getElementById("detail").innerHTML = "<p>Select a request.</p>";
+		load();
+	});
+}
+
+load();
+setInterval(load, 2000);
+</script>
+</body>
+</html>
+`
@@ -5,7 +5,9 @@
 package tunnel_test
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"fmt"
 	"io"
@@ -15,13 +17,19 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
 	"github.com/mmatczuk/go-http-tunnel"
 	"github.com/mmatczuk/go-http-tunnel/log"
+	"github.com/mmatczuk/go-http-tunnel/metrics"
 	"github.com/mmatczuk/go-http-tunnel/proto"
 )
 
@@ -65,6 +73,7 @@ func echoTCP(l net.Listener) {
 		}
 		go func() {
 			io.Copy(conn, conn)
+			conn.Close()
 		}()
 	}
 }
@@ -204,6 +213,1155 @@ func TestIntegration(t *testing.T) {
 	wg.Wait()
 }
 
+func TestIntegrationTunnelUpdates(t *testing.T) {
+	// local services
+	http, tcp := makeEcho(t)
+	defer http.Close()
+	defer tcp.Close()
+
+	// server, clients are pinged to observe round trip time
+	defer func(d time.Duration) { tunnel.DefaultPingInterval = d }(tunnel.DefaultPingInterval)
+	tunnel.DefaultPingInterval = 50 * time.Millisecond
+	registry := metrics.NewRegistry()
+	s, err := tunnel.NewServer(&tunnel.ServerConfig{
+		Addr:          ":0",
+		AutoSubscribe: true,
+		TLSConfig:     tlsConfig(),
+		Logger:        log.NewStdLogger(),
+		Metrics:       registry,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	defer s.Stop()
+
+	tcpLocalAddr := freeAddr()
+	tcpAddedAddr := freeAddr()
+	addedLabel := ":" + port(tcpAddedAddr) + `"`
+
+	// client
+	c, err := tunnel.NewClient(&tunnel.ClientConfig{
+		ServerAddr:      s.Addr(),
+		TLSClientConfig: tlsConfig(),
+		Tunnels: map[string]*proto.Tunnel{
+			proto.TCP: {
+				Protocol: proto.TCP,
+				Addr:     tcpLocalAddr.String(),
+			},
+		},
+		Proxy:  tunnel.NewTCPProxy(tcp.Addr().String(), log.NewStdLogger()).Proxy,
+		Logger: log.NewStdLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go c.Start()
+	// FIXME: replace sleep with client state change watch when ready
+	time.Sleep(500 * time.Millisecond)
+	defer c.Stop()
+
+	added := &proto.Tunnel{
+		Protocol: proto.TCP,
+		Addr:     tcpAddedAddr.String(),
+	}
+	if err := c.AddTunnel("added", added); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.AddTunnel("added", added); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := c.AddTunnel("invalid", &proto.Tunnel{Protocol: "foo"}); err == nil {
+		t.Fatal("expected error")
+	}
+
+	payload := randPayload(payloadInitialSize, 1)[0]
+	testTCP(t, tcpAddedAddr, payload, 1)
+	testTCP(t, tcpLocalAddr, payload, 1)
+
+	var b bytes.Buffer
+	registry.WriteTo(&b)
+	if !strings.Contains(b.String(), addedLabel) {
+		t.Fatalf("expected metrics of added tunnel\n%s", b.String())
+	}
+	if strings.Contains(b.String(), "tunnel_server_ping_duration_seconds_count 0") {
+		t.Fatalf("expected ping observations\n%s", b.String())
+	}
+
+	if err := c.RemoveTunnel("added"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RemoveTunnel("added"); err == nil {
+		t.Fatal("expected error")
+	}
+	if conn, err := net.Dial("tcp", tcpAddedAddr.String()); err == nil {
+		conn.Close()
+		t.Fatal("expected dial error")
+	}
+	b.Reset()
+	registry.WriteTo(&b)
+	if strings.Contains(b.String(), addedLabel) {
+		t.Fatalf("expected metrics of removed tunnel to be deleted\n%s", b.String())
+	}
+
+	testTCP(t, tcpLocalAddr, payload, 1)
+}
+
+func TestIntegrationAssignedHost(t *testing.T) {
+	// local service
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	defer echo.Close()
+
+	// server
+	s, err := tunnel.NewServer(&tunnel.ServerConfig{
+		Addr:          ":0",
+		AutoSubscribe: true,
+		TLSConfig:     tlsConfig(),
+		Logger:        log.NewStdLogger(),
+		Domain:        "tunnel.test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	defer s.Stop()
+
+	h := httptest.NewServer(s)
+	defer h.Close()
+
+	// client
+	opened := make(chan *proto.Tunnel, 1)
+	c, err := tunnel.NewClient(&tunnel.ClientConfig{
+		ServerAddr:      s.Addr(),
+		TLSClientConfig: tlsConfig(),
+		Tunnels: map[string]*proto.Tunnel{
+			"web": {
+				Protocol: proto.HTTP,
+			},
+		},
+		Proxy: tunnel.Proxy(tunnel.ProxyFuncs{
+			Tunnels: map[string]tunnel.ProxyFunc{
+				"web": tunnel.NewHTTPProxy(&url.URL{Scheme: "http", Host: echo.Listener.Addr().String()}, log.NewStdLogger()).Proxy,
+			},
+		}),
+		Logger: log.NewStdLogger(),
+		TunnelOpened: func(name string, t *proto.Tunnel) {
+			opened <- t
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go c.Start()
+	defer c.Stop()
+
+	var host string
+	select {
+	case o := <-opened:
+		host = o.Host
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel not opened")
+	}
+	if !strings.HasSuffix(host, ".tunnel.test") {
+		t.Fatalf("unexpected host %q", host)
+	}
+	if got := c.Tunnels()["web"].Host; got != host {
+		t.Fatalf("expected %q got %q", host, got)
+	}
+
+	payload := randPayload(payloadInitialSize, 1)[0]
+	r, err := http.NewRequest(http.MethodPost, h.URL+"/some/path", bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Host = host
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(b, payload) {
+		t.Fatalf("unexpected response %s: %q", resp.Status, b)
+	}
+}
+
+func TestIntegrationUDP(t *testing.T) {
+	// local service
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	// server
+	s := makeTunnelServer(t)
+	defer s.Stop()
+
+	// client
+	opened := make(chan *proto.Tunnel, 1)
+	c, err := tunnel.NewClient(&tunnel.ClientConfig{
+		ServerAddr:      s.Addr(),
+		TLSClientConfig: tlsConfig(),
+		Tunnels: map[string]*proto.Tunnel{
+			"udp": {
+				Protocol: proto.UDP,
+				Addr:     "127.0.0.1:0",
+			},
+		},
+		Proxy: tunnel.Proxy(tunnel.ProxyFuncs{
+			UDP: tunnel.NewUDPProxy(echo.LocalAddr().String(), log.NewStdLogger()).Proxy,
+		}),
+		Logger: log.NewStdLogger(),
+		TunnelOpened: func(name string, t *proto.Tunnel) {
+			opened <- t
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go c.Start()
+	defer c.Stop()
+
+	var addr string
+	select {
+	case o := <-opened:
+		addr = o.Addr
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel not opened")
+	}
+
+	// every remote address gets its own session
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("udp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		buf := make([]byte, 65535)
+		for _, payload := range randPayload(payloadInitialSize, 3) {
+			if _, err := conn.Write(payload); err != nil {
+				t.Fatal(err)
+			}
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, err := conn.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf[:n], payload) {
+				t.Fatalf("unexpected datagram of size %d", n)
+			}
+		}
+	}
+}
+
+func TestIntegrationProxyProtocol(t *testing.T) {
+	// local service replies with the PROXY protocol header
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				line, _ := bufio.NewReader(conn).ReadString('\n')
+				io.WriteString(conn, line)
+				conn.Close()
+			}()
+		}
+	}()
+
+	// server
+	s := makeTunnelServer(t)
+	defer s.Stop()
+
+	// client
+	p := tunnel.NewTCPProxy(backend.Addr().String(), log.NewStdLogger())
+	p.ProxyProtocol = tunnel.ProxyProtocolV1
+
+	opened := make(chan *proto.Tunnel, 1)
+	c, err := tunnel.NewClient(&tunnel.ClientConfig{
+		ServerAddr:      s.Addr(),
+		TLSClientConfig: tlsConfig(),
+		Tunnels: map[string]*proto.Tunnel{
+			"tcp": {
+				Protocol: proto.TCP,
+				Addr:     "127.0.0.1:0",
+			},
+		},
+		Proxy: tunnel.Proxy(tunnel.ProxyFuncs{
+			Tunnels: map[string]tunnel.ProxyFunc{"tcp": p.Proxy},
+		}),
+		Logger: log.NewStdLogger(),
+		TunnelOpened: func(name string, t *proto.Tunnel) {
+			opened <- t
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go c.Start()
+	defer c.Stop()
+
+	var addr string
+	select {
+	case o := <-opened:
+		addr = o.Addr
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel not opened")
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := fmt.Sprintf("PROXY TCP4 127.0.0.1 127.0.0.1 %s %s\r\n", port(conn.LocalAddr()), port(conn.RemoteAddr()))
+	if line != expected {
+		t.Fatalf("expected %q got %q", expected, line)
+	}
+}
+
+func TestIntegrationUpgrade(t *testing.T) {
+	// local service switches to echo protocol
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" {
+			http.Error(w, "unsupported upgrade", http.StatusBadRequest)
+			return
+		}
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		io.Copy(conn, brw)
+	}))
+	defer echo.Close()
+
+	// server
+	s := makeTunnelServer(t)
+	defer s.Stop()
+
+	h := httptest.NewServer(s)
+	defer h.Close()
+
+	// client
+	opened := make(chan *proto.Tunnel, 1)
+	c, err := tunnel.NewClient(&tunnel.ClientConfig{
+		ServerAddr:      s.Addr(),
+		TLSClientConfig: tlsConfig(),
+		Tunnels: map[string]*proto.Tunnel{
+			"web": {
+				Protocol: proto.HTTP,
+				Host:     "ws.test",
+			},
+		},
+		Proxy: tunnel.Proxy(tunnel.ProxyFuncs{
+			Tunnels: map[string]tunnel.ProxyFunc{
+				"web": tunnel.NewHTTPProxy(&url.URL{Scheme: "http", Host: echo.Listener.Addr().String()}, log.NewStdLogger()).Proxy,
+			},
+		}),
+		Logger: log.NewStdLogger(),
+		TunnelOpened: func(name string, t *proto.Tunnel) {
+			opened <- t
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go c.Start()
+	defer c.Stop()
+
+	select {
+	case <-opened:
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel not opened")
+	}
+
+	upgrade := func(protocol string) (net.Conn, *bufio.Reader, *http.Response) {
+		conn, err := net.Dial("tcp", h.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		fmt.Fprintf(conn, "GET /ws HTTP/1.1\r\nHost: ws.test\r\nConnection: Upgrade\r\nUpgrade: %s\r\n\r\n", protocol)
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn, br, resp
+	}
+
+	// rejected upgrade is a regular response
+	conn, _, resp := upgrade("other")
+	conn.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 got %s", resp.Status)
+	}
+
+	conn, br, resp := upgrade("echo")
+	defer conn.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Upgrade") != "echo" {
+		t.Fatalf("unexpected response %s %v", resp.Status, resp.Header)
+	}
+
+	for _, payload := range randPayload(payloadInitialSize, 3) {
+		if _, err := conn.Write(payload); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, len(payload))
+		if _, err := io.ReadFull(br, b); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, payload) {
+			t.Fatal("echo mismatch")
+		}
+	}
+}
+
+func TestIntegrationHTTP2(t *testing.T) {
+	// local service echoes every message immediately and replies with
+	// status in trailers like gRPC
+	echo := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.Header.Get("Te") != "trailers" {
+			t.Errorf("unexpected request %s %v", r.Proto, r.Header)
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, X-Checksum")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+
+		b := make([]byte, 4)
+		for {
+			if _, err := io.ReadFull(r.Body, b); err != nil {
+				break
+			}
+			w.Write(b)
+			w.(http.Flusher).Flush()
+		}
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set("X-Checksum", r.Trailer.Get("X-Checksum"))
+	}), &http2.Server{}))
+	defer echo.Close()
+
+	// server
+	s := makeTunnelServer(t)
+	defer s.Stop()
+
+	h := httptest.NewUnstartedServer(s)
+	h.EnableHTTP2 = true
+	h.StartTLS()
+	defer h.Close()
+
+	// client
+	p := tunnel.NewHTTPProxy(&url.URL{Scheme: "http", Host: echo.Listener.Addr().String()}, log.NewStdLogger())
+	p.EnableHTTP2()
+
+	opened := make(chan *proto.Tunnel, 1)
+	c, err := tunnel.NewClient(&tunnel.ClientConfig{
+		ServerAddr:      s.Addr(),
+		TLSClientConfig: tlsConfig(),
+		Tunnels: map[string]*proto.Tunnel{
+			"grpc": {
+				Protocol: proto.HTTP,
+				Host:     "grpc.test",
+				HTTP2:    true,
+			},
+		},
+		Proxy: tunnel.Proxy(tunnel.ProxyFuncs{
+			Tunnels: map[string]tunnel.ProxyFunc{"grpc": p.Proxy},
+		}),
+		Logger: log.NewStdLogger(),
+		TunnelOpened: func(name string, t *proto.Tunnel) {
+			opened <- t
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go c.Start()
+	defer c.Stop()
+
+	select {
+	case <-opened:
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel not opened")
+	}
+
+	// bidirectional stream, every message must be echoed before the next
+	// one is sent
+	pr, pw := io.Pipe()
+	r, err := http.NewRequest(http.MethodPost, h.URL+"/echo.Echo/Stream", pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Host = "grpc.test"
+	r.Header.Set("Content-Type", "application/grpc")
+	r.Header.Set("Te", "trailers")
+	r.Trailer = http.Header{"X-Checksum": nil}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	hc := &http.Client{Transport: &http2.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := hc.Do(r.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 {
+		t.Fatalf("unexpected response %s %s", resp.Proto, resp.Status)
+	}
+
+	for _, msg := range []string{"ping", "pong", "done"} {
+		if _, err := io.WriteString(pw, msg); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, len(msg))
+		if _, err := io.ReadFull(resp.Body, b); err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != msg {
+			t.Fatalf("expected %q got %q", msg, b)
+		}
+	}
+	r.Trailer.Set("X-Checksum", "abc")
+	pw.Close()
+
+	if _, err := ioutil.ReadAll(resp.Body); err != nil {
+		t.Fatal(err)
+	}
+	if v := resp.Trailer.Get("Grpc-Status"); v != "0" {
+		t.Fatalf("expected Grpc-Status 0 got %q", v)
+	}
+	if v := resp.Trailer.Get("X-Checksum"); v != "abc" {
+		t.Fatalf("expected X-Checksum abc got %q", v)
+	}
+}
+
+func TestIntegrationServerSentEvents(t *testing.T) {
+	// local service sends the next event only after the previous one was
+	// received by the user
+	next := make(chan struct{})
+	events := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 3; i++ {
+			fmt.Fprintf(w, "data: %d\n\n", i)
+			w.(http.Flusher).Flush()
+			select {
+			case <-next:
+			case <-time.After(5 * time.Second):
+				return
+			}
+		}
+	}))
+	defer events.Close()
+
+	// server
+	s := makeTunnelServer(t)
+	defer s.Stop()
+
+	h := httptest.NewServer(s)
+	defer h.Close()
+
+	// client
+	opened := make(chan *proto.Tunnel, 1)
+	c, err := tunnel.NewClient(&tunnel.ClientConfig{
+		ServerAddr:      s.Addr(),
+		TLSClientConfig: tlsConfig(),
+		Tunnels: map[string]*proto.Tunnel{
+			"web": {
+				Protocol: proto.HTTP,
+				Host:     "events.test",
+			},
+		},
+		Proxy: tunnel.Proxy(tunnel.ProxyFuncs{
+			Tunnels: map[string]tunnel.ProxyFunc{
+				"web": tunnel.NewHTTPProxy(&url.URL{Scheme: "http", Host: events.Listener.Addr().String()}, log.NewStdLogger()).Proxy,
+			},
+		}),
+		Logger: log.NewStdLogger(),
+		TunnelOpened: func(name string, t *proto.Tunnel) {
+			opened <- t
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go c.Start()
+	defer c.Stop()
+
+	select {
+	case <-opened:
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel not opened")
+	}
+
+	r, err := http.NewRequest(http.MethodGet, h.URL+"/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Host = "events.test"
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := http.DefaultClient.Do(r.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	br := bufio.NewReader(resp.Body)
+	for i := 0; i < 3; i++ {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := fmt.Sprintf("data: %d\n", i); line != expected {
+			t.Fatalf("expected %q got %q", expected, line)
+		}
+		br.ReadString('\n')
+		next <- struct{}{}
+	}
+}
+
+func TestIntegrationCluster(t *testing.T) {
+	// local service
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/xff" {
+			io.WriteString(w, strings.Join(r.Header["X-Forwarded-For"], ", "))
+			return
+		}
+		fmt.Fprintf(w, "%s %s", r.Header.Get("X-Forwarded-Proto"), r.URL.Path)
+	}))
+	defer backend.Close()
+
+	dir, err := ioutil.TempDir("", "cluster")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := tunnel.NewFileClusterStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// local TCP and UDP services
+	tcpEcho, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpEcho.Close()
+	go echoTCP(tcpEcho)
+
+	udpEcho, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpEcho.Close()
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := udpEcho.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			udpEcho.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	// nodes, the client connects to b and users to a, a listens on
+	// 127.0.0.2 so that it can open the ports of b
+	makeNode := func(name string, policy *tunnel.ListenPolicy) (*tunnel.Server, *httptest.Server, *httptest.Server) {
+		h := httptest.NewUnstartedServer(nil)
+		ch := httptest.NewUnstartedServer(nil)
+		s, err := tunnel.NewServer(&tunnel.ServerConfig{
+			Addr:          ":0",
+			AutoSubscribe: true,
+			TLSConfig:     tlsConfig(),
+			ListenPolicy:  policy,
+			Logger:        log.NewStdLogger(),
+			Cluster: &tunnel.ClusterConfig{
+				NodeID:    name,
+				Addr:      ch.Listener.Addr().String(),
+				TLSConfig: &tls.Config{InsecureSkipVerify: true},
+				Secret:    "secret",
+				Store:     store,
+				Interval:  50 * time.Millisecond,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go s.Start()
+
+		h.Config.Handler = s
+		h.Start()
+		ch.Config.Handler = s.ClusterHandler()
+		ch.StartTLS()
+
+		return s, h, ch
+	}
+	a, ha, ca := makeNode("a", &tunnel.ListenPolicy{BindAddrs: []string{"127.0.0.2"}})
+	defer a.Stop()
+	defer ha.Close()
+	defer ca.Close()
+	b, hb, cb := makeNode("b", nil)
+	defer b.Stop()
+	defer hb.Close()
+	defer cb.Close()
+
+	tcpPort := port(freeAddr())
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpPort := fmt.Sprint(pc.LocalAddr().(*net.UDPAddr).Port)
+	pc.Close()
+
+	// client
+	opened := make(chan *proto.Tunnel, 3)
+	c, err := tunnel.NewClient(&tunnel.ClientConfig{
+		ServerAddr:      b.Addr(),
+		TLSClientConfig: tlsConfig(),
+		Tunnels: map[string]*proto.Tunnel{
+			"web": {
+				Protocol: proto.HTTP,
+				Host:     "cluster.test",
+			},
+			"tcp": {
+				Protocol: proto.TCP,
+				Addr:     "127.0.0.1:" + tcpPort,
+			},
+			"udp": {
+				Protocol: proto.UDP,
+				Addr:     "127.0.0.1:" + udpPort,
+			},
+		},
+		Proxy: tunnel.Proxy(tunnel.ProxyFuncs{
+			HTTP: tunnel.NewHTTPProxy(&url.URL{Scheme: "http", Host: backend.Listener.Addr().String()}, log.NewStdLogger()).Proxy,
+			TCP: tunnel.NewMultiTCPProxy(map[string]string{
+				tcpPort: tcpEcho.Addr().String(),
+			}, log.NewStdLogger()).Proxy,
+			UDP: tunnel.NewUDPProxy(udpEcho.LocalAddr().String(), log.NewStdLogger()).Proxy,
+		}),
+		Logger: log.NewStdLogger(),
+		TunnelOpened: func(name string, t *proto.Tunnel) {
+			opened <- t
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go c.Start()
+	defer c.Stop()
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-opened:
+		case <-time.After(5 * time.Second):
+			t.Fatal("tunnel not opened")
+		}
+	}
+
+	get := func(url, host string, header http.Header) (int, string) {
+		r, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Host = host
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, string(b)
+	}
+
+	// a learns about the host when b publishes its state
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status, body := get(ha.URL+"/foo", "cluster.test", nil)
+		if status == http.StatusOK {
+			if body != "http /foo" {
+				t.Fatalf("unexpected body %q", body)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("request not forwarded, status %d", status)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if status, _ := get(ha.URL, "unknown.test", nil); status != http.StatusNotFound {
+		t.Fatalf("expected status %d got %d", http.StatusNotFound, status)
+	}
+
+	// forwarding does not add entries to X-Forwarded-For
+	xff := http.Header{"X-Forwarded-For": {"10.0.0.1"}}
+	_, direct := get(hb.URL+"/xff", "cluster.test", xff)
+	if status, body := get(ha.URL+"/xff", "cluster.test", xff); status != http.StatusOK || body != direct {
+		t.Fatalf("unexpected response %d %q expected %q", status, body, direct)
+	}
+
+	// the cluster listener serves only requests of nodes
+	resp, err := cb.Client().Get(cb.URL + "/bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected status %d got %d", http.StatusForbidden, resp.StatusCode)
+	}
+
+	// TCP and UDP connections to a are streamed to b
+	payload := []byte("ping")
+	buf := make([]byte, len(payload))
+	for _, network := range []string{"tcp", "udp"} {
+		p := tcpPort
+		if network == "udp" {
+			p = udpPort
+		}
+		deadline = time.Now().Add(5 * time.Second)
+		for {
+			err := func() error {
+				conn, err := net.Dial(network, "127.0.0.2:"+p)
+				if err != nil {
+					return err
+				}
+				defer conn.Close()
+				if _, err := conn.Write(payload); err != nil {
+					return err
+				}
+				conn.SetReadDeadline(time.Now().Add(time.Second))
+				if _, err := io.ReadFull(conn, buf); err != nil {
+					return err
+				}
+				if !bytes.Equal(buf, payload) {
+					return fmt.Errorf("unexpected payload %q", buf)
+				}
+				return nil
+			}()
+			if err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s connection not forwarded: %s", network, err)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+
+	// requests pretending to be forwarded must not be trusted
+	forged := http.Header{
+		"X-Tunnel-Cluster-Secret": {"guess"},
+		"X-Tunnel-Cluster-Proto":  {"https"},
+	}
+	if status, body := get(hb.URL+"/bar", "cluster.test", forged); status != http.StatusOK || body != "http /bar" {
+		t.Fatalf("unexpected response %d %q", status, body)
+	}
+
+	// b removes its state on shutdown
+	b.Stop()
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(filepath.Join(dir, "b.json")); os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("node state not removed")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestIntegrationMultipleConnections(t *testing.T) {
+	// local service
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Path)
+	}))
+	defer backend.Close()
+
+	// server
+	s := makeTunnelServer(t)
+	defer s.Stop()
+
+	h := httptest.NewServer(s)
+	defer h.Close()
+
+	// client
+	var (
+		mu    sync.Mutex
+		conns []net.Conn
+	)
+	dialed := make(chan struct{}, 10)
+	opened := make(chan *proto.Tunnel, 1)
+	c, err := tunnel.NewClient(&tunnel.ClientConfig{
+		ServerAddr:      s.Addr(),
+		TLSClientConfig: tlsConfig(),
+		DialTLS: func(network, addr string, config *tls.Config) (net.Conn, error) {
+			conn, err := tls.Dial(network, addr, config)
+			if err == nil {
+				mu.Lock()
+				conns = append(conns, conn)
+				mu.Unlock()
+				dialed <- struct{}{}
+			}
+			return conn, err
+		},
+		Tunnels: map[string]*proto.Tunnel{
+			"web": {
+				Protocol: proto.HTTP,
+				Host:     "conns.test",
+			},
+		},
+		Proxy: tunnel.Proxy(tunnel.ProxyFuncs{
+			HTTP: tunnel.NewHTTPProxy(&url.URL{Scheme: "http", Host: backend.Listener.Addr().String()}, log.NewStdLogger()).Proxy,
+		}),
+		Logger:      log.NewStdLogger(),
+		Connections: 3,
+		TunnelOpened: func(name string, t *proto.Tunnel) {
+			opened <- t
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go c.Start()
+	defer c.Stop()
+
+	waitDialed := func(n int) {
+		for i := 0; i < n; i++ {
+			select {
+			case <-dialed:
+			case <-time.After(5 * time.Second):
+				t.Fatal("connection not dialed")
+			}
+		}
+	}
+	waitDialed(3)
+
+	select {
+	case <-opened:
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel not opened")
+	}
+
+	get := func(path string) {
+		r, err := http.NewRequest(http.MethodGet, h.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Host = "conns.test"
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK || string(b) != path {
+			t.Fatalf("unexpected response %d %q", resp.StatusCode, b)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		get(fmt.Sprint("/", i))
+	}
+
+	// tunnel stays open while other connections are alive and the lost
+	// connection is replaced
+	mu.Lock()
+	conns[0].Close()
+	mu.Unlock()
+	waitDialed(1)
+
+	for i := 0; i < 10; i++ {
+		get(fmt.Sprint("/after/", i))
+	}
+
+	// other process with the same identity is not merged with the running
+	// client
+	other, err := tunnel.NewClient(&tunnel.ClientConfig{
+		ServerAddr:      s.Addr(),
+		TLSClientConfig: tlsConfig(),
+		Tunnels: map[string]*proto.Tunnel{
+			"web": {
+				Protocol: proto.HTTP,
+				Host:     "other.test",
+			},
+		},
+		Proxy: tunnel.Proxy(tunnel.ProxyFuncs{}),
+		TunnelOpened: func(name string, t *proto.Tunnel) {
+			opened <- t
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- other.Start()
+	}()
+	defer other.Stop()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expected error")
+		}
+	case <-opened:
+		t.Fatal("other client connected")
+	case <-time.After(10 * time.Second):
+		t.Fatal("other client not rejected")
+	}
+}
+
+func TestIntegrationShutdown(t *testing.T) {
+	for _, side := range []string{"server", "client"} {
+		t.Run(side, func(t *testing.T) {
+			testShutdown(t, side)
+		})
+	}
+}
+
+func testShutdown(t *testing.T, side string) {
+	// local services
+	httpEcho, tcp := makeEcho(t)
+	defer httpEcho.Close()
+	defer tcp.Close()
+
+	// server
+	s := makeTunnelServer(t)
+	defer s.Stop()
+	h := httptest.NewServer(s)
+	defer h.Close()
+
+	httpLocalAddr := h.Listener.Addr()
+	tcpLocalAddr := freeAddr()
+
+	// client
+	c := makeTunnelClient(t, s.Addr(),
+		httpLocalAddr, httpEcho.Addr(),
+		tcpLocalAddr, tcp.Addr(),
+	)
+	time.Sleep(500 * time.Millisecond)
+	defer c.Stop()
+
+	conn, err := net.Dial("tcp", tcpLocalAddr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	echo := func(conn net.Conn) error {
+		conn.SetDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			return err
+		}
+		b := make([]byte, 4)
+		_, err := io.ReadFull(conn, b)
+		return err
+	}
+	if err := echo(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		if side == "server" {
+			done <- s.Shutdown(ctx)
+		} else {
+			done <- c.Shutdown(ctx)
+		}
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	// in-flight stream is not interrupted
+	if err := echo(conn); err != nil {
+		t.Fatal("in-flight stream interrupted:", err)
+	}
+
+	// new requests are rejected, server closes public listeners
+	if side == "server" {
+		if nc, err := net.Dial("tcp", tcpLocalAddr.String()); err == nil {
+			nc.Close()
+			t.Fatal("expected listener to be closed")
+		}
+	}
+	r, _ := http.NewRequest(http.MethodGet, "http://localhost:"+port(httpLocalAddr)+"/", nil)
+	r.SetBasicAuth("user", "password")
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected %d got %d", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+
+	select {
+	case err := <-done:
+		t.Fatal("shutdown returned before in-flight stream finished:", err)
+	default:
+	}
+
+	conn.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(4 * time.Second):
+		t.Fatal("shutdown did not return")
+	}
+}
+
 func testHTTP(t testing.TB, addr net.Addr, payload []byte, repeat uint) {
 	url := fmt.Sprintf("http://localhost:%s/some/path", port(addr))
 
@@ -0,0 +1,647 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256" // register hash functions
+	_ "crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+// Default JWKS refresh intervals.
+const (
+	// DefaultJWKSRefreshInterval specifies how often JWKS loaded from URL
+	// is refreshed.
+	DefaultJWKSRefreshInterval = time.Hour
+	// DefaultJWKSMinRefreshInterval specifies how often JWKS may be
+	// refreshed when a token is signed with unknown key.
+	DefaultJWKSMinRefreshInterval = time.Minute
+)
+
+// maxJWKSSize limits size of JWKS fetched from URL.
+const maxJWKSSize = 1 << 20
+
+// JWTConfig configures JWT bearer token authentication of HTTP tunnels.
+// Tokens are validated for tunnels that enable JWT and for hosts matching
+// Rules.
+type JWTConfig struct {
+	// JWKS specifies path or http(s) URL of JSON Web Key Set with keys
+	// tokens are signed with. Keys loaded from URL are refreshed
+	// periodically and when a token is signed with unknown key.
+	JWKS string
+	// Issuers specifies accepted "iss" claims, if empty any issuer is
+	// accepted.
+	Issuers []string
+	// Audiences specifies accepted "aud" claims, if empty audience is not
+	// checked.
+	Audiences []string
+	// Cookie specifies optional name of cookie token is read from if the
+	// request has no Authorization header.
+	Cookie string
+	// Rules specifies claims required to access hosts.
+	Rules []JWTRule
+	// ForwardClaims specifies claims forwarded to the client as
+	// proto.HeaderClaimPrefix headers, if empty "sub" is forwarded.
+	ForwardClaims []string
+	// Leeway specifies allowed clock skew when validating "exp" and "nbf".
+	Leeway time.Duration
+}
+
+// JWTRule requires token claims for a host. Host may be a wildcard like
+// "*.example.com", every rule matching request host must be satisfied. A
+// claim is satisfied if it's equal to or, for array claims, contains any of
+// the values.
+type JWTRule struct {
+	Host   string              `json:"host"`
+	Claims map[string][]string `json:"claims"`
+}
+
+// jwtAuth validates JWT bearer tokens.
+type jwtAuth struct {
+	config *JWTConfig
+	keys   *jwks
+}
+
+func newJWTAuth(config *JWTConfig) (*jwtAuth, error) {
+	if config.JWKS == "" {
+		return nil, errors.New("missing JWKS")
+	}
+	for _, r := range config.Rules {
+		if r.Host == "" {
+			return nil, errors.New("missing rule host")
+		}
+	}
+
+	k := &jwks{source: config.JWKS}
+	if err := k.load(); err != nil {
+		return nil, fmt.Errorf("loading JWKS failed: %s", err)
+	}
+
+	return &jwtAuth{
+		config: config,
+		keys:   k,
+	}, nil
+}
+
+// protects returns true if there is a rule for host.
+func (a *jwtAuth) protects(host string) bool {
+	if a == nil {
+		return false
+	}
+	for _, r := range a.config.Rules {
+		if matchHost(r.Host, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate validates token of r and rules of host, it returns the token
+// claims, errInvalidToken if token is missing or invalid and errForbidden if
+// claims do not satisfy the rules.
+func (a *jwtAuth) authenticate(r *http.Request, host string) (map[string]interface{}, error) {
+	token := a.token(r)
+	if token == "" {
+		return nil, errInvalidToken
+	}
+
+	claims, err := a.verify(token, time.Now())
+	if err != nil {
+		return nil, errInvalidToken
+	}
+
+	for _, rule := range a.config.Rules {
+		if !matchHost(rule.Host, host) {
+			continue
+		}
+		for name, values := range rule.Claims {
+			if !claimMatches(claims[name], values) {
+				return nil, errForbidden
+			}
+		}
+	}
+
+	return claims, nil
+}
+
+// token returns token from Authorization header or cookie.
+func (a *jwtAuth) token(r *http.Request) string {
+	const prefix = "bearer "
+	if h := r.Header.Get("Authorization"); len(h) > len(prefix) && strings.EqualFold(h[:len(prefix)], prefix) {
+		return strings.TrimSpace(h[len(prefix):])
+	}
+	if a.config.Cookie != "" {
+		if c, err := r.Cookie(a.config.Cookie); err == nil {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+// forward removes token from h and sets claim headers.
+func (a *jwtAuth) forward(h http.Header, claims map[string]interface{}) {
+	for k := range h {
+		if strings.HasPrefix(k, proto.HeaderClaimPrefix) {
+			h.Del(k)
+		}
+	}
+	h.Del("Authorization")
+	if a.config.Cookie != "" {
+		removeCookie(h, a.config.Cookie)
+	}
+
+	names := a.config.ForwardClaims
+	if len(names) == 0 {
+		names = []string{"sub"}
+	}
+	for _, name := range names {
+		if v, ok := claims[name]; ok {
+			h.Set(proto.HeaderClaimPrefix+name, claimString(v))
+		}
+	}
+}
+
+// verify checks token signature and registered claims, it returns the token
+// claims.
+func (a *jwtAuth) verify(token string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed header: %s", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed signature: %s", err)
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, k := range a.keys.lookup(header.Kid) {
+		if k.alg != "" && k.alg != header.Alg {
+			continue
+		}
+		if err := verifySignature(header.Alg, k.key, signed, sig); err == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("invalid signature")
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed claims: %s", err)
+	}
+
+	leeway := a.config.Leeway
+	exp, ok := claimTime(claims["exp"])
+	if !ok {
+		return nil, errors.New("missing exp")
+	}
+	if now.After(exp.Add(leeway)) {
+		return nil, errors.New("token expired")
+	}
+	if nbf, ok := claimTime(claims["nbf"]); ok && now.Add(leeway).Before(nbf) {
+		return nil, errors.New("token not valid yet")
+	}
+	if len(a.config.Issuers) > 0 && !claimMatches(claims["iss"], a.config.Issuers) {
+		return nil, errors.New("invalid issuer")
+	}
+	if len(a.config.Audiences) > 0 && !claimMatches(claims["aud"], a.config.Audiences) {
+		return nil, errors.New("invalid audience")
+	}
+
+	return claims, nil
+}
+
+func decodeSegment(s string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	return d.Decode(v)
+}
+
+var jwtHashes = map[string]crypto.Hash{
+	"256": crypto.SHA256,
+	"384": crypto.SHA384,
+	"512": crypto.SHA512,
+}
+
+// jwtCurves maps ES algorithm hash size to the only allowed curve.
+var jwtCurves = map[string]string{
+	"256": "P-256",
+	"384": "P-384",
+	"512": "P-521",
+}
+
+// verifySignature verifies signature of RS, PS, ES and HS algorithms.
+func verifySignature(alg string, key interface{}, signed, sig []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	hash, ok := jwtHashes[alg[2:]]
+	if !ok {
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+
+	if alg[:2] == "HS" {
+		k, ok := key.([]byte)
+		if !ok {
+			return errors.New("key type mismatch")
+		}
+		m := hmac.New(hash.New, k)
+		m.Write(signed)
+		if subtle.ConstantTimeCompare(m.Sum(nil), sig) != 1 {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch alg[:2] {
+	case "RS", "PS":
+		k, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("key type mismatch")
+		}
+		if alg[:2] == "RS" {
+			return rsa.VerifyPKCS1v15(k, hash, digest, sig)
+		}
+		return rsa.VerifyPSS(k, hash, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	case "ES":
+		k, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.New("key type mismatch")
+		}
+		if k.Curve.Params().Name != jwtCurves[alg[2:]] {
+			return errors.New("key curve mismatch")
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("invalid signature")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unsupported algorithm %q", alg)
+}
+
+// claimTime returns NumericDate claim as time.
+func claimTime(v interface{}) (time.Time, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(f), 0), true
+}
+
+// claimMatches returns true if claim equals or contains any of values.
+func claimMatches(claim interface{}, values []string) bool {
+	var have []string
+	switch v := claim.(type) {
+	case nil:
+		return false
+	case []interface{}:
+		for _, e := range v {
+			have = append(have, claimString(e))
+		}
+	default:
+		have = []string{claimString(v)}
+	}
+
+	for _, h := range have {
+		for _, v := range values {
+			if h == v {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// claimString returns claim as header value, arrays are joined with comma
+// and objects are JSON encoded.
+func claimString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		if v {
+			return "true"
+		}
+		return "false"
+	case []interface{}:
+		s := make([]string, len(v))
+		for i, e := range v {
+			s[i] = claimString(e)
+		}
+		return strings.Join(s, ",")
+	default:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+}
+
+// removeCookie removes cookie name from Cookie headers of h.
+func removeCookie(h http.Header, name string) {
+	r := http.Request{Header: h}
+	cookies := r.Cookies()
+	h.Del("Cookie")
+
+	var s []string
+	for _, c := range cookies {
+		if c.Name != name {
+			s = append(s, c.Name+"="+c.Value)
+		}
+	}
+	if len(s) > 0 {
+		h.Set("Cookie", strings.Join(s, "; "))
+	}
+}
+
+// matchHost returns true if host equals pattern or matches wildcard pattern
+// like "*.example.com".
+func matchHost(pattern, host string) bool {
+	pattern, host = strings.ToLower(pattern), strings.ToLower(host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if pattern == host {
+		return true
+	}
+	return strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:])
+}
+
+// jwk is a public key from JWKS.
+type jwk struct {
+	kid string
+	alg string
+	// key is *rsa.PublicKey, *ecdsa.PublicKey or []byte for HMAC.
+	key interface{}
+}
+
+// jwks holds keys loaded from file or URL.
+type jwks struct {
+	source string
+
+	mu      sync.Mutex
+	keys    []jwk
+	fetched time.Time
+	// tried is time of the last refresh attempt, refreshes are at least
+	// DefaultJWKSMinRefreshInterval apart even if they fail.
+	tried time.Time
+	// refresh is closed when refresh in progress is done.
+	refresh chan struct{}
+}
+
+func (k *jwks) remote() bool {
+	return strings.HasPrefix(k.source, "http://") || strings.HasPrefix(k.source, "https://")
+}
+
+// lookup returns keys with kid, or all keys if kid is empty. Remote keys are
+// refreshed in background when stale or kid is unknown, lookup of unknown kid
+// waits for the refresh.
+func (k *jwks) lookup(kid string) []jwk {
+	k.mu.Lock()
+	keys := k.find(kid)
+	if !k.remote() {
+		k.mu.Unlock()
+		return keys
+	}
+
+	wait := k.refresh
+	if wait == nil && time.Since(k.tried) > DefaultJWKSMinRefreshInterval &&
+		(len(keys) == 0 || time.Since(k.fetched) > DefaultJWKSRefreshInterval) {
+		wait = make(chan struct{})
+		k.refresh = wait
+		k.tried = time.Now()
+		go k.reload(wait)
+	}
+	k.mu.Unlock()
+
+	if len(keys) > 0 || wait == nil {
+		return keys
+	}
+
+	<-wait
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	return k.find(kid)
+}
+
+// reload fetches keys without holding mu and closes done.
+func (k *jwks) reload(done chan struct{}) {
+	keys, err := k.read()
+
+	k.mu.Lock()
+	if err == nil {
+		k.keys = keys
+		k.fetched = time.Now()
+	}
+	k.refresh = nil
+	k.mu.Unlock()
+
+	close(done)
+}
+
+func (k *jwks) find(kid string) []jwk {
+	if kid == "" {
+		return k.keys
+	}
+	var keys []jwk
+	for _, v := range k.keys {
+		if v.kid == kid {
+			keys = append(keys, v)
+		}
+	}
+	return keys
+}
+
+func (k *jwks) load() error {
+	keys, err := k.read()
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.keys = keys
+	k.fetched = time.Now()
+	k.tried = k.fetched
+
+	return nil
+}
+
+// read reads and parses keys from source.
+func (k *jwks) read() ([]jwk, error) {
+	var (
+		b   []byte
+		err error
+	)
+	if k.remote() {
+		b, err = fetchJWKS(k.source)
+	} else {
+		b, err = ioutil.ReadFile(k.source)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return parseJWKS(b)
+}
+
+func fetchJWKS(url string) ([]byte, error) {
+	c := &http.Client{Timeout: DefaultTimeout}
+	resp, err := c.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %s", resp.Status)
+	}
+
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxJWKSSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxJWKSSize {
+		return nil, fmt.Errorf("JWKS exceeds %d bytes", maxJWKSSize)
+	}
+	return b, nil
+}
+
+func parseJWKS(b []byte) ([]jwk, error) {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Alg string `json:"alg"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+			K   string `json:"k"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, err
+	}
+
+	var keys []jwk
+	for _, v := range set.Keys {
+		if v.Use != "" && v.Use != "sig" {
+			continue
+		}
+
+		k := jwk{kid: v.Kid, alg: v.Alg}
+		switch v.Kty {
+		case "RSA":
+			n, err := base64.RawURLEncoding.DecodeString(v.N)
+			if err != nil {
+				return nil, fmt.Errorf("key %q: %s", v.Kid, err)
+			}
+			e, err := base64.RawURLEncoding.DecodeString(v.E)
+			if err != nil {
+				return nil, fmt.Errorf("key %q: %s", v.Kid, err)
+			}
+			k.key = &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}
+		case "EC":
+			var curve elliptic.Curve
+			switch v.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				return nil, fmt.Errorf("key %q: unsupported curve %q", v.Kid, v.Crv)
+			}
+			x, err := base64.RawURLEncoding.DecodeString(v.X)
+			if err != nil {
+				return nil, fmt.Errorf("key %q: %s", v.Kid, err)
+			}
+			y, err := base64.RawURLEncoding.DecodeString(v.Y)
+			if err != nil {
+				return nil, fmt.Errorf("key %q: %s", v.Kid, err)
+			}
+			k.key = &ecdsa.PublicKey{
+				Curve: curve,
+				X:     new(big.Int).SetBytes(x),
+				Y:     new(big.Int).SetBytes(y),
+			}
+		case "oct":
+			s, err := base64.RawURLEncoding.DecodeString(v.K)
+			if err != nil {
+				return nil, fmt.Errorf("key %q: %s", v.Kid, err)
+			}
+			k.key = s
+		default:
+			continue
+		}
+		keys = append(keys, k)
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no signing keys")
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,334 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func signRS256(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	s := jwtSigningInput(t, "RS256", kid, claims)
+	h := sha256.Sum256([]byte(s))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, h[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s + "." + b64(sig)
+}
+
+func signES256(t *testing.T, key *ecdsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	s := jwtSigningInput(t, "ES256", kid, claims)
+	h := sha256.Sum256([]byte(s))
+	r, ss, err := ecdsa.Sign(rand.Reader, key, h[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	ss.FillBytes(sig[32:])
+	return s + "." + b64(sig)
+}
+
+func jwtSigningInput(t *testing.T, alg, kid string, claims map[string]interface{}) string {
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b64(header) + "." + b64(payload)
+}
+
+func TestJWTAuth(t *testing.T) {
+	t.Parallel()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	set := map[string]interface{}{
+		"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa", "alg": "RS256", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+			{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(ecKey.X.Bytes()), "y": b64(ecKey.Y.Bytes())},
+			{"kty": "RSA", "kid": "enc", "use": "enc", "n": b64(otherKey.N.Bytes()), "e": "AQAB"},
+		},
+	}
+	b, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "tunnel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "jwks.json")
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := newJWTAuth(&JWTConfig{
+		JWKS:      path,
+		Issuers:   []string{"https://auth.example.com/"},
+		Audiences: []string{"tunnel"},
+		Cookie:    "token",
+		Rules: []JWTRule{
+			{Host: "*.example.com", Claims: map[string][]string{"groups": {"dev", "ops"}}},
+		},
+		ForwardClaims: []string{"sub", "groups"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !a.protects("demo.example.com:8080") || a.protects("example.org") {
+		t.Fatal("unexpected protected hosts")
+	}
+
+	now := time.Now().Unix()
+	claims := func(override map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":    "https://auth.example.com/",
+			"aud":    []string{"other", "tunnel"},
+			"sub":    "alice",
+			"groups": []string{"dev"},
+			"exp":    now + 60,
+		}
+		for k, v := range override {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+
+	tests := []struct {
+		name   string
+		host   string
+		token  string
+		cookie bool
+		err    error
+	}{
+		{"rsa", "demo.example.com", signRS256(t, rsaKey, "rsa", claims(nil)), false, nil},
+		{"ec", "demo.example.com", signES256(t, ecKey, "ec", claims(nil)), false, nil},
+		{"cookie", "demo.example.com", signRS256(t, rsaKey, "rsa", claims(nil)), true, nil},
+		{"missing", "demo.example.com", "", false, errInvalidToken},
+		{"malformed", "demo.example.com", "foo.bar", false, errInvalidToken},
+		{"unknown key", "demo.example.com", signRS256(t, otherKey, "rsa", claims(nil)), false, errInvalidToken},
+		{"enc key", "demo.example.com", signRS256(t, otherKey, "enc", claims(nil)), false, errInvalidToken},
+		{"expired", "demo.example.com", signRS256(t, rsaKey, "rsa", claims(map[string]interface{}{"exp": now - 60})), false, errInvalidToken},
+		{"no exp", "demo.example.com", signRS256(t, rsaKey, "rsa", claims(map[string]interface{}{"exp": nil})), false, errInvalidToken},
+		{"not before", "demo.example.com", signRS256(t, rsaKey, "rsa", claims(map[string]interface{}{"nbf": now + 60})), false, errInvalidToken},
+		{"issuer", "demo.example.com", signRS256(t, rsaKey, "rsa", claims(map[string]interface{}{"iss": "https://evil.com/"})), false, errInvalidToken},
+		{"audience", "demo.example.com", signRS256(t, rsaKey, "rsa", claims(map[string]interface{}{"aud": "other"})), false, errInvalidToken},
+		{"rule", "demo.example.com", signRS256(t, rsaKey, "rsa", claims(map[string]interface{}{"groups": "qa"})), false, errForbidden},
+		{"no rule", "example.org", signRS256(t, rsaKey, "rsa", claims(map[string]interface{}{"groups": nil})), false, nil},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "http://"+tt.host, nil)
+		if tt.cookie {
+			r.AddCookie(&http.Cookie{Name: "token", Value: tt.token})
+		} else if tt.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+
+		_, err := a.authenticate(r, tt.host)
+		if err != tt.err {
+			t.Errorf("%s: expected error %v got %v", tt.name, tt.err, err)
+		}
+	}
+
+	// forward
+	r := httptest.NewRequest(http.MethodGet, "http://demo.example.com", nil)
+	r.Header.Set("Authorization", "Bearer "+signRS256(t, rsaKey, "rsa", claims(map[string]interface{}{"groups": []string{"dev", "ops"}})))
+	r.Header.Set(proto.HeaderClaimPrefix+"Admin", "true")
+	r.AddCookie(&http.Cookie{Name: "token", Value: "x"})
+	r.AddCookie(&http.Cookie{Name: "session", Value: "y"})
+
+	c, err := a.authenticate(r, r.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.forward(r.Header, c)
+
+	if r.Header.Get("Authorization") != "" {
+		t.Error("Authorization not removed")
+	}
+	if v := r.Header.Get("Cookie"); v != "session=y" {
+		t.Errorf("unexpected Cookie %q", v)
+	}
+	if v := r.Header.Get(proto.HeaderClaimPrefix + "Admin"); v != "" {
+		t.Errorf("spoofed claim header not removed %q", v)
+	}
+	if v := r.Header.Get(proto.HeaderClaimPrefix + "sub"); v != "alice" {
+		t.Errorf("unexpected sub %q", v)
+	}
+	if v := r.Header.Get(proto.HeaderClaimPrefix + "groups"); v != "dev,ops" {
+		t.Errorf("unexpected groups %q", v)
+	}
+}
+
+func TestFetchJWKSLimit(t *testing.T) {
+	t.Parallel()
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"keys":[]}`))
+		w.Write(bytes.Repeat([]byte(" "), maxJWKSSize))
+	}))
+	defer s.Close()
+
+	if _, err := fetchJWKS(s.URL); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestJWKSRefresh(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mu      sync.Mutex
+		fetches int
+		kids    = []string{"a"}
+		status  = http.StatusOK
+	)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetches++
+		var keys []map[string]string
+		for _, kid := range kids {
+			keys = append(keys, map[string]string{"kty": "oct", "kid": kid, "k": b64([]byte(kid))})
+		}
+		st := status
+		mu.Unlock()
+
+		time.Sleep(50 * time.Millisecond)
+		w.WriteHeader(st)
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	}))
+	defer s.Close()
+
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return fetches
+	}
+
+	k := &jwks{source: s.URL}
+	if err := k.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	// unknown kid is fetched once for concurrent lookups
+	mu.Lock()
+	kids = append(kids, "b")
+	mu.Unlock()
+	k.mu.Lock()
+	k.tried = time.Time{}
+	k.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if len(k.lookup("b")) != 1 {
+				t.Error("key not found")
+			}
+		}()
+	}
+	wg.Wait()
+	if n := count(); n != 2 {
+		t.Fatalf("expected 2 fetches got %d", n)
+	}
+
+	// unknown kid does not trigger refetch until min refresh interval
+	if len(k.lookup("c")) != 0 || count() != 2 {
+		t.Fatal("unexpected refetch")
+	}
+
+	// failed fetch is rate limited as well
+	mu.Lock()
+	status = http.StatusInternalServerError
+	mu.Unlock()
+	k.mu.Lock()
+	k.tried = time.Time{}
+	k.mu.Unlock()
+	if len(k.lookup("c")) != 0 || len(k.lookup("c")) != 0 || count() != 3 {
+		t.Fatalf("expected 3 fetches got %d", count())
+	}
+	if len(k.lookup("a")) != 1 {
+		t.Fatal("keys lost on failed fetch")
+	}
+}
+
+func TestVerifySignatureCurve(t *testing.T) {
+	t.Parallel()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := []byte("header.payload")
+
+	sign := func(digest []byte) []byte {
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+		return sig
+	}
+
+	h256 := sha256.Sum256(signed)
+	if err := verifySignature("ES256", &key.PublicKey, signed, sign(h256[:])); err != nil {
+		t.Fatal(err)
+	}
+	h512 := sha512.Sum512(signed)
+	if err := verifySignature("ES512", &key.PublicKey, signed, sign(h512[:])); err == nil {
+		t.Fatal("expected curve mismatch")
+	}
+}
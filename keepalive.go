@@ -26,5 +26,8 @@ var (
 )
 
 func keepAlive(conn net.Conn) error {
+	if c, ok := conn.(*proxyConn); ok {
+		conn = c.Conn
+	}
 	return tcpkeepalive.SetKeepAlive(conn, DefaultKeepAliveIdleTime, DefaultKeepAliveCount, DefaultKeepAliveInterval)
 }
@@ -10,6 +10,9 @@ import (
 )
 
 func keepAlive(conn net.Conn) error {
+	if c, ok := conn.(*proxyConn); ok {
+		conn = c.Conn
+	}
 	c, ok := conn.(*net.TCPConn)
 	if !ok {
 		return fmt.Errorf("Bad connection type: %T", c)
@@ -0,0 +1,133 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+// ListenPolicy restricts addresses TCP and UDP tunnels may listen on.
+type ListenPolicy struct {
+	// MinPort and MaxPort specify range of allowed ports. If a client
+	// requests port 0 or no address a free port from the range is
+	// allocated. If both are zero any port is allowed and port 0 is
+	// allocated by the operating system.
+	MinPort int
+	MaxPort int
+	// BindAddrs specifies allowed bind addresses i.e. "0.0.0.0",
+	// "127.0.0.1". If a client requests no bind address the first one is
+	// used. If empty any address is allowed.
+	BindAddrs []string
+}
+
+func (p *ListenPolicy) validate() error {
+	if p.MinPort == 0 && p.MaxPort == 0 {
+		return nil
+	}
+	if p.MinPort < 1 || p.MaxPort > 65535 || p.MinPort > p.MaxPort {
+		return fmt.Errorf("invalid port range %d-%d", p.MinPort, p.MaxPort)
+	}
+	return nil
+}
+
+// listen opens listener on addr if allowed by the policy, if addr is empty or
+// has port 0 a free port is allocated.
+func (p *ListenPolicy) listen(network, addr string) (net.Listener, error) {
+	var l net.Listener
+	err := p.bind(network, addr, func(addr string) (err error) {
+		l, err = net.Listen(network, addr)
+		return
+	})
+	return l, err
+}
+
+// listenPacket is listen for packet oriented networks.
+func (p *ListenPolicy) listenPacket(network, addr string) (net.PacketConn, error) {
+	var pc net.PacketConn
+	err := p.bind(network, addr, func(addr string) (err error) {
+		pc, err = net.ListenPacket(network, addr)
+		return
+	})
+	return pc, err
+}
+
+// bind invokes open with address allowed by the policy.
+func (p *ListenPolicy) bind(network, addr string, open func(addr string) error) error {
+	if network == proto.UNIX {
+		return errors.New("unix listeners are not allowed")
+	}
+
+	var (
+		host string
+		port int
+	)
+	if addr != "" {
+		h, ps, err := net.SplitHostPort(addr)
+		if err != nil {
+			return err
+		}
+		if port, err = net.LookupPort(network, ps); err != nil {
+			return err
+		}
+		host = h
+	}
+
+	if host == "" && len(p.BindAddrs) > 0 {
+		host = p.BindAddrs[0]
+	}
+	if !p.allowedHost(host) {
+		return fmt.Errorf("bind address %q is not allowed, allowed addresses are %v", host, p.BindAddrs)
+	}
+
+	if port != 0 {
+		if !p.allowedPort(port) {
+			return fmt.Errorf("port %d is not allowed, allowed ports are %d-%d", port, p.MinPort, p.MaxPort)
+		}
+		return open(net.JoinHostPort(host, strconv.Itoa(port)))
+	}
+
+	if p.MinPort == 0 && p.MaxPort == 0 {
+		return open(net.JoinHostPort(host, "0"))
+	}
+
+	n := p.MaxPort - p.MinPort + 1
+	start := rand.Intn(n)
+	for i := 0; i < n; i++ {
+		port := p.MinPort + (start+i)%n
+		if err := open(net.JoinHostPort(host, strconv.Itoa(port))); err == nil {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("no free port in range %d-%d", p.MinPort, p.MaxPort)
+}
+
+func (p *ListenPolicy) allowedHost(host string) bool {
+	if len(p.BindAddrs) == 0 {
+		return true
+	}
+	if host == "" {
+		host = "0.0.0.0"
+	}
+	for _, a := range p.BindAddrs {
+		if a == host {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *ListenPolicy) allowedPort(port int) bool {
+	if p.MinPort == 0 && p.MaxPort == 0 {
+		return true
+	}
+	return port >= p.MinPort && port <= p.MaxPort
+}
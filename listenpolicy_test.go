@@ -0,0 +1,91 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"net"
+	"strconv"
+	"testing"
+)
+
+// reservePorts listens on two consecutive ports, it returns the listeners and
+// the lower port.
+func reservePorts(t *testing.T) (net.Listener, net.Listener, int) {
+	for i := 0; i < 100; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := l.Addr().(*net.TCPAddr).Port
+		if port < 65535 {
+			next, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port+1)))
+			if err == nil {
+				return l, next, port
+			}
+		}
+		l.Close()
+	}
+	t.Fatal("no free consecutive ports")
+	return nil, nil, 0
+}
+
+func TestListenPolicy(t *testing.T) {
+	t.Parallel()
+
+	l, next, port := reservePorts(t)
+	defer l.Close()
+
+	// the range has the busy port and a single free one
+	policy := &ListenPolicy{
+		MinPort:   port,
+		MaxPort:   port + 1,
+		BindAddrs: []string{"127.0.0.1"},
+	}
+	if err := policy.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if a, err := policy.listen("tcp", ""); err == nil {
+		a.Close()
+		t.Error("expected error when all ports are busy")
+	}
+	next.Close()
+
+	for _, addr := range []string{"", ":0", "127.0.0.1:0"} {
+		a, err := policy.listen("tcp", addr)
+		if err != nil {
+			t.Fatalf("%q: %s", addr, err)
+		}
+		if expected := net.JoinHostPort("127.0.0.1", strconv.Itoa(port+1)); a.Addr().String() != expected {
+			t.Errorf("%q: expected %s got %s", addr, expected, a.Addr())
+		}
+		a.Close()
+	}
+
+	for _, addr := range []string{
+		"0.0.0.0:0",
+		":" + strconv.Itoa(port+2),
+		"127.0.0.1:22",
+		"127.0.0.1:" + strconv.Itoa(port),
+	} {
+		if a, err := policy.listen("tcp", addr); err == nil {
+			a.Close()
+			t.Errorf("%q: expected error", addr)
+		}
+	}
+	if _, err := policy.listen("unix", "/tmp/tunnel.sock"); err == nil {
+		t.Error("expected error")
+	}
+
+	for _, p := range []*ListenPolicy{
+		{MinPort: 0, MaxPort: 10},
+		{MinPort: 10, MaxPort: 5},
+		{MinPort: 1, MaxPort: 70000},
+	} {
+		if err := p.validate(); err == nil {
+			t.Errorf("%+v: expected error", p)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"github.com/mmatczuk/go-http-tunnel/metrics"
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+// Traffic directions used as metric label values.
+const (
+	dirIn  = "in"
+	dirOut = "out"
+)
+
+// tunnelLabel returns tunnel metric label value for msg, wildcard tunnels are
+// reported under the wildcard host.
+func tunnelLabel(msg *proto.ControlMessage) string {
+	if msg.TunnelHost != "" {
+		return msg.TunnelHost + msg.PathPrefix
+	}
+	switch msg.ForwardedProto {
+	case proto.HTTP, proto.HTTPS:
+		return hostKey(msg.ForwardedHost)
+	}
+	return msg.ForwardedHost
+}
+
+// metricLabel returns tunnel metric label value of connections and requests
+// of t.
+func (t *registryTunnel) metricLabel() string {
+	switch {
+	case t.host != nil:
+		return hostKey(t.host.Host) + cleanPathPrefix(t.host.PathPrefix)
+	case t.sni != "":
+		return t.sni
+	case t.listener != nil:
+		return t.listener.Addr().String()
+	}
+	return ""
+}
+
+type serverMetrics struct {
+	clients      *metrics.Gauge
+	handshakes   *metrics.CounterVec
+	streams      *metrics.GaugeVec
+	bytes        *metrics.CounterVec
+	httpDuration *metrics.HistogramVec
+	pingDuration *metrics.Histogram
+}
+
+func newServerMetrics(r *metrics.Registry) *serverMetrics {
+	if r == nil {
+		r = metrics.NewRegistry()
+	}
+
+	return &serverMetrics{
+		clients: r.Gauge(
+			"tunnel_server_connected_clients",
+			"Number of clients connected to the server.",
+		).With(),
+		handshakes: r.Counter(
+			"tunnel_server_handshakes_total",
+			"Number of client handshakes by result, result is success or failure reason.",
+			"result",
+		),
+		streams: r.Gauge(
+			"tunnel_server_active_streams",
+			"Number of proxied connections and requests in progress.",
+			"tunnel", "proto",
+		),
+		bytes: r.Counter(
+			"tunnel_server_transferred_bytes_total",
+			"Number of bytes transferred, direction in is from user to client.",
+			"tunnel", "dir",
+		),
+		httpDuration: r.Histogram(
+			"tunnel_server_http_request_duration_seconds",
+			"Time from sending HTTP request to the client until receiving response headers.",
+			nil,
+			"code",
+		),
+		pingDuration: r.Histogram(
+			"tunnel_server_ping_duration_seconds",
+			"Client ping round trip time.",
+			nil,
+		).With(),
+	}
+}
+
+type clientMetrics struct {
+	connected    *metrics.Gauge
+	reconnects   *metrics.Counter
+	backoffs     *metrics.Counter
+	backoffSleep *metrics.Counter
+	streams      *metrics.GaugeVec
+}
+
+func newClientMetrics(r *metrics.Registry) *clientMetrics {
+	if r == nil {
+		r = metrics.NewRegistry()
+	}
+
+	return &clientMetrics{
+		connected: r.Gauge(
+			"tunnel_client_connected",
+			"Set to 1 if client is connected to the server.",
+		).With(),
+		reconnects: r.Counter(
+			"tunnel_client_reconnects_total",
+			"Number of times client reconnected to the server after disconnect.",
+		).With(),
+		backoffs: r.Counter(
+			"tunnel_client_backoffs_total",
+			"Number of failed dial attempts followed by backoff.",
+		).With(),
+		backoffSleep: r.Counter(
+			"tunnel_client_backoff_seconds_total",
+			"Total time spent waiting in backoff.",
+		).With(),
+		streams: r.Gauge(
+			"tunnel_client_active_streams",
+			"Number of proxied connections and requests in progress.",
+			"proto",
+		),
+	}
+}
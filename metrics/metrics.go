@@ -0,0 +1,415 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+// Package metrics implements minimal counters, gauges and histograms exposed
+// in Prometheus text format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefBuckets are the default histogram buckets, tailored to measure network
+// latency in seconds.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+)
+
+// Registry holds metrics and writes them in Prometheus text format. It's safe
+// for concurrent use.
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]*vec
+}
+
+// NewRegistry creates a new empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		metrics: make(map[string]*vec),
+	}
+}
+
+// Counter registers a counter with given label names, if a counter with the
+// same name is already registered it is returned.
+func (r *Registry) Counter(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{r.register(name, help, typeCounter, nil, labels)}
+}
+
+// Gauge registers a gauge with given label names, if a gauge with the same
+// name is already registered it is returned.
+func (r *Registry) Gauge(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{r.register(name, help, typeGauge, nil, labels)}
+}
+
+// Histogram registers a histogram with given upper bounds of buckets and label
+// names, if buckets is nil DefBuckets are used. If a histogram with the same
+// name is already registered it is returned.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	b := append([]float64(nil), buckets...)
+	sort.Float64s(b)
+
+	return &HistogramVec{r.register(name, help, typeHistogram, b, labels)}
+}
+
+func (r *Registry) register(name, help, typ string, buckets []float64, labels []string) *vec {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if v, ok := r.metrics[name]; ok {
+		if v.typ != typ || len(v.labels) != len(labels) {
+			panic(fmt.Sprintf("metrics: %s already registered as %s", name, v.typ))
+		}
+		return v
+	}
+
+	v := &vec{
+		name:    name,
+		help:    help,
+		typ:     typ,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+	r.metrics[name] = v
+
+	return v
+}
+
+// WriteTo writes all metrics in Prometheus text format to w.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	vecs := make([]*vec, 0, len(names))
+	sort.Strings(names)
+	for _, name := range names {
+		vecs = append(vecs, r.metrics[name])
+	}
+	r.mu.Unlock()
+
+	cw := &countWriter{w: bufio.NewWriter(w)}
+	for _, v := range vecs {
+		v.writeTo(cw)
+	}
+	if cw.err == nil {
+		cw.err = cw.w.(*bufio.Writer).Flush()
+	}
+
+	return cw.n, cw.err
+}
+
+// ServeHTTP implements http.Handler.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+// CounterVec is a set of counters partitioned by label values.
+type CounterVec struct {
+	v *vec
+}
+
+// With returns counter for given label values.
+func (c *CounterVec) With(values ...string) *Counter {
+	return &Counter{c.v.with(values)}
+}
+
+// DeleteLabel removes counters with label name set to value.
+func (c *CounterVec) DeleteLabel(name, value string) {
+	c.v.deleteLabel(name, value)
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	s *series
+}
+
+// Inc increments the counter by 1.
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add adds the given non-negative value to the counter.
+func (c *Counter) Add(v float64) {
+	if v < 0 {
+		panic("metrics: counter cannot decrease")
+	}
+	c.s.add(v)
+}
+
+// GaugeVec is a set of gauges partitioned by label values.
+type GaugeVec struct {
+	v *vec
+}
+
+// With returns gauge for given label values.
+func (g *GaugeVec) With(values ...string) *Gauge {
+	return &Gauge{g.v.with(values)}
+}
+
+// Delete removes gauge with given label values.
+func (g *GaugeVec) Delete(values ...string) {
+	g.v.delete(values)
+}
+
+// DeleteLabel removes gauges with label name set to value.
+func (g *GaugeVec) DeleteLabel(name, value string) {
+	g.v.deleteLabel(name, value)
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	s *series
+}
+
+// Set sets the gauge to v.
+func (g *Gauge) Set(v float64) {
+	g.s.set(v)
+}
+
+// Add adds v to the gauge, v may be negative.
+func (g *Gauge) Add(v float64) {
+	g.s.add(v)
+}
+
+// Inc increments the gauge by 1.
+func (g *Gauge) Inc() {
+	g.s.add(1)
+}
+
+// Dec decrements the gauge by 1.
+func (g *Gauge) Dec() {
+	g.s.add(-1)
+}
+
+// HistogramVec is a set of histograms partitioned by label values.
+type HistogramVec struct {
+	v *vec
+}
+
+// With returns histogram for given label values.
+func (h *HistogramVec) With(values ...string) *Histogram {
+	return &Histogram{h.v.with(values)}
+}
+
+// Histogram counts observations in configurable buckets.
+type Histogram struct {
+	s *series
+}
+
+// Observe adds a single observation to the histogram.
+func (h *Histogram) Observe(v float64) {
+	h.s.observe(v)
+}
+
+type vec struct {
+	name    string
+	help    string
+	typ     string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+func (v *vec) with(values []string) *series {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s expected %d label values got %d", v.name, len(v.labels), len(values)))
+	}
+
+	key := strings.Join(values, "\xff")
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{
+			values: append([]string(nil), values...),
+		}
+		if v.buckets != nil {
+			s.buckets = v.buckets
+			s.counts = make([]uint64, len(v.buckets))
+		}
+		v.series[key] = s
+	}
+
+	return s
+}
+
+func (v *vec) delete(values []string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	delete(v.series, strings.Join(values, "\xff"))
+}
+
+func (v *vec) deleteLabel(name, value string) {
+	i := -1
+	for j, l := range v.labels {
+		if l == name {
+			i = j
+		}
+	}
+	if i < 0 {
+		return
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for key, s := range v.series {
+		if s.values[i] == value {
+			delete(v.series, key)
+		}
+	}
+}
+
+func (v *vec) writeTo(w *countWriter) {
+	v.mu.Lock()
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	series := make([]*series, 0, len(keys))
+	for _, key := range keys {
+		series = append(series, v.series[key])
+	}
+	v.mu.Unlock()
+
+	w.printf("# HELP %s %s\n", v.name, escape(v.help, false))
+	w.printf("# TYPE %s %s\n", v.name, v.typ)
+
+	for _, s := range series {
+		s.mu.Lock()
+		if v.typ != typeHistogram {
+			w.printf("%s%s %s\n", v.name, labels(v.labels, s.values, "", ""), format(s.value))
+			s.mu.Unlock()
+			continue
+		}
+
+		var cumulative uint64
+		for i, b := range v.buckets {
+			cumulative += s.counts[i]
+			w.printf("%s_bucket%s %d\n", v.name, labels(v.labels, s.values, "le", format(b)), cumulative)
+		}
+		w.printf("%s_bucket%s %d\n", v.name, labels(v.labels, s.values, "le", "+Inf"), s.count)
+		w.printf("%s_sum%s %s\n", v.name, labels(v.labels, s.values, "", ""), format(s.value))
+		w.printf("%s_count%s %d\n", v.name, labels(v.labels, s.values, "", ""), s.count)
+		s.mu.Unlock()
+	}
+}
+
+type series struct {
+	values  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	value  float64
+	counts []uint64
+	count  uint64
+}
+
+func (s *series) add(v float64) {
+	s.mu.Lock()
+	s.value += v
+	s.mu.Unlock()
+}
+
+func (s *series) set(v float64) {
+	s.mu.Lock()
+	s.value = v
+	s.mu.Unlock()
+}
+
+func (s *series) observe(v float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.value += v
+	s.count++
+	for i, b := range s.buckets {
+		if v <= b {
+			s.counts[i]++
+			break
+		}
+	}
+}
+
+func labels(names, values []string, extraName, extraValue string) string {
+	if len(names) == 0 && extraName == "" {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", name, escape(values[i], true))
+	}
+	if extraName != "" {
+		if len(names) > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", extraName, extraValue)
+	}
+	b.WriteByte('}')
+
+	return b.String()
+}
+
+func escape(s string, quote bool) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	if quote {
+		s = strings.Replace(s, `"`, `\"`, -1)
+	}
+	return s
+}
+
+func format(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type countWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (cw *countWriter) printf(format string, a ...interface{}) {
+	if cw.err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(cw.w, format, a...)
+	cw.n += int64(n)
+	cw.err = err
+}
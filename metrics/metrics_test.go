@@ -0,0 +1,109 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRegistryWriteTo(t *testing.T) {
+	t.Parallel()
+
+	r := NewRegistry()
+
+	c := r.Counter("requests_total", "Number of requests.", "code")
+	c.With("200").Inc()
+	c.With("200").Add(2)
+	c.With("502").Inc()
+
+	g := r.Gauge("clients", "Number of \\ clients.")
+	g.With().Inc()
+	g.With().Inc()
+	g.With().Dec()
+
+	h := r.Histogram("duration_seconds", "Request duration.", []float64{1, 0.1}, "host")
+	h.With(`a"b`).Observe(0.05)
+	h.With(`a"b`).Observe(0.5)
+	h.With(`a"b`).Observe(5)
+
+	if r.Counter("requests_total", "", "code").With("200") == nil {
+		t.Fatal("expected counter")
+	}
+
+	expected := `# HELP clients Number of \\ clients.
+# TYPE clients gauge
+clients 1
+# HELP duration_seconds Request duration.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{host="a\"b",le="0.1"} 1
+duration_seconds_bucket{host="a\"b",le="1"} 2
+duration_seconds_bucket{host="a\"b",le="+Inf"} 3
+duration_seconds_sum{host="a\"b"} 5.55
+duration_seconds_count{host="a\"b"} 3
+# HELP requests_total Number of requests.
+# TYPE requests_total counter
+requests_total{code="200"} 3
+requests_total{code="502"} 1
+`
+
+	var b bytes.Buffer
+	n, err := r.WriteTo(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(b.Len()) {
+		t.Error("size mismatch", n, b.Len())
+	}
+	if b.String() != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, b.String())
+	}
+}
+
+func TestRegistryTypeMismatch(t *testing.T) {
+	t.Parallel()
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic")
+		}
+	}()
+
+	r := NewRegistry()
+	r.Counter("foo", "")
+	r.Gauge("foo", "")
+}
+
+func TestDeleteLabel(t *testing.T) {
+	t.Parallel()
+
+	r := NewRegistry()
+
+	c := r.Counter("bytes_total", "", "tunnel", "dir")
+	c.With("a", "in").Inc()
+	c.With("a", "out").Inc()
+	c.With("b", "in").Inc()
+	c.DeleteLabel("tunnel", "a")
+	c.DeleteLabel("unknown", "b")
+
+	g := r.Gauge("streams", "", "tunnel")
+	g.With("a").Inc()
+	g.DeleteLabel("tunnel", "a")
+
+	expected := `# HELP bytes_total 
+# TYPE bytes_total counter
+bytes_total{tunnel="b",dir="in"} 1
+# HELP streams 
+# TYPE streams gauge
+`
+
+	var b bytes.Buffer
+	if _, err := r.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, b.String())
+	}
+}
@@ -6,6 +6,8 @@ package tunnel
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"net"
 	"net/http"
@@ -20,20 +22,33 @@ import (
 type connPair struct {
 	conn       net.Conn
 	clientConn *http2.ClientConn
+	// group is token shared by connections opened by one client process.
+	group string
+}
+
+// streams returns number of streams in progress and waiting on connection.
+func (cp connPair) streams() int {
+	st := cp.clientConn.State()
+	return st.StreamsActive + st.StreamsReserved + st.StreamsPending
 }
 
 type connPool struct {
-	t     *http2.Transport
-	conns map[string]connPair // key is host:port
+	t *http2.Transport
+	// conns maps host:port to control connections of a client, a client
+	// may open several connections, new streams are sent over the least
+	// loaded one.
+	conns map[string][]connPair
 	free  func(identifier id.ID)
-	mu    sync.RWMutex
+	// stopped is set on server shutdown, new connections are rejected.
+	stopped bool
+	mu      sync.RWMutex
 }
 
 func newConnPool(t *http2.Transport, f func(identifier id.ID)) *connPool {
 	return &connPool{
 		t:     t,
 		free:  f,
-		conns: make(map[string]connPair),
+		conns: make(map[string][]connPair),
 	}
 }
 
@@ -45,86 +60,273 @@ func (p *connPool) GetClientConn(req *http.Request, addr string) (*http2.ClientC
 	p.mu.RLock()
 	defer p.mu.RUnlock()
 
-	if cp, ok := p.conns[addr]; ok && cp.clientConn.CanTakeNewRequest() {
-		return cp.clientConn, nil
+	var (
+		best    *http2.ClientConn
+		streams int
+	)
+	for _, cp := range p.conns[addr] {
+		if !cp.clientConn.CanTakeNewRequest() {
+			continue
+		}
+		if n := cp.streams(); best == nil || n < streams {
+			best, streams = cp.clientConn, n
+		}
+	}
+	if best == nil {
+		return nil, errClientNotConnected
 	}
 
-	return nil, errClientNotConnected
+	return best, nil
 }
 
+// MarkDead is called by transport when connection is closed or client sent
+// GOAWAY, the connection is closed after in-flight streams are done. On server
+// shutdown connections are closed by the server.
 func (p *connPool) MarkDead(c *http2.ClientConn) {
-	p.mu.Lock()
-	defer p.mu.Unlock()
+	p.mu.RLock()
+	stopped := p.stopped
+	p.mu.RUnlock()
 
-	for addr, cp := range p.conns {
-		if cp.clientConn == c {
-			p.close(cp, addr)
-			return
+	if stopped {
+		return
+	}
+
+	go func() {
+		c.Shutdown(context.Background())
+
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		for addr, conns := range p.conns {
+			for _, cp := range conns {
+				if cp.clientConn == c {
+					p.close(cp, addr)
+					return
+				}
+			}
 		}
+	}()
+}
+
+// newConnGroup returns a random connection group token.
+func newConnGroup() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
 	}
+	return hex.EncodeToString(b[:]), nil
 }
 
-func (p *connPool) AddConn(conn net.Conn, identifier id.ID) error {
+// newClientConn creates HTTP/2 client connection over conn, it's used for
+// handshake before the connection is added to the pool.
+func (p *connPool) newClientConn(conn net.Conn) (*http2.ClientConn, error) {
+	return p.t.NewClientConn(conn)
+}
+
+// AddConn adds control connection of client to the pool. If extra is false
+// the connection starts a new group, connections of the client that do not
+// respond to ping are closed first so that a reconnecting client is not
+// mistaken for a running one. If extra is true the connection joins group
+// of running connections.
+func (p *connPool) AddConn(conn net.Conn, c *http2.ClientConn, identifier id.ID, group string, extra bool) error {
+	addr := p.addr(identifier)
+
+	var dead []connPair
+	if !extra {
+		p.mu.RLock()
+		conns := append([]connPair(nil), p.conns[addr]...)
+		p.mu.RUnlock()
+
+		dead = p.dead(conns)
+	}
+
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	addr := p.addr(identifier)
+	if p.stopped {
+		return errServerClosed
+	}
 
-	if cp, ok := p.conns[addr]; ok {
-		if err := p.ping(cp); err != nil {
-			p.close(cp, addr)
-		} else {
+	for _, cp := range dead {
+		p.close(cp, addr)
+	}
+
+	conns := p.conns[addr]
+	if extra {
+		if len(conns) == 0 || !constantTimeEqual(conns[0].group, group) {
+			return errClientAlreadyConnected
+		}
+		if len(conns) >= MaxClientConns {
 			return errClientAlreadyConnected
 		}
+	} else if len(conns) > 0 {
+		return errClientAlreadyConnected
 	}
 
-	c, err := p.t.NewClientConn(conn)
-	if err != nil {
-		return err
-	}
-	p.conns[addr] = connPair{
+	p.conns[addr] = append(conns, connPair{
 		conn:       conn,
 		clientConn: c,
-	}
+		group:      group,
+	})
 
 	return nil
 }
 
+// dead pings connections concurrently and returns those that do not respond.
+func (p *connPool) dead(conns []connPair) []connPair {
+	var (
+		dead []connPair
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+	)
+	for _, cp := range conns {
+		wg.Add(1)
+		go func(cp connPair) {
+			defer wg.Done()
+			if err := p.ping(cp, DefaultPingTimeout); err != nil {
+				mu.Lock()
+				dead = append(dead, cp)
+				mu.Unlock()
+			}
+		}(cp)
+	}
+	wg.Wait()
+
+	return dead
+}
+
+// DeleteConn closes all connections of client.
 func (p *connPool) DeleteConn(identifier id.ID) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
 	addr := p.addr(identifier)
 
-	if cp, ok := p.conns[addr]; ok {
+	for _, cp := range p.conns[addr] {
 		p.close(cp, addr)
 	}
 }
 
-func (p *connPool) Ping(identifier id.ID) (time.Duration, error) {
+// stop marks pool as stopped so that new connections are rejected, it returns
+// client connections in the pool.
+func (p *connPool) stop() []*http2.ClientConn {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	addr := p.addr(identifier)
+	p.stopped = true
 
-	if cp, ok := p.conns[addr]; ok {
+	var conns []*http2.ClientConn
+	for _, v := range p.conns {
+		for _, cp := range v {
+			conns = append(conns, cp.clientConn)
+		}
+	}
+	return conns
+}
+
+// closeAll closes all connections in the pool.
+func (p *connPool) closeAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for addr, conns := range p.conns {
+		for _, cp := range conns {
+			p.close(cp, addr)
+		}
+	}
+}
+
+func (p *connPool) Connected(identifier id.ID) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return len(p.conns[p.addr(identifier)]) > 0
+}
+
+// Conns returns number of control connections of client.
+func (p *connPool) Conns(identifier id.ID) int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return len(p.conns[p.addr(identifier)])
+}
+
+// Ping pings all connections of client, it returns the longest round trip
+// time.
+func (p *connPool) Ping(identifier id.ID) (time.Duration, error) {
+	p.mu.RLock()
+	conns := append([]connPair(nil), p.conns[p.addr(identifier)]...)
+	p.mu.RUnlock()
+
+	if len(conns) == 0 {
+		return 0, errClientNotConnected
+	}
+
+	var max time.Duration
+	for _, cp := range conns {
 		start := time.Now()
-		err := p.ping(cp)
-		return time.Since(start), err
+		if err := p.ping(cp, DefaultPingTimeout); err != nil {
+			return 0, err
+		}
+		if d := time.Since(start); d > max {
+			max = d
+		}
 	}
 
-	return 0, errClientNotConnected
+	return max, nil
 }
 
-func (p *connPool) ping(cp connPair) error {
-	ctx, cancel := context.WithTimeout(context.Background(), DefaultPingTimeout)
+// pingAll pings all connections of all clients concurrently and calls observe
+// with round trip time of every successful ping.
+func (p *connPool) pingAll(observe func(d time.Duration)) {
+	p.mu.RLock()
+	var conns []connPair
+	for _, v := range p.conns {
+		conns = append(conns, v...)
+	}
+	p.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, cp := range conns {
+		wg.Add(1)
+		go func(cp connPair) {
+			defer wg.Done()
+			start := time.Now()
+			if err := p.ping(cp, DefaultPingTimeout); err == nil {
+				observe(time.Since(start))
+			}
+		}(cp)
+	}
+	wg.Wait()
+}
+
+func (p *connPool) ping(cp connPair, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
 	return cp.clientConn.Ping(ctx)
 }
 
+// close closes connection of client, when the last connection is closed the
+// client is freed. It must be called with mu held.
 func (p *connPool) close(cp connPair, addr string) {
 	cp.conn.Close()
+
+	conns := make([]connPair, 0, len(p.conns[addr]))
+	for _, v := range p.conns[addr] {
+		if v.clientConn != cp.clientConn {
+			conns = append(conns, v)
+		}
+	}
+	if len(conns) == len(p.conns[addr]) {
+		// already closed
+		return
+	}
+	if len(conns) > 0 {
+		p.conns[addr] = conns
+		return
+	}
+
 	delete(p.conns, addr)
 	if p.free != nil {
 		p.free(p.identifier(addr))
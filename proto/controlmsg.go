@@ -12,15 +12,37 @@ import (
 // Protocol HTTP headers.
 const (
 	HeaderError = "X-Error"
+	// HeaderProxyError is set by client on responses it generates when
+	// local backend fails, the server replaces them with an error page.
+	HeaderProxyError = "X-Tunnel-Proxy-Error"
+	// HeaderClaimPrefix is prefix of headers carrying validated JWT claims
+	// forwarded by server i.e. "X-Jwt-Claim-Sub".
+	HeaderClaimPrefix = "X-Jwt-Claim-"
 
 	HeaderAction         = "X-Action"
 	HeaderForwardedHost  = "X-Forwarded-Host"
 	HeaderForwardedProto = "X-Forwarded-Proto"
+	HeaderTunnelHost     = "X-Tunnel-Host"
+	HeaderPathPrefix     = "X-Tunnel-Path-Prefix"
+	HeaderTunnelName     = "X-Tunnel-Name"
+	HeaderRemoteAddr     = "X-Tunnel-Remote-Addr"
+	HeaderLocalAddr      = "X-Tunnel-Local-Addr"
+	// HeaderConnGroup is set by server on handshake to a new connection
+	// group token, client replies with it or with the token of its first
+	// connection to open an additional connection.
+	HeaderConnGroup = "X-Tunnel-Conn-Group"
 )
 
 // Known actions.
 const (
-	ActionProxy = "proxy"
+	ActionProxy   = "proxy"
+	ActionTunnels = "tunnels"
+	ActionOpened  = "opened"
+
+	// ActionProxyHTTP2 is proxy of HTTP request sent as the request to
+	// client, headers, body and trailers of the user request are passed
+	// as is.
+	ActionProxyHTTP2 = "proxy-http2"
 )
 
 // Known protocol types.
@@ -33,6 +55,7 @@ const (
 	TCP6 = "tcp6"
 	UNIX = "unix"
 	SNI  = "sni"
+	UDP  = "udp"
 )
 
 // ControlMessage is sent from server to client before streaming data. It's
@@ -42,7 +65,20 @@ type ControlMessage struct {
 	Action         string
 	ForwardedHost  string
 	ForwardedProto string
-	RemoteAddr     string
+	// RemoteAddr is the address of the end user, for TCP and SNI
+	// connections it's sent by server, otherwise it's the address of the
+	// server.
+	RemoteAddr string
+	// LocalAddr is the server address TCP or SNI connection was accepted
+	// on.
+	LocalAddr string
+	// TunnelHost is the tunnel host ForwardedHost was matched with, it
+	// differs from ForwardedHost for wildcard hosts.
+	TunnelHost string
+	// PathPrefix is the tunnel path prefix HTTP request was matched with.
+	PathPrefix string
+	// TunnelName is the name of the tunnel as requested by client.
+	TunnelName string
 }
 
 // ReadControlMessage reads ControlMessage from HTTP headers.
@@ -52,6 +88,13 @@ func ReadControlMessage(r *http.Request) (*ControlMessage, error) {
 		ForwardedHost:  r.Header.Get(HeaderForwardedHost),
 		ForwardedProto: r.Header.Get(HeaderForwardedProto),
 		RemoteAddr:     r.RemoteAddr,
+		TunnelHost:     r.Header.Get(HeaderTunnelHost),
+		PathPrefix:     r.Header.Get(HeaderPathPrefix),
+		TunnelName:     r.Header.Get(HeaderTunnelName),
+		LocalAddr:      r.Header.Get(HeaderLocalAddr),
+	}
+	if addr := r.Header.Get(HeaderRemoteAddr); addr != "" {
+		msg.RemoteAddr = addr
 	}
 
 	var missing []string
@@ -73,9 +116,39 @@ func ReadControlMessage(r *http.Request) (*ControlMessage, error) {
 	return &msg, nil
 }
 
+// DeleteFromHeader removes ControlMessage headers from HTTP header except for
+// X-Forwarded-Host and X-Forwarded-Proto that are meaningful to backends.
+func DeleteFromHeader(h http.Header) {
+	for _, k := range []string{
+		HeaderAction,
+		HeaderTunnelHost,
+		HeaderPathPrefix,
+		HeaderTunnelName,
+		HeaderRemoteAddr,
+		HeaderLocalAddr,
+	} {
+		h.Del(k)
+	}
+}
+
 // WriteToHeader writes ControlMessage to HTTP header.
 func (c *ControlMessage) WriteToHeader(h http.Header) {
 	h.Set(HeaderAction, string(c.Action))
 	h.Set(HeaderForwardedHost, c.ForwardedHost)
 	h.Set(HeaderForwardedProto, c.ForwardedProto)
+	if c.TunnelHost != "" {
+		h.Set(HeaderTunnelHost, c.TunnelHost)
+	}
+	if c.PathPrefix != "" {
+		h.Set(HeaderPathPrefix, c.PathPrefix)
+	}
+	if c.TunnelName != "" {
+		h.Set(HeaderTunnelName, c.TunnelName)
+	}
+	if c.RemoteAddr != "" {
+		h.Set(HeaderRemoteAddr, c.RemoteAddr)
+	}
+	if c.LocalAddr != "" {
+		h.Set(HeaderLocalAddr, c.LocalAddr)
+	}
 }
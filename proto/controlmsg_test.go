@@ -26,6 +26,17 @@ func TestControlMessageWriteRead(t *testing.T) {
 			},
 			nil,
 		},
+		{
+			&ControlMessage{
+				Action:         "action",
+				ForwardedHost:  "foo.example.com",
+				ForwardedProto: "forwarded_proto",
+				TunnelHost:     "*.example.com",
+				PathPrefix:     "/api",
+				TunnelName:     "api",
+			},
+			nil,
+		},
 		{
 			&ControlMessage{
 				ForwardedHost:  "forwarded_host",
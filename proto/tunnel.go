@@ -12,12 +12,96 @@ type Tunnel struct {
 	// by the server.
 	Protocol string
 	// Host specified HTTP request host, it's required for HTTP and WS
-	// tunnels.
+	// tunnels unless server is configured to assign hosts.
 	Host string
-	// Auth specifies HTTP basic auth credentials in form "user:password",
-	// if set server would protect HTTP and WS tunnels with basic auth.
+	// Auth specifies HTTP basic auth credentials in htpasswd format, one
+	// "user:password" per line, the password may be a bcrypt, argon2, apr1
+	// or SHA hash. If set server would protect HTTP and WS tunnels with
+	// basic auth.
 	Auth string
-	// Addr specifies TCP address server would listen on, it's required
-	// for TCP tunnels.
+	// AuthFile specifies name of htpasswd file configured on the server
+	// with additional basic auth users.
+	AuthFile string `json:",omitempty"`
+	// JWT if enabled server would protect HTTP tunnel with JWT bearer
+	// token authentication, it's exclusive with Auth.
+	JWT bool `json:",omitempty"`
+	// Addr specifies TCP or UDP address server would listen on, if empty
+	// or port is 0 server allocates a port.
 	Addr string
+	// PathPrefix specifies optional HTTP path prefix, it allows several
+	// clients to share a host, requests are routed to the tunnel with the
+	// longest matching prefix.
+	PathPrefix string `json:",omitempty"`
+	// StripPrefix if enabled server removes PathPrefix from request path
+	// before passing the request to the client.
+	StripPrefix bool `json:",omitempty"`
+	// Pool if enabled allows other clients to serve the same HTTP host or
+	// TCP address, server balances traffic between them.
+	Pool bool `json:",omitempty"`
+	// HTTP2 if enabled server passes HTTP requests to client as HTTP/2
+	// requests preserving streaming and trailers i.e. for gRPC, the client
+	// talks HTTP/2 to the local service.
+	HTTP2 bool `json:",omitempty"`
+	// Allow specifies optional CIDRs or IP addresses allowed to access the
+	// tunnel, if empty any address is allowed.
+	Allow []string `json:",omitempty"`
+	// Deny specifies optional CIDRs or IP addresses denied access to the
+	// tunnel, it takes precedence over Allow.
+	Deny []string `json:",omitempty"`
+	// RequestHeaders specifies rewrite rules of HTTP request headers
+	// applied by server before passing the request to the client.
+	RequestHeaders []HeaderRule `json:",omitempty"`
+	// ResponseHeaders specifies rewrite rules of HTTP response headers
+	// applied by server before passing the response to the user.
+	ResponseHeaders []HeaderRule `json:",omitempty"`
+}
+
+// Header rewrite actions.
+const (
+	HeaderSet    = "set"
+	HeaderAdd    = "add"
+	HeaderRemove = "remove"
+	HeaderRename = "rename"
+)
+
+// HeaderRule describes rewriting of a single HTTP header.
+type HeaderRule struct {
+	// Action is HeaderSet, HeaderAdd, HeaderRemove or HeaderRename.
+	Action string
+	// Name is the header name.
+	Name string
+	// Value is the header value for set and add or the new header name for
+	// rename. Values may contain placeholders {remote_addr}, {client_id}
+	// and {host} replaced with address of the user, identifier of the
+	// client and request host.
+	Value string `json:",omitempty"`
+}
+
+// Tunnel update actions.
+const (
+	TunnelAdd    = "add"
+	TunnelRemove = "remove"
+)
+
+// TunnelUpdate is sent from client to server over ActionTunnels stream to open
+// or close a single tunnel without reconnecting.
+type TunnelUpdate struct {
+	// ID identifies the update, it's copied to TunnelUpdateResult.
+	ID uint64
+	// Action is TunnelAdd or TunnelRemove.
+	Action string
+	// Name is the tunnel name.
+	Name string
+	// Tunnel specifies tunnel to open, it's required for TunnelAdd.
+	Tunnel *Tunnel `json:",omitempty"`
+}
+
+// TunnelUpdateResult is sent from server to client as a response to
+// TunnelUpdate.
+type TunnelUpdateResult struct {
+	ID    uint64
+	Error string `json:",omitempty"`
+	// Tunnel is the opened tunnel with server assigned host or address,
+	// it's set for successful TunnelAdd.
+	Tunnel *Tunnel `json:",omitempty"`
 }
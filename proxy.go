@@ -6,6 +6,7 @@ package tunnel
 
 import (
 	"io"
+	"net/http"
 
 	"github.com/mmatczuk/go-http-tunnel/proto"
 )
@@ -14,23 +15,45 @@ import (
 // and writing the response.
 type ProxyFunc func(w io.Writer, r io.ReadCloser, msg *proto.ControlMessage)
 
+// proxyRequest is passed to ProxyFunc as reader of proto.ActionProxyHTTP2
+// messages, it reads the request body and gives HTTPProxy access to headers
+// and trailers of the request.
+type proxyRequest struct {
+	*http.Request
+}
+
+func (r *proxyRequest) Read(p []byte) (int, error) { return r.Body.Read(p) }
+func (r *proxyRequest) Close() error               { return r.Body.Close() }
+
 // ProxyFuncs is a collection of ProxyFunc.
 type ProxyFuncs struct {
 	// HTTP is custom implementation of HTTP proxing.
 	HTTP ProxyFunc
 	// TCP is custom implementation of TCP proxing.
 	TCP ProxyFunc
+	// UDP is custom implementation of UDP proxing.
+	UDP ProxyFunc
+	// Tunnels specifies optional ProxyFunc per tunnel name, it takes
+	// precedence over protocol functions if server sends the tunnel name.
+	Tunnels map[string]ProxyFunc
 }
 
 // Proxy returns a ProxyFunc that uses custom function if provided.
 func Proxy(p ProxyFuncs) ProxyFunc {
 	return func(w io.Writer, r io.ReadCloser, msg *proto.ControlMessage) {
+		if f := p.Tunnels[msg.TunnelName]; msg.TunnelName != "" && f != nil {
+			f(w, r, msg)
+			return
+		}
+
 		var f ProxyFunc
 		switch msg.ForwardedProto {
 		case proto.HTTP, proto.HTTPS:
 			f = p.HTTP
 		case proto.TCP, proto.TCP4, proto.TCP6, proto.UNIX:
 			f = p.TCP
+		case proto.UDP:
+			f = p.UDP
 		}
 
 		if f == nil {
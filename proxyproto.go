@@ -0,0 +1,387 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/log"
+)
+
+// PROXY protocol versions.
+const (
+	ProxyProtocolV1 = 1
+	ProxyProtocolV2 = 2
+)
+
+// proxyV2Signature starts every PROXY protocol v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// writeProxyHeader writes PROXY protocol header of version describing
+// connection from src to dst. If addresses are not TCP addresses the header
+// says the source is unknown.
+func writeProxyHeader(w io.Writer, version int, src, dst string) error {
+	srcIP, srcPort := splitIPPort(src)
+	dstIP, dstPort := splitIPPort(dst)
+
+	var b []byte
+	switch version {
+	case ProxyProtocolV1:
+		b = proxyHeaderV1(srcIP, srcPort, dstIP, dstPort)
+	case ProxyProtocolV2:
+		b = proxyHeaderV2(srcIP, srcPort, dstIP, dstPort)
+	default:
+		return fmt.Errorf("unsupported PROXY protocol version %d", version)
+	}
+
+	_, err := w.Write(b)
+	return err
+}
+
+func proxyHeaderV1(srcIP net.IP, srcPort int, dstIP net.IP, dstPort int) []byte {
+	if srcIP == nil || dstIP == nil {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+
+	if s4, d4 := srcIP.To4(), dstIP.To4(); s4 != nil && d4 != nil {
+		return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", s4, d4, srcPort, dstPort))
+	}
+
+	// mixed families use IPv6 for both
+	return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", ipv6String(srcIP), ipv6String(dstIP), srcPort, dstPort))
+}
+
+// ipv6String formats ip in IPv6 notation, IPv4 addresses are IPv4-mapped.
+func ipv6String(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
+
+func proxyHeaderV2(srcIP net.IP, srcPort int, dstIP net.IP, dstPort int) []byte {
+	var b bytes.Buffer
+	b.Write(proxyV2Signature)
+
+	if srcIP == nil || dstIP == nil {
+		// LOCAL command, unspecified family
+		b.Write([]byte{0x20, 0x00, 0x00, 0x00})
+		return b.Bytes()
+	}
+
+	var (
+		family byte
+		addrs  []byte
+	)
+	if s4, d4 := srcIP.To4(), dstIP.To4(); s4 != nil && d4 != nil {
+		family = 0x11 // TCP over IPv4
+		addrs = append(append(addrs, s4...), d4...)
+	} else {
+		family = 0x21 // TCP over IPv6
+		addrs = append(append(addrs, srcIP.To16()...), dstIP.To16()...)
+	}
+	addrs = append(addrs, byte(srcPort>>8), byte(srcPort), byte(dstPort>>8), byte(dstPort))
+
+	// version 2, PROXY command
+	b.Write([]byte{0x21, family})
+	binary.Write(&b, binary.BigEndian, uint16(len(addrs)))
+	b.Write(addrs)
+
+	return b.Bytes()
+}
+
+// splitIPPort returns IP and port of address in form "ip:port", IP is nil if
+// addr is not such an address.
+func splitIPPort(addr string) (net.IP, int) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, 0
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, 0
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 0 || p > 0xffff {
+		return nil, 0
+	}
+	return ip, p
+}
+
+// proxyListener reads PROXY protocol header of connections from trusted
+// addresses. Headers are read in background so that a slow peer does not
+// block Accept.
+type proxyListener struct {
+	net.Listener
+	trusted []*net.IPNet
+	timeout time.Duration
+	logger  log.Logger
+
+	conns   chan net.Conn
+	done    chan struct{}
+	stopped chan struct{}
+	err     error
+	once    sync.Once
+}
+
+// NewProxyProtocolListener returns listener reading PROXY protocol v1 or v2
+// header of connections from trusted CIDRs or IP addresses, addresses from the
+// header become remote and local address of the connection. Connections from
+// trusted addresses without a valid header are closed, connections from other
+// addresses are returned unchanged.
+func NewProxyProtocolListener(l net.Listener, trusted []string, logger log.Logger) (net.Listener, error) {
+	nets, err := parseCIDRs(trusted)
+	if err != nil {
+		return nil, err
+	}
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+
+	pl := &proxyListener{
+		Listener: l,
+		trusted:  nets,
+		timeout:  DefaultTimeout,
+		logger:   logger,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go pl.acceptLoop()
+
+	return pl, nil
+}
+
+func (l *proxyListener) acceptLoop() {
+	defer close(l.stopped)
+
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Temporary() {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			l.err = err
+			return
+		}
+
+		go func() {
+			c, err := l.readHeader(conn)
+			if err != nil {
+				l.logger.Log(
+					"level", 1,
+					"msg", "invalid PROXY protocol header",
+					"addr", conn.RemoteAddr(),
+					"err", err,
+				)
+				conn.Close()
+				return
+			}
+
+			select {
+			case l.conns <- c:
+			case <-l.done:
+				c.Close()
+			}
+		}()
+	}
+}
+
+// Accept implements net.Listener.
+func (l *proxyListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.stopped:
+		return nil, l.err
+	}
+}
+
+// Close implements net.Listener.
+func (l *proxyListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+	})
+	return l.Listener.Close()
+}
+
+func (l *proxyListener) readHeader(conn net.Conn) (net.Conn, error) {
+	if !containsIP(l.trusted, addrIP(conn.RemoteAddr())) {
+		return conn, nil
+	}
+
+	conn.SetReadDeadline(time.Now().Add(l.timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	r := bufio.NewReader(conn)
+	src, dst, err := readProxyHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &proxyConn{
+		Conn:   conn,
+		r:      r,
+		remote: conn.RemoteAddr(),
+		local:  conn.LocalAddr(),
+	}
+	if src != nil {
+		c.remote, c.local = src, dst
+	}
+
+	return c, nil
+}
+
+// proxyConn is a connection with addresses read from PROXY protocol header.
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+	local  net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+func (c *proxyConn) RemoteAddr() net.Addr       { return c.remote }
+func (c *proxyConn) LocalAddr() net.Addr        { return c.local }
+
+// CloseWrite closes write side of TCP connection.
+func (c *proxyConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// readProxyHeader reads PROXY protocol v1 or v2 header, it returns nil
+// addresses if the header does not carry addresses i.e. for health checks of
+// the proxy.
+func readProxyHeader(r *bufio.Reader) (src, dst net.Addr, err error) {
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, nil, err
+	}
+	if bytes.Equal(sig, proxyV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+	if bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return readProxyHeaderV1(r)
+	}
+
+	return nil, nil, errors.New("missing header")
+}
+
+// proxyV1MaxLen is the maximal length of PROXY protocol v1 header.
+const proxyV1MaxLen = 107
+
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLen {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errors.New("header too long")
+	}
+
+	f := strings.Fields(string(line[:len(line)-2]))
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("malformed header %q", line)
+	}
+
+	src, err := parseProxyAddr(f[2], f[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := parseProxyAddr(f[3], f[5])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return src, dst, nil
+}
+
+func parseProxyAddr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q", host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	hdr := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, nil, err
+	}
+	verCmd, family := hdr[12], hdr[13]
+	n := int(binary.BigEndian.Uint16(hdr[14:]))
+
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, nil, err
+	}
+
+	if verCmd>>4 != 2 {
+		return nil, nil, fmt.Errorf("unsupported version %d", verCmd>>4)
+	}
+	switch verCmd & 0x0f {
+	case 0x0:
+		// LOCAL, connection established by the proxy itself
+		return nil, nil, nil
+	case 0x1:
+		// PROXY
+	default:
+		return nil, nil, fmt.Errorf("unsupported command %d", verCmd&0x0f)
+	}
+
+	var size int
+	switch family {
+	case 0x11:
+		size = net.IPv4len
+	case 0x21:
+		size = net.IPv6len
+	default:
+		// not TCP, keep the connection addresses
+		return nil, nil, nil
+	}
+	if n < 2*size+4 {
+		return nil, nil, errors.New("header too short")
+	}
+
+	src := &net.TCPAddr{
+		IP:   net.IP(data[:size]),
+		Port: int(binary.BigEndian.Uint16(data[2*size:])),
+	}
+	dst := &net.TCPAddr{
+		IP:   net.IP(data[size : 2*size]),
+		Port: int(binary.BigEndian.Uint16(data[2*size+2:])),
+	}
+
+	return src, dst, nil
+}
@@ -0,0 +1,139 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func v2(b ...byte) string {
+	return string(append(append([]byte{}, proxyV2Signature...), b...))
+}
+
+func TestWriteProxyHeader(t *testing.T) {
+	tests := []struct {
+		version  int
+		src      string
+		dst      string
+		expected string
+	}{
+		{ProxyProtocolV1, "192.0.2.1:56324", "10.0.0.1:22", "PROXY TCP4 192.0.2.1 10.0.0.1 56324 22\r\n"},
+		{ProxyProtocolV1, "[2001:db8::1]:56324", "[2001:db8::2]:22", "PROXY TCP6 2001:db8::1 2001:db8::2 56324 22\r\n"},
+		{ProxyProtocolV1, "192.0.2.1:56324", "[2001:db8::2]:22", "PROXY TCP6 ::ffff:192.0.2.1 2001:db8::2 56324 22\r\n"},
+		{ProxyProtocolV1, "", "10.0.0.1:22", "PROXY UNKNOWN\r\n"},
+		{ProxyProtocolV2, "192.0.2.1:56324", "10.0.0.1:22", v2(
+			0x21, 0x11, 0x00, 0x0c,
+			192, 0, 2, 1,
+			10, 0, 0, 1,
+			0xdc, 0x04, 0x00, 0x16,
+		)},
+		{ProxyProtocolV2, "[2001:db8::1]:56324", "[2001:db8::2]:22", v2(
+			0x21, 0x21, 0x00, 0x24,
+			0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+			0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2,
+			0xdc, 0x04, 0x00, 0x16,
+		)},
+		{ProxyProtocolV2, "pipe", "10.0.0.1:22", v2(0x20, 0x00, 0x00, 0x00)},
+	}
+
+	for _, tt := range tests {
+		var b bytes.Buffer
+		if err := writeProxyHeader(&b, tt.version, tt.src, tt.dst); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != tt.expected {
+			t.Errorf("v%d %s %s: expected %q got %q", tt.version, tt.src, tt.dst, tt.expected, b.String())
+		}
+	}
+
+	if err := writeProxyHeader(&bytes.Buffer{}, 3, "", ""); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		trusted string
+		header  string
+		remote  string
+		data    string
+	}{
+		{"127.0.0.0/8", "PROXY TCP4 192.0.2.1 10.0.0.1 56324 443\r\n", "192.0.2.1:56324", "data"},
+		{"127.0.0.1", v2(0x21, 0x11, 0x00, 0x0c, 192, 0, 2, 1, 10, 0, 0, 1, 0xdc, 0x04, 0x01, 0xbb), "192.0.2.1:56324", "data"},
+		{"127.0.0.1", "PROXY UNKNOWN\r\n", "", "data"},
+		{"192.0.2.0/24", "PROXY TCP4 192.0.2.1 10.0.0.1 56324 443\r\n", "", "PROXY TCP4 192.0.2.1 10.0.0.1 56324 443\r\ndata"},
+	}
+
+	for _, tt := range tests {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pl, err := NewProxyProtocolListener(l, []string{tt.trusted}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// invalid header from trusted address is rejected
+		bad, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		bad.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Write([]byte(tt.header + "data"))
+		c.(*net.TCPConn).CloseWrite()
+
+		conn, err := pl.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn.RemoteAddr().String() == bad.LocalAddr().String() {
+			if tt.remote != "" {
+				t.Fatalf("%q: invalid header accepted", tt.header)
+			}
+			// untrusted connection is accepted as is
+			conn.Close()
+			if conn, err = pl.Accept(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		remote := tt.remote
+		if remote == "" {
+			remote = c.LocalAddr().String()
+		}
+		if conn.RemoteAddr().String() != remote {
+			t.Errorf("%q: expected remote address %s got %s", tt.header, remote, conn.RemoteAddr())
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		b, err := ioutil.ReadAll(conn)
+		if err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+		if string(b) != tt.data {
+			t.Errorf("%q: expected data %q got %q", tt.header, tt.data, b)
+		}
+
+		conn.Close()
+		bad.Close()
+		c.Close()
+		pl.Close()
+		if _, err := pl.Accept(); err == nil {
+			t.Fatal("expected error after close")
+		}
+	}
+}
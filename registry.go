@@ -7,10 +7,14 @@ package tunnel
 import (
 	"fmt"
 	"net"
+	"path"
+	"sort"
+	"strings"
 	"sync"
 
 	"github.com/mmatczuk/go-http-tunnel/id"
 	"github.com/mmatczuk/go-http-tunnel/log"
+	"github.com/mmatczuk/go-http-tunnel/proto"
 )
 
 // RegistryItem holds information about hosts and listeners associated with a
@@ -18,24 +22,81 @@ import (
 type RegistryItem struct {
 	Hosts     []*HostAuth
 	Listeners []net.Listener
+
+	// tunnels maps tunnel name to host or listener opened for it.
+	tunnels map[string]*registryTunnel
+}
+
+type registryTunnel struct {
+	// tunnel is the tunnel as opened by server, with assigned host and
+	// address.
+	tunnel   *proto.Tunnel
+	host     *HostAuth
+	listener net.Listener
+	// sni is set for SNI listeners.
+	sni string
+	// pool is set for listeners shared by a pool of clients, it's the
+	// listener key.
+	pool string
+	// filter is optional source address filter.
+	filter *ipFilter
 }
 
-// HostAuth holds host and authentication info.
+// HostAuth holds host, path prefix and authentication info.
 type HostAuth struct {
 	Host string
 	Auth *Auth
+	// PathPrefix specifies optional path prefix, requests are routed to
+	// the host with the longest matching prefix.
+	PathPrefix string
+	// StripPrefix if enabled removes PathPrefix from request path.
+	StripPrefix bool
+	// Pool if enabled allows other clients to register the same host and
+	// path prefix with Pool enabled, requests are balanced between them.
+	Pool bool
+	// JWT if enabled requires JWT bearer token authentication.
+	JWT bool
+	// HTTP2 if enabled requests are passed to client as HTTP/2 requests.
+	HTTP2 bool
+	// RequestHeaders specifies rewrite rules of request headers.
+	RequestHeaders []proto.HeaderRule
+	// ResponseHeaders specifies rewrite rules of response headers.
+	ResponseHeaders []proto.HeaderRule
+
+	filter *ipFilter
+}
+
+// Pool describes clients serving a host and path prefix or a shared
+// listener.
+type Pool struct {
+	Host       string
+	PathPrefix string
+	Addr       string
+	Clients    []id.ID
 }
 
 type hostInfo struct {
 	identifier id.ID
+	name       string
 	auth       *Auth
+	jwt        bool
+	http2      bool
+	prefix     string
+	strip      bool
+	pool       bool
+	filter     *ipFilter
+	reqRules   []proto.HeaderRule
+	respRules  []proto.HeaderRule
 }
 
 type registry struct {
-	items  map[id.ID]*RegistryItem
-	hosts  map[string]*hostInfo
-	mu     sync.RWMutex
-	logger log.Logger
+	items    map[id.ID]*RegistryItem
+	hosts    map[string][]*hostInfo // sorted by prefix length, longest first
+	sni      map[string]id.ID
+	pools    map[string][]poolMember // shared listener members by listener key
+	balancer *balancer
+	mu       sync.RWMutex
+	logger   log.Logger
 }
 
 func newRegistry(logger log.Logger) *registry {
@@ -43,10 +104,15 @@ func newRegistry(logger log.Logger) *registry {
 		logger = log.NewNopLogger()
 	}
 
+	b, _ := newBalancer(PoolRoundRobin)
+
 	return &registry{
-		items:  make(map[id.ID]*RegistryItem),
-		hosts:  make(map[string]*hostInfo),
-		logger: logger,
+		items:    make(map[id.ID]*RegistryItem),
+		hosts:    make(map[string][]*hostInfo),
+		sni:      make(map[string]id.ID),
+		pools:    make(map[string][]poolMember),
+		balancer: b,
+		logger:   logger,
 	}
 }
 
@@ -80,15 +146,244 @@ func (r *registry) IsSubscribed(identifier id.ID) bool {
 
 // Subscriber returns client identifier assigned to given host.
 func (r *registry) Subscriber(hostPort string) (id.ID, *Auth, bool) {
+	h, _, ok := r.match(hostPort, "/")
+	if !ok {
+		return id.ID{}, nil, false
+	}
+
+	return h.identifier, h.auth, ok
+}
+
+// match returns host info and the registered host matching given host and
+// path. Exact hosts take precedence over wildcards, and more specific
+// wildcards take precedence over less specific ones. Within a host the longest
+// matching path prefix wins. If the host is served by a pool of clients one of
+// them is selected by the balancer.
+func (r *registry) match(hostPort, path string) (*hostInfo, string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	host := hostKey(hostPort)
+	if h := r.matchPrefix(host, path); h != nil {
+		return h, host, true
+	}
+
+	labels := strings.Split(host, ".")
+	for i := 1; i < len(labels)-1; i++ {
+		w := "*." + strings.Join(labels[i:], ".")
+		if h := r.matchPrefix(w, path); h != nil {
+			return h, w, true
+		}
+	}
+
+	return nil, "", false
+}
+
+func (r *registry) matchPrefix(host, path string) *hostInfo {
+	hosts := r.hosts[host]
+	for i, h := range hosts {
+		if !pathHasPrefix(path, h.prefix) {
+			continue
+		}
+		if !h.pool {
+			return h
+		}
+
+		var (
+			pool []*hostInfo
+			ids  []id.ID
+		)
+		for _, v := range hosts[i:] {
+			if v.prefix == h.prefix {
+				pool = append(pool, v)
+				ids = append(ids, v.identifier)
+			}
+		}
+		return pool[r.balancer.pick(host+h.prefix, ids)]
+	}
+	return nil
+}
+
+// poolMember is a client serving a shared listener.
+type poolMember struct {
+	identifier id.ID
+	name       string
+}
+
+// matchListener returns client and its tunnel name selected from pool of
+// a shared listener.
+func (r *registry) matchListener(key string) (id.ID, string, bool) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
-	h, ok := r.hosts[trimPort(hostPort)]
+	members := r.pools[key]
+	if len(members) == 0 {
+		return id.ID{}, "", false
+	}
+
+	ids := make([]id.ID, len(members))
+	for i, m := range members {
+		ids[i] = m.identifier
+	}
+	m := members[r.balancer.pick(key, ids)]
+
+	return m.identifier, m.name, true
+}
+
+// tunnelFilter returns source address filter of a tunnel opened by client.
+func (r *registry) tunnelFilter(identifier id.ID, name string) *ipFilter {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	i, ok := r.items[identifier]
 	if !ok {
-		return id.ID{}, nil, false
+		return nil
+	}
+	t, ok := i.tunnels[name]
+	if !ok {
+		return nil
 	}
+	return t.filter
+}
 
-	return h.identifier, h.auth, ok
+// Pools returns clients serving hosts and shared listeners, hosts served by
+// a single client are included.
+func (r *registry) Pools() []*Pool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var pools []*Pool
+	for host, hosts := range r.hosts {
+		m := make(map[string]*Pool)
+		for _, h := range hosts {
+			p, ok := m[h.prefix]
+			if !ok {
+				p = &Pool{Host: host, PathPrefix: h.prefix}
+				m[h.prefix] = p
+				pools = append(pools, p)
+			}
+			p.Clients = append(p.Clients, h.identifier)
+		}
+	}
+	for key, members := range r.pools {
+		p := &Pool{Addr: key}
+		for _, m := range members {
+			p.Clients = append(p.Clients, m.identifier)
+		}
+		pools = append(pools, p)
+	}
+
+	sort.Slice(pools, func(i, j int) bool {
+		if pools[i].Host != pools[j].Host {
+			return pools[i].Host < pools[j].Host
+		}
+		if pools[i].PathPrefix != pools[j].PathPrefix {
+			return pools[i].PathPrefix < pools[j].PathPrefix
+		}
+		return pools[i].Addr < pools[j].Addr
+	})
+
+	return pools
+}
+
+// clusterState returns clients connected to the node and hosts and
+// listeners of their tunnels.
+func (r *registry) clusterState() *ClusterNode {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	n := &ClusterNode{}
+	for identifier, i := range r.items {
+		if i == voidRegistryItem {
+			continue
+		}
+		n.Clients = append(n.Clients, identifier)
+
+		for _, t := range i.tunnels {
+			switch {
+			case t.host != nil:
+				n.Hosts = append(n.Hosts, &ClusterHost{
+					Host:       hostKey(t.host.Host),
+					PathPrefix: cleanPathPrefix(t.host.PathPrefix),
+					Pool:       t.host.Pool,
+				})
+			case t.sni != "":
+				n.Hosts = append(n.Hosts, &ClusterHost{
+					Host: hostKey(t.sni),
+					SNI:  true,
+				})
+			case t.tunnel != nil && t.tunnel.Addr != "":
+				n.Listeners = append(n.Listeners, &ClusterListener{
+					Protocol: t.tunnel.Protocol,
+					Addr:     t.tunnel.Addr,
+					Pool:     t.pool != "",
+				})
+			}
+		}
+	}
+
+	return n
+}
+
+// sniRank returns specificity of SNI host pattern, exact hosts rank above
+// wildcards.
+func sniRank(pattern string) int {
+	if strings.HasPrefix(pattern, "*.") {
+		return len(pattern)
+	}
+	return 1 << 16
+}
+
+// clusterTarget returns tunnel serving stream forwarded by other cluster node,
+// target is SNI host or port of TCP or UDP listener. Exact SNI host is
+// preferred over wildcards, the longest wildcard wins.
+func (r *registry) clusterTarget(network, target string) (identifier id.ID, name string, t *registryTunnel, ok bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for k, i := range r.items {
+		if i == voidRegistryItem {
+			continue
+		}
+		for n, v := range i.tunnels {
+			if v.listener == nil || v.tunnel == nil {
+				continue
+			}
+			switch network {
+			case proto.SNI:
+				if v.sni == "" || !matchHost(v.sni, target) {
+					continue
+				}
+				if ok && sniRank(t.sni) >= sniRank(v.sni) {
+					continue
+				}
+			default:
+				if v.sni != "" || listenerNetwork(v.tunnel.Protocol) != network || listenerPort(v.tunnel.Addr) != target {
+					continue
+				}
+			}
+			identifier, name, t, ok = k, n, v, true
+		}
+	}
+
+	return
+}
+
+// Subscribers returns a copy of registry items of all subscribed clients, items
+// of subscribed but not connected clients are empty.
+func (r *registry) Subscribers() map[id.ID]*RegistryItem {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	items := make(map[id.ID]*RegistryItem, len(r.items))
+	for identifier, i := range r.items {
+		items[identifier] = &RegistryItem{
+			Hosts:     append([]*HostAuth(nil), i.Hosts...),
+			Listeners: append([]net.Listener(nil), i.Listeners...),
+		}
+	}
+
+	return items
 }
 
 // Unsubscribe removes client from registry and returns it's RegistryItem.
@@ -107,11 +402,7 @@ func (r *registry) Unsubscribe(identifier id.ID) *RegistryItem {
 		"identifier", identifier,
 	)
 
-	if i.Hosts != nil {
-		for _, h := range i.Hosts {
-			delete(r.hosts, h.Host)
-		}
-	}
+	r.release(i, identifier)
 
 	delete(r.items, identifier)
 
@@ -136,22 +427,113 @@ func (r *registry) set(i *RegistryItem, identifier id.ID) error {
 		return fmt.Errorf("attempt to overwrite registry item")
 	}
 
-	if i.Hosts != nil {
-		for _, h := range i.Hosts {
-			if h.Auth != nil && h.Auth.User == "" {
-				return fmt.Errorf("missing auth user")
-			}
-			if _, ok := r.hosts[trimPort(h.Host)]; ok {
-				return fmt.Errorf("host %q is occupied", h.Host)
+	// hosts of i are not in registry yet, duplicates within i are checked
+	// here
+	seen := make(map[string]bool, len(i.Hosts)+len(i.tunnels))
+	for _, h := range i.Hosts {
+		if err := r.checkHost(h, identifier); err != nil {
+			return err
+		}
+		k := hostKey(h.Host) + cleanPathPrefix(h.PathPrefix)
+		if seen[k] {
+			return fmt.Errorf("host %q is duplicated", h.Host+h.PathPrefix)
+		}
+		seen[k] = true
+	}
+	for _, t := range i.tunnels {
+		if err := r.checkSNI(t.sni, identifier); err != nil {
+			return err
+		}
+		if err := r.checkPool(t.pool, identifier); err != nil {
+			return err
+		}
+		if t.sni != "" {
+			k := "sni://" + hostKey(t.sni)
+			if seen[k] {
+				return fmt.Errorf("host %q is duplicated", t.sni)
 			}
+			seen[k] = true
 		}
+	}
 
-		for _, h := range i.Hosts {
-			r.hosts[trimPort(h.Host)] = &hostInfo{
-				identifier: identifier,
-				auth:       h.Auth,
-			}
+	names := make(map[*HostAuth]string, len(i.tunnels))
+	for name, t := range i.tunnels {
+		if t.host != nil {
+			names[t.host] = name
+		}
+	}
+	for _, h := range i.Hosts {
+		r.addHost(h, identifier, names[h])
+	}
+	for name, t := range i.tunnels {
+		if t.sni != "" {
+			r.sni[hostKey(t.sni)] = identifier
+		}
+		if t.pool != "" {
+			r.pools[t.pool] = append(r.pools[t.pool], poolMember{identifier, name})
+		}
+	}
+
+	r.items[identifier] = i
+
+	return nil
+}
+
+// add adds a single tunnel identified by name to registry item of a connected
+// client, t must have either host or listener set.
+func (r *registry) add(identifier id.ID, name string, t *registryTunnel) error {
+	r.logger.Log(
+		"level", 2,
+		"action", "add registry tunnel",
+		"identifier", identifier,
+		"name", name,
+	)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	j, ok := r.items[identifier]
+	if !ok {
+		return errClientNotSubscribed
+	}
+	if j == voidRegistryItem {
+		return errClientNotConnected
+	}
+	if _, ok := j.tunnels[name]; ok {
+		return fmt.Errorf("tunnel %q already exists", name)
+	}
+
+	i := &RegistryItem{
+		Hosts:     append([]*HostAuth(nil), j.Hosts...),
+		Listeners: append([]net.Listener(nil), j.Listeners...),
+		tunnels:   make(map[string]*registryTunnel, len(j.tunnels)+1),
+	}
+	for k, v := range j.tunnels {
+		i.tunnels[k] = v
+	}
+	i.tunnels[name] = t
+
+	if t.host != nil {
+		if err := r.checkHost(t.host, identifier); err != nil {
+			return err
 		}
+		r.addHost(t.host, identifier, name)
+		i.Hosts = append(i.Hosts, t.host)
+	}
+	if t.sni != "" {
+		if err := r.checkSNI(t.sni, identifier); err != nil {
+			return err
+		}
+		r.sni[hostKey(t.sni)] = identifier
+	}
+	if t.pool != "" {
+		if err := r.checkPool(t.pool, identifier); err != nil {
+			return err
+		}
+		r.pools[t.pool] = append(r.pools[t.pool], poolMember{identifier, name})
+	}
+	if t.listener != nil {
+		i.Listeners = append(i.Listeners, t.listener)
 	}
 
 	r.items[identifier] = i
@@ -159,6 +541,249 @@ func (r *registry) set(i *RegistryItem, identifier id.ID) error {
 	return nil
 }
 
+// remove removes a single tunnel identified by name from registry item of a
+// connected client and returns it, caller is responsible for closing the
+// listener.
+func (r *registry) remove(identifier id.ID, name string) (*registryTunnel, error) {
+	r.logger.Log(
+		"level", 2,
+		"action", "remove registry tunnel",
+		"identifier", identifier,
+		"name", name,
+	)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	j, ok := r.items[identifier]
+	if !ok {
+		return nil, errClientNotSubscribed
+	}
+	t, ok := j.tunnels[name]
+	if !ok {
+		return nil, fmt.Errorf("no such tunnel %q", name)
+	}
+
+	i := &RegistryItem{
+		Hosts:     make([]*HostAuth, 0, len(j.Hosts)),
+		Listeners: make([]net.Listener, 0, len(j.Listeners)),
+		tunnels:   make(map[string]*registryTunnel, len(j.tunnels)),
+	}
+	for k, v := range j.tunnels {
+		if k != name {
+			i.tunnels[k] = v
+		}
+	}
+	for _, h := range j.Hosts {
+		if h != t.host {
+			i.Hosts = append(i.Hosts, h)
+		}
+	}
+	for _, l := range j.Listeners {
+		if l != t.listener {
+			i.Listeners = append(i.Listeners, l)
+		}
+	}
+
+	if t.host != nil {
+		r.deleteHost(t.host, identifier)
+	}
+	if t.sni != "" {
+		delete(r.sni, hostKey(t.sni))
+	}
+	if t.pool != "" {
+		r.deletePoolMember(t.pool, identifier)
+	}
+
+	r.items[identifier] = i
+
+	return t, nil
+}
+
+// checkHost returns error if h is invalid, the same host and path prefix is
+// already registered or h overlaps with a different host of other client.
+// Overlapping hosts of the same client are allowed, the most specific one is
+// matched. Clients may share a host if they use different path prefixes or
+// all of them enable pool.
+func (r *registry) checkHost(h *HostAuth, identifier id.ID) error {
+	if h.Auth != nil {
+		if h.Auth.missingUser() {
+			return fmt.Errorf("missing auth user")
+		}
+		if err := h.Auth.checkCost(); err != nil {
+			return err
+		}
+	}
+
+	host := hostKey(h.Host)
+	if err := validateHost(host); err != nil {
+		return err
+	}
+	if err := validatePathPrefix(h.PathPrefix); err != nil {
+		return err
+	}
+	prefix := cleanPathPrefix(h.PathPrefix)
+	for _, v := range r.hosts[host] {
+		if v.prefix == prefix && (!h.Pool || !v.pool || v.identifier == identifier) {
+			return fmt.Errorf("host %q is occupied", h.Host+h.PathPrefix)
+		}
+	}
+	for k, hosts := range r.hosts {
+		if k == host {
+			continue
+		}
+		for _, v := range hosts {
+			if v.identifier != identifier && hostsOverlap(host, k) {
+				return fmt.Errorf("host %q overlaps with %q", h.Host, k)
+			}
+		}
+	}
+
+	return nil
+}
+
+// addHost adds h of tunnel name to hosts keeping the host slice sorted by
+// prefix length.
+func (r *registry) addHost(h *HostAuth, identifier id.ID, name string) {
+	host := hostKey(h.Host)
+	hosts := append(r.hosts[host], &hostInfo{
+		identifier: identifier,
+		name:       name,
+		auth:       h.Auth,
+		jwt:        h.JWT,
+		http2:      h.HTTP2,
+		prefix:     cleanPathPrefix(h.PathPrefix),
+		strip:      h.StripPrefix,
+		pool:       h.Pool,
+		filter:     h.filter,
+		reqRules:   h.RequestHeaders,
+		respRules:  h.ResponseHeaders,
+	})
+	sort.SliceStable(hosts, func(i, j int) bool {
+		return len(hosts[i].prefix) > len(hosts[j].prefix)
+	})
+	r.hosts[host] = hosts
+}
+
+// deleteHost removes h registered by client from hosts.
+func (r *registry) deleteHost(h *HostAuth, identifier id.ID) {
+	host := hostKey(h.Host)
+	prefix := cleanPathPrefix(h.PathPrefix)
+
+	hosts := make([]*hostInfo, 0, len(r.hosts[host]))
+	for _, v := range r.hosts[host] {
+		if v.prefix != prefix || v.identifier != identifier {
+			hosts = append(hosts, v)
+		}
+	}
+	if len(hosts) == 0 {
+		delete(r.hosts, host)
+	} else {
+		r.hosts[host] = hosts
+	}
+}
+
+// checkSNI is checkHost for SNI hosts.
+func (r *registry) checkSNI(sni string, identifier id.ID) error {
+	if sni == "" {
+		return nil
+	}
+
+	host := hostKey(sni)
+	if err := validateHost(host); err != nil {
+		return err
+	}
+	for k, v := range r.sni {
+		if k == host {
+			return fmt.Errorf("host %q is occupied", sni)
+		}
+		if v != identifier && hostsOverlap(host, k) {
+			return fmt.Errorf("host %q overlaps with %q", sni, k)
+		}
+	}
+
+	return nil
+}
+
+// opened returns tunnels of i as opened by server.
+func (i *RegistryItem) opened() map[string]*proto.Tunnel {
+	m := make(map[string]*proto.Tunnel, len(i.tunnels))
+	for name, t := range i.tunnels {
+		if t.tunnel != nil {
+			m[name] = t.tunnel
+		}
+	}
+	return m
+}
+
+// isHostFree returns true if host can be registered by any client.
+func (r *registry) isHostFree(host string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.checkHost(&HostAuth{Host: host}, id.ID{}) == nil
+}
+
+// served returns true if host or shared listener of t is served by a client,
+// pool members share them.
+func (r *registry) served(t *registryTunnel) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if t.host != nil {
+		prefix := cleanPathPrefix(t.host.PathPrefix)
+		for _, h := range r.hosts[hostKey(t.host.Host)] {
+			if h.prefix == prefix {
+				return true
+			}
+		}
+	}
+	if t.pool != "" {
+		return len(r.pools[t.pool]) > 0
+	}
+	return false
+}
+
+// checkPool returns error if client is already a member of the pool.
+func (r *registry) checkPool(key string, identifier id.ID) error {
+	for _, m := range r.pools[key] {
+		if m.identifier == identifier {
+			return fmt.Errorf("listener %q is occupied", key)
+		}
+	}
+	return nil
+}
+
+// deletePoolMember removes client from pool of a shared listener.
+func (r *registry) deletePoolMember(key string, identifier id.ID) {
+	members := make([]poolMember, 0, len(r.pools[key]))
+	for _, m := range r.pools[key] {
+		if m.identifier != identifier {
+			members = append(members, m)
+		}
+	}
+	if len(members) == 0 {
+		delete(r.pools, key)
+	} else {
+		r.pools[key] = members
+	}
+}
+
+// release removes hosts and pool memberships of i from registry.
+func (r *registry) release(i *RegistryItem, identifier id.ID) {
+	for _, h := range i.Hosts {
+		r.deleteHost(h, identifier)
+	}
+	for _, t := range i.tunnels {
+		if t.sni != "" {
+			delete(r.sni, hostKey(t.sni))
+		}
+		if t.pool != "" {
+			r.deletePoolMember(t.pool, identifier)
+		}
+	}
+}
+
 func (r *registry) clear(identifier id.ID) *RegistryItem {
 	r.logger.Log(
 		"level", 2,
@@ -174,11 +799,7 @@ func (r *registry) clear(identifier id.ID) *RegistryItem {
 		return nil
 	}
 
-	if i.Hosts != nil {
-		for _, h := range i.Hosts {
-			delete(r.hosts, trimPort(h.Host))
-		}
-	}
+	r.release(i, identifier)
 
 	r.items[identifier] = voidRegistryItem
 
@@ -192,3 +813,80 @@ func trimPort(hostPort string) (host string) {
 	}
 	return
 }
+
+// hostKey returns normalized host used as a registry key.
+func hostKey(hostPort string) string {
+	return strings.ToLower(trimPort(hostPort))
+}
+
+// validateHost checks that host is not empty and if it's a wildcard it has
+// form "*.example.com".
+func validateHost(host string) error {
+	if host == "" {
+		return fmt.Errorf("missing host")
+	}
+	if !strings.Contains(host, "*") {
+		return nil
+	}
+	if !strings.HasPrefix(host, "*.") || strings.Contains(host[2:], "*") || !strings.Contains(host[2:], ".") {
+		return fmt.Errorf("invalid wildcard host %q, expected form *.example.com", host)
+	}
+	return nil
+}
+
+// isWildcard returns true if host is a wildcard host.
+func isWildcard(host string) bool {
+	return strings.HasPrefix(host, "*.")
+}
+
+// hostCovers returns true if pattern matches host, host may be a wildcard.
+func hostCovers(pattern, host string) bool {
+	if pattern == host {
+		return true
+	}
+	if !isWildcard(pattern) {
+		return false
+	}
+	return strings.HasSuffix(host, pattern[1:])
+}
+
+// hostsOverlap returns true if there is a host matched by both a and b.
+func hostsOverlap(a, b string) bool {
+	return hostCovers(a, b) || hostCovers(b, a)
+}
+
+// validatePathPrefix checks that prefix is empty or an absolute path.
+func validatePathPrefix(prefix string) error {
+	if prefix != "" && !strings.HasPrefix(prefix, "/") {
+		return fmt.Errorf("invalid path prefix %q, must start with /", prefix)
+	}
+	return nil
+}
+
+// cleanPathPrefix removes trailing slashes from prefix, root prefix is empty.
+func cleanPathPrefix(prefix string) string {
+	return strings.TrimRight(prefix, "/")
+}
+
+// cleanRequestPath returns p with dot segments and repeated slashes removed,
+// trailing slash is kept. Requests are matched and forwarded with the clean
+// path so that ../ can not step out of a path prefix.
+func cleanRequestPath(p string) string {
+	c := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && c != "/" {
+		c += "/"
+	}
+	return c
+}
+
+// pathHasPrefix returns true if path equals prefix or is prefix followed by
+// a path segment, prefix must be clean.
+func pathHasPrefix(path, prefix string) bool {
+	if prefix == "" {
+		return true
+	}
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || path[len(prefix)] == '/'
+}
@@ -0,0 +1,308 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+)
+
+func TestRegistryWildcard(t *testing.T) {
+	t.Parallel()
+
+	a := id.New([]byte("a"))
+	b := id.New([]byte("b"))
+
+	r := newRegistry(nil)
+	r.Subscribe(a)
+	r.Subscribe(b)
+
+	if err := r.set(&RegistryItem{
+		Hosts: []*HostAuth{
+			{Host: "*.preview.example.com"},
+			{Host: "*.a.preview.example.com"},
+			{Host: "api.preview.example.com"},
+		},
+	}, a); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host     string
+		expected string
+	}{
+		{"foo.preview.example.com", "*.preview.example.com"},
+		{"FOO.preview.example.com:8080", "*.preview.example.com"},
+		{"foo.bar.preview.example.com", "*.preview.example.com"},
+		{"foo.a.preview.example.com", "*.a.preview.example.com"},
+		{"api.preview.example.com", "api.preview.example.com"},
+		{"preview.example.com", ""},
+		{"example.com", ""},
+	}
+	for _, tt := range tests {
+		_, host, ok := r.match(tt.host, "/")
+		if host != tt.expected || ok != (tt.expected != "") {
+			t.Errorf("%s: expected %q got %q", tt.host, tt.expected, host)
+		}
+	}
+
+	if err := r.set(&RegistryItem{}, b); err != nil {
+		t.Fatal(err)
+	}
+
+	// hosts overlapping with hosts of other client are rejected
+	for _, host := range []string{
+		"*.preview.example.com",
+		"*.b.preview.example.com",
+		"b.preview.example.com",
+		"*.example.com",
+		"api.preview.example.com",
+		"*.*.example.com",
+		"foo.*.example.com",
+		"*.com",
+	} {
+		err := r.add(b, host, &registryTunnel{host: &HostAuth{Host: host}})
+		if err == nil {
+			t.Errorf("%s: expected error", host)
+		}
+	}
+
+	if err := r.add(b, "b", &registryTunnel{host: &HostAuth{Host: "*.example.org"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.add(b, "sni", &registryTunnel{sni: "*.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.add(a, "sni", &registryTunnel{sni: "foo.example.com"}); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := r.add(b, "sni2", &registryTunnel{sni: "foo.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.add(b, "sni3", &registryTunnel{sni: "*.example.com"}); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestRegistrySetDuplicate(t *testing.T) {
+	t.Parallel()
+
+	a := id.New([]byte("a"))
+
+	r := newRegistry(nil)
+	r.Subscribe(a)
+
+	for _, i := range []*RegistryItem{
+		{Hosts: []*HostAuth{{Host: "foo.com"}, {Host: "FOO.com"}}},
+		{Hosts: []*HostAuth{{Host: "foo.com", PathPrefix: "/api"}, {Host: "foo.com", PathPrefix: "/api/", Pool: true}}},
+		{tunnels: map[string]*registryTunnel{"a": {sni: "foo.com"}, "b": {sni: "foo.com"}}},
+	} {
+		if err := r.set(i, a); err == nil {
+			t.Errorf("%+v: expected error", i)
+		}
+	}
+
+	if err := r.set(&RegistryItem{Hosts: []*HostAuth{
+		{Host: "foo.com"},
+		{Host: "foo.com", PathPrefix: "/api"},
+		{Host: "*.foo.com"},
+	}}, a); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCleanRequestPath(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"", "/"},
+		{"/", "/"},
+		{"/a/b", "/a/b"},
+		{"/a/b/", "/a/b/"},
+		{"/a/../b", "/b"},
+		{"/a/./b/", "/a/b/"},
+		{"/a/b/..", "/a"},
+		{"/a/b/../", "/a/"},
+		{"/../a", "/a"},
+		{"//a///b", "/a/b"},
+		{"a", "/a"},
+	}
+	for _, tt := range tests {
+		if p := cleanRequestPath(tt.path); p != tt.expected {
+			t.Errorf("%q: expected %q got %q", tt.path, tt.expected, p)
+		}
+	}
+}
+
+func TestRegistryAuthCost(t *testing.T) {
+	t.Parallel()
+
+	a := id.New([]byte("a"))
+
+	r := newRegistry(nil)
+	r.Subscribe(a)
+
+	auth := NewAuth("user:$2y$13$r0SDW468IYKWiBq3c0AcmuFLnwhoJdzr1.DaxvgjUouEpmJMTctCi")
+	if err := r.set(&RegistryItem{Hosts: []*HostAuth{{Host: "foo.com", Auth: auth}}}, a); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestRegistryPathPrefix(t *testing.T) {
+	t.Parallel()
+
+	a := id.New([]byte("a"))
+	b := id.New([]byte("b"))
+
+	r := newRegistry(nil)
+	r.Subscribe(a)
+	r.Subscribe(b)
+
+	if err := r.set(&RegistryItem{
+		Hosts: []*HostAuth{
+			{Host: "example.com"},
+			{Host: "example.com", PathPrefix: "/api/v2/", StripPrefix: true},
+		},
+	}, a); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.set(&RegistryItem{
+		Hosts: []*HostAuth{
+			{Host: "example.com", PathPrefix: "/api"},
+		},
+	}, b); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path       string
+		identifier id.ID
+		prefix     string
+	}{
+		{"/", a, ""},
+		{"/apis", a, ""},
+		{"/api", b, "/api"},
+		{"/api/v1/users", b, "/api"},
+		{"/api/v2", a, "/api/v2"},
+		{"/api/v2/users", a, "/api/v2"},
+		{"/api/v2/../v1", b, "/api"},
+		{"/api/v2/%2e%2e/v1", b, "/api"},
+		{"/api/../apis", a, ""},
+		{"/api//v2/", a, "/api/v2"},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, _, ok := r.match("example.com", cleanRequestPath(u.Path))
+		if !ok {
+			t.Errorf("%s: no match", tt.path)
+			continue
+		}
+		if h.identifier != tt.identifier || h.prefix != tt.prefix {
+			t.Errorf("%s: expected %s %q got %s %q", tt.path, tt.identifier, tt.prefix, h.identifier, h.prefix)
+		}
+	}
+	if h, _, _ := r.match("example.com", "/api/v2/x"); !h.strip {
+		t.Error("expected strip")
+	}
+
+	for _, prefix := range []string{"", "/api/", "api"} {
+		err := r.add(b, "x", &registryTunnel{host: &HostAuth{Host: "example.com", PathPrefix: prefix}})
+		if err == nil {
+			t.Errorf("%q: expected error", prefix)
+		}
+	}
+
+	r.Unsubscribe(b)
+	if h, _, _ := r.match("example.com", "/api/v1"); h.identifier != a {
+		t.Errorf("expected fallback to %s got %s", a, h.identifier)
+	}
+}
+
+func TestRegistryPool(t *testing.T) {
+	t.Parallel()
+
+	a := id.New([]byte("a"))
+	b := id.New([]byte("b"))
+	c := id.New([]byte("c"))
+
+	r := newRegistry(nil)
+	for _, identifier := range []id.ID{a, b, c} {
+		r.Subscribe(identifier)
+	}
+
+	if err := r.set(&RegistryItem{
+		Hosts: []*HostAuth{{Host: "example.com", Pool: true}},
+	}, a); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.set(&RegistryItem{
+		Hosts: []*HostAuth{{Host: "example.com", Pool: true}},
+	}, b); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.set(&RegistryItem{}, c); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.add(c, "x", &registryTunnel{host: &HostAuth{Host: "example.com"}}); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := r.add(a, "x", &registryTunnel{host: &HostAuth{Host: "example.com", Pool: true}}); err == nil {
+		t.Fatal("expected error")
+	}
+
+	count := make(map[id.ID]int)
+	for i := 0; i < 4; i++ {
+		h, _, _ := r.match("example.com", "/")
+		count[h.identifier]++
+	}
+	if count[a] != 2 || count[b] != 2 {
+		t.Fatalf("expected round robin got %v", count)
+	}
+
+	r.clear(a)
+	for i := 0; i < 2; i++ {
+		if h, _, _ := r.match("example.com", "/"); h.identifier != b {
+			t.Fatalf("expected %s got %s", b, h.identifier)
+		}
+	}
+	if p := r.Pools(); len(p) != 1 || len(p[0].Clients) != 1 {
+		t.Fatalf("unexpected pools %+v", p)
+	}
+
+	if err := r.add(c, "x", &registryTunnel{pool: "tcp://:80"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.add(b, "x", &registryTunnel{pool: "tcp://:80"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.add(b, "y", &registryTunnel{pool: "tcp://:80"}); err == nil {
+		t.Fatal("expected error")
+	}
+
+	r.balancer, _ = newBalancer(PoolLeastStreams)
+	r.balancer.acquire(b)
+	for i := 0; i < 2; i++ {
+		if identifier, _, _ := r.matchListener("tcp://:80"); identifier != c {
+			t.Fatalf("expected %s got %s", c, identifier)
+		}
+	}
+	r.balancer.release(b)
+
+	if _, err := r.remove(c, "x"); err != nil {
+		t.Fatal(err)
+	}
+	r.clear(b)
+	if _, _, ok := r.matchListener("tcp://:80"); ok {
+		t.Fatal("expected empty pool")
+	}
+}
@@ -5,6 +5,8 @@
 package tunnel
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"crypto/tls"
 	"crypto/x509"
@@ -12,9 +14,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/http2"
@@ -22,6 +29,7 @@ import (
 	"github.com/inconshreveable/go-vhost"
 	"github.com/mmatczuk/go-http-tunnel/id"
 	"github.com/mmatczuk/go-http-tunnel/log"
+	"github.com/mmatczuk/go-http-tunnel/metrics"
 	"github.com/mmatczuk/go-http-tunnel/proto"
 )
 
@@ -58,6 +66,55 @@ type ServerConfig struct {
 	SNIAddr string
 	// Optional listener to manage subscribers
 	SubscriptionListener SubscriptionListener
+	// SubscriptionStore specifies optional store of subscriptions, they are
+	// loaded on start, written on Subscribe and Unsubscribe and reloaded
+	// when the store is changed externally.
+	SubscriptionStore SubscriptionStore
+	// Metrics specifies optional registry server metrics are added to.
+	Metrics *metrics.Registry
+	// PoolPolicy specifies how a client is selected when several clients
+	// serve the same host or listener, PoolRoundRobin or PoolLeastStreams.
+	// If empty PoolRoundRobin is used.
+	PoolPolicy string
+	// Domain specifies optional base domain of server assigned hosts. If
+	// set HTTP tunnels with empty host get a random subdomain of Domain.
+	Domain string
+	// ListenPolicy specifies optional restrictions of addresses TCP and
+	// UDP tunnels listen on. If nil clients may listen on any address.
+	ListenPolicy *ListenPolicy
+	// AccessPolicy specifies optional server wide filtering by source
+	// address, it's applied in addition to allow and deny lists of tunnels.
+	AccessPolicy *AccessPolicy
+	// AccessLog specifies optional log of public HTTP requests and TCP
+	// connections.
+	AccessLog *AccessLog
+	// ErrorPages specifies optional custom error pages of HTTP tunnels, if
+	// nil built-in pages are used.
+	ErrorPages *ErrorPages
+	// JWT specifies optional JWT bearer token authentication of HTTP
+	// tunnels.
+	JWT *JWTConfig
+	// AuthFiles specifies htpasswd files HTTP tunnels may reference by
+	// name instead of sending credentials.
+	AuthFiles map[string]*HtpasswdFile
+	// ProxyProtocol specifies CIDRs or IP addresses of load balancers in
+	// front of the server, PROXY protocol v1 or v2 header is read from
+	// their connections to TCP and SNI listeners so that the real source
+	// address is used in logs, access control and forwarded headers.
+	ProxyProtocol []string
+	// HeaderRules specifies optional header rewrite rules of HTTP tunnels,
+	// they are applied after the rules of tunnels.
+	HeaderRules []*HeaderRules
+	// FlushInterval specifies the flush interval of HTTP response bodies
+	// sent to users. If zero, no periodic flushing is done. A negative
+	// value means to flush immediately after each write. Responses of
+	// unknown length i.e. server-sent events and gRPC are always flushed
+	// immediately.
+	FlushInterval time.Duration
+	// Cluster specifies optional cluster configuration, nodes of a cluster
+	// share hosts and listeners of connected clients and forward public
+	// HTTP requests to the node the client is connected to.
+	Cluster *ClusterConfig
 }
 
 // Server is responsible for proxying public connections to the client over a
@@ -71,6 +128,27 @@ type Server struct {
 	httpClient *http.Client
 	logger     log.Logger
 	vhostMuxer *vhost.TLSMuxer
+	metrics    *serverMetrics
+	access     *accessControl
+	jwt        *jwtAuth
+	cluster    *cluster
+
+	// ctx is canceled on shutdown, it bounds long running streams to
+	// clients.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	sharedMu sync.Mutex
+	shared   map[string]*sharedListener
+
+	// mirrors are listeners on ports of TCP and UDP tunnels of other
+	// cluster nodes, connections are forwarded to them. Keys are network
+	// and port.
+	mirrorsMu sync.Mutex
+	mirrors   map[string]net.Listener
+
+	subsMu sync.RWMutex
+	subs   map[id.ID]*Subscription
 }
 
 // NewServer creates a new Server.
@@ -85,12 +163,55 @@ func NewServer(config *ServerConfig) (*Server, error) {
 		logger = log.NewNopLogger()
 	}
 
+	b, err := newBalancer(config.PoolPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.ListenPolicy != nil {
+		if err := config.ListenPolicy.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, r := range config.HeaderRules {
+		if err := ValidateHeaderRules(r.Request); err != nil {
+			return nil, fmt.Errorf("request header rules of %q: %s", r.Host, err)
+		}
+		if err := ValidateHeaderRules(r.Response); err != nil {
+			return nil, fmt.Errorf("response header rules of %q: %s", r.Host, err)
+		}
+	}
+
+	if _, err := parseCIDRs(config.ProxyProtocol); err != nil {
+		return nil, fmt.Errorf("PROXY protocol: %s", err)
+	}
+
+	access, err := newAccessControl(config.AccessPolicy)
+	if err != nil {
+		return nil, fmt.Errorf("access policy: %s", err)
+	}
+
+	var jwt *jwtAuth
+	if config.JWT != nil {
+		if jwt, err = newJWTAuth(config.JWT); err != nil {
+			return nil, fmt.Errorf("JWT: %s", err)
+		}
+	}
+
 	s := &Server{
 		registry: newRegistry(logger),
 		config:   config,
 		listener: listener,
 		logger:   logger,
+		metrics:  newServerMetrics(config.Metrics),
+		shared:   make(map[string]*sharedListener),
+		access:   access,
+		jwt:      jwt,
+		subs:     make(map[id.ID]*Subscription),
 	}
+	s.registry.balancer = b
+	s.ctx, s.cancel = context.WithCancel(context.Background())
 
 	t := &http2.Transport{}
 	pool := newConnPool(t, s.disconnected)
@@ -103,13 +224,29 @@ func NewServer(config *ServerConfig) (*Server, error) {
 		},
 	}
 
+	if config.Cluster != nil {
+		if s.cluster, err = newCluster(config.Cluster, s.registry.clusterState, logger); err != nil {
+			s.cancel()
+			return nil, fmt.Errorf("cluster: %s", err)
+		}
+		s.cluster.synced = s.syncMirrors
+		s.mirrors = make(map[string]net.Listener)
+	}
+
 	if config.SNIAddr != "" {
 		l, err := net.Listen("tcp", config.SNIAddr)
 		if err != nil {
+			s.cancel()
+			return nil, err
+		}
+		if l, err = s.acceptProxyProtocol(l); err != nil {
+			s.cancel()
 			return nil, err
 		}
 		mux, err := vhost.NewTLSMuxer(l, DefaultTimeout)
 		if err != nil {
+			l.Close()
+			s.cancel()
 			return nil, fmt.Errorf("SNI Muxer creation failed: %s", err)
 		}
 		s.vhostMuxer = mux
@@ -130,6 +267,11 @@ func NewServer(config *ServerConfig) (*Server, error) {
 						"addr", conn.RemoteAddr(),
 					)
 				case vhost.NotFound:
+					// host may be served by other cluster node
+					if node := s.cluster.lookupSNI(vhostName); node != nil && tlsConn != nil {
+						go s.cluster.stream(tlsConn, node, proto.SNI, vhostName)
+						continue
+					}
 
 					logger.Log(
 						"level", 0,
@@ -151,9 +293,66 @@ func NewServer(config *ServerConfig) (*Server, error) {
 		}()
 	}
 
+	if config.SubscriptionStore != nil {
+		subs, err := config.SubscriptionStore.Load()
+		if err != nil {
+			if s.vhostMuxer != nil {
+				s.vhostMuxer.Close()
+			}
+			s.cancel()
+			return nil, fmt.Errorf("loading subscriptions failed: %s", err)
+		}
+		s.syncSubscriptions(subs)
+	}
+
+	// start background work last so that it sees fully built server and
+	// does not leak on errors
+	if config.SubscriptionStore != nil {
+		go config.SubscriptionStore.Watch(s.ctx, s.syncSubscriptions)
+	}
+	if s.cluster != nil {
+		go s.cluster.run(s.ctx)
+	}
+	go s.pingClients()
+
 	return s, nil
 }
 
+// pingClients measures round trip time of connected clients every
+// DefaultPingInterval until server is shut down.
+func (s *Server) pingClients() {
+	t := time.NewTicker(DefaultPingInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-t.C:
+			s.connPool.pingAll(func(d time.Duration) {
+				s.metrics.pingDuration.Observe(d.Seconds())
+			})
+		}
+	}
+}
+
+// deleteTunnelMetrics removes per tunnel metric series of removed tunnels so
+// that they do not accumulate, hosts and listeners still served by other
+// pool members are kept.
+func (s *Server) deleteTunnelMetrics(i *RegistryItem) {
+	if i == nil {
+		return
+	}
+	for _, t := range i.tunnels {
+		if s.registry.served(t) {
+			continue
+		}
+		label := t.metricLabel()
+		s.metrics.streams.DeleteLabel("tunnel", label)
+		s.metrics.bytes.DeleteLabel("tunnel", label)
+	}
+}
+
 func listener(config *ServerConfig) (net.Listener, error) {
 	if config.Listener != nil {
 		return config.Listener, nil
@@ -177,11 +376,14 @@ func (s *Server) disconnected(identifier id.ID) {
 		"action", "disconnected",
 		"identifier", identifier,
 	)
+	s.metrics.clients.Dec()
 
 	i := s.registry.clear(identifier)
 	if i == nil {
 		return
 	}
+	s.cluster.changed()
+	s.deleteTunnelMetrics(i)
 	for _, l := range i.Listeners {
 		s.logger.Log(
 			"level", 2,
@@ -251,10 +453,14 @@ func (s *Server) handleClient(conn net.Conn) {
 		req        *http.Request
 		resp       *http.Response
 		tunnels    map[string]*proto.Tunnel
+		opened     map[string]*proto.Tunnel
 		err        error
 		ok         bool
+		reason     string
 
 		inConnPool bool
+		cc         *http2.ClientConn
+		group      string
 		certs      []*x509.Certificate
 	)
 
@@ -265,6 +471,7 @@ func (s *Server) handleClient(conn net.Conn) {
 			"msg", "invalid connection type",
 			"err", fmt.Errorf("expected TLS conn, got %T", conn),
 		)
+		reason = "invalid_conn"
 		goto reject
 	}
 
@@ -275,6 +482,7 @@ func (s *Server) handleClient(conn net.Conn) {
 			"msg", "certificate error",
 			"err", err,
 		)
+		reason = "certificate"
 		goto reject
 	}
 
@@ -285,19 +493,20 @@ func (s *Server) handleClient(conn net.Conn) {
 		certs = tlsConn.ConnectionState().VerifiedChains[0]
 	}
 	if s.config.AutoSubscribe {
-		s.Subscribe(identifier)
+		s.registry.Subscribe(identifier)
 		if s.config.SubscriptionListener != nil {
 			s.config.SubscriptionListener.Subscribed(identifier, tlsConn, certs)
 		}
 	} else if !s.IsSubscribed(identifier) {
 		if s.config.SubscriptionListener != nil && s.config.SubscriptionListener.CanSubscribe(identifier, certs) {
-			s.Subscribe(identifier)
+			s.registry.Subscribe(identifier)
 			s.config.SubscriptionListener.Subscribed(identifier, tlsConn, certs)
 		} else {
 			logger.Log(
 				"level", 2,
 				"msg", "unknown client",
 			)
+			reason = "unknown_client"
 			goto reject
 		}
 	}
@@ -308,18 +517,29 @@ func (s *Server) handleClient(conn net.Conn) {
 			"msg", "setting infinite deadline failed",
 			"err", err,
 		)
+		reason = "deadline"
 		goto reject
 	}
 
-	if err := s.connPool.AddConn(conn, identifier); err != nil {
+	if cc, err = s.connPool.newClientConn(conn); err != nil {
 		logger.Log(
 			"level", 2,
-			"msg", "adding connection failed",
+			"msg", "connection setup failed",
 			"err", err,
 		)
+		reason = "conn_pool"
+		goto reject
+	}
+
+	if group, err = newConnGroup(); err != nil {
+		logger.Log(
+			"level", 2,
+			"msg", "handshake request creation failed",
+			"err", err,
+		)
+		reason = "handshake"
 		goto reject
 	}
-	inConnPool = true
 
 	req, err = http.NewRequest(http.MethodConnect, s.connPool.URL(identifier), nil)
 	if err != nil {
@@ -328,8 +548,12 @@ func (s *Server) handleClient(conn net.Conn) {
 			"msg", "handshake request creation failed",
 			"err", err,
 		)
+		reason = "handshake"
 		goto reject
 	}
+	// client joins a new connection group or replies with the group of its
+	// first connection
+	req.Header.Set(proto.HeaderConnGroup, group)
 
 	{
 		ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
@@ -337,15 +561,19 @@ func (s *Server) handleClient(conn net.Conn) {
 		req = req.WithContext(ctx)
 	}
 
-	resp, err = s.httpClient.Do(req)
+	// the connection is not in the pool yet, handshake is sent over it
+	// directly
+	resp, err = cc.RoundTrip(req)
 	if err != nil {
 		logger.Log(
 			"level", 2,
 			"msg", "handshake failed",
 			"err", err,
 		)
+		reason = "handshake"
 		goto reject
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		err = fmt.Errorf("Status %s", resp.Status)
@@ -354,8 +582,41 @@ func (s *Server) handleClient(conn net.Conn) {
 			"msg", "handshake failed",
 			"err", err,
 		)
+		reason = "handshake"
+		goto reject
+	}
+
+	// tunnels are registered by the first connection, other connections
+	// only carry streams
+	if g := resp.Header.Get(proto.HeaderConnGroup); g != "" && g != group {
+		if err = s.connPool.AddConn(conn, cc, identifier, g, true); err != nil {
+			logger.Log(
+				"level", 2,
+				"msg", "adding connection failed",
+				"err", err,
+			)
+			reason = "conn_pool"
+			goto reject
+		}
+		logger.Log(
+			"level", 1,
+			"action", "connection added",
+			"conns", s.connPool.Conns(identifier),
+		)
+		return
+	}
+
+	if err = s.connPool.AddConn(conn, cc, identifier, group, false); err != nil {
+		logger.Log(
+			"level", 2,
+			"msg", "adding connection failed",
+			"err", err,
+		)
+		reason = "conn_pool"
 		goto reject
 	}
+	inConnPool = true
+	s.metrics.clients.Inc()
 
 	if resp.ContentLength == 0 {
 		err = fmt.Errorf("Tunnels Content-Legth: 0")
@@ -364,6 +625,7 @@ func (s *Server) handleClient(conn net.Conn) {
 			"msg", "handshake failed",
 			"err", err,
 		)
+		reason = "handshake"
 		goto reject
 	}
 
@@ -373,6 +635,7 @@ func (s *Server) handleClient(conn net.Conn) {
 			"msg", "handshake failed",
 			"err", err,
 		)
+		reason = "handshake"
 		goto reject
 	}
 
@@ -383,15 +646,17 @@ func (s *Server) handleClient(conn net.Conn) {
 			"msg", "handshake failed",
 			"err", err,
 		)
+		reason = "handshake"
 		goto reject
 	}
 
-	if err = s.addTunnels(tunnels, identifier); err != nil {
+	if opened, err = s.addTunnels(tunnels, identifier); err != nil {
 		logger.Log(
 			"level", 2,
 			"msg", "handshake failed",
 			"err", err,
 		)
+		reason = "tunnels"
 		goto reject
 	}
 
@@ -399,6 +664,10 @@ func (s *Server) handleClient(conn net.Conn) {
 		"level", 1,
 		"action", "connected",
 	)
+	s.metrics.handshakes.With("success").Inc()
+
+	s.notifyOpened(opened, identifier)
+	go s.handleTunnelUpdates(identifier)
 
 	return
 
@@ -407,6 +676,7 @@ reject:
 		"level", 1,
 		"action", "rejected",
 	)
+	s.metrics.handshakes.With(reason).Inc()
 
 	if inConnPool {
 		s.notifyError(err, identifier)
@@ -441,55 +711,70 @@ func (s *Server) notifyError(serverError error, identifier id.ID) {
 	s.httpClient.Do(req.WithContext(ctx))
 }
 
-// addTunnels invokes addHost or addListener based on data from proto.Tunnel. If
-// a tunnel cannot be added whole batch is reverted.
-func (s *Server) addTunnels(tunnels map[string]*proto.Tunnel, identifier id.ID) error {
+// notifyOpened tries to send opened tunnels with server assigned hosts and
+// addresses to client.
+func (s *Server) notifyOpened(opened map[string]*proto.Tunnel, identifier id.ID) {
+	b, err := json.Marshal(opened)
+	if err != nil {
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.connPool.URL(identifier), bytes.NewReader(b))
+	if err != nil {
+		s.logger.Log(
+			"level", 2,
+			"action", "client opened notification failed",
+			"identifier", identifier,
+			"err", err,
+		)
+		return
+	}
+	req.Header.Set(proto.HeaderAction, proto.ActionOpened)
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+	defer cancel()
+
+	resp, err := s.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		s.logger.Log(
+			"level", 2,
+			"action", "client opened notification failed",
+			"identifier", identifier,
+			"err", err,
+		)
+		return
+	}
+	resp.Body.Close()
+}
+
+// addTunnels invokes openTunnel for every tunnel from proto.Tunnel map and
+// returns the opened tunnels. If a tunnel cannot be added whole batch is
+// reverted.
+func (s *Server) addTunnels(tunnels map[string]*proto.Tunnel, identifier id.ID) (map[string]*proto.Tunnel, error) {
 	i := &RegistryItem{
 		Hosts:     []*HostAuth{},
 		Listeners: []net.Listener{},
+		tunnels:   make(map[string]*registryTunnel, len(tunnels)),
 	}
 
 	var err error
 	for name, t := range tunnels {
-		switch t.Protocol {
-		case proto.HTTP:
-			i.Hosts = append(i.Hosts, &HostAuth{t.Host, NewAuth(t.Auth)})
-		case proto.TCP, proto.TCP4, proto.TCP6, proto.UNIX:
-			var l net.Listener
-			l, err = net.Listen(t.Protocol, t.Addr)
-			if err != nil {
-				goto rollback
-			}
-
-			s.logger.Log(
-				"level", 2,
-				"action", "open listener",
-				"identifier", identifier,
-				"addr", l.Addr(),
-			)
-
-			i.Listeners = append(i.Listeners, l)
-		case proto.SNI:
-			if s.vhostMuxer == nil {
-				err = fmt.Errorf("unable to configure SNI for tunnel %s: %s", name, t.Protocol)
-				goto rollback
-			}
-			var l net.Listener
-			l, err = s.vhostMuxer.Listen(t.Host)
-			if err != nil {
-				goto rollback
-			}
+		var rt *registryTunnel
+		rt, err = s.openTunnel(name, t, identifier)
+		if err != nil {
+			goto rollback
+		}
 
-			s.logger.Log(
-				"level", 2,
-				"action", "add SNI vhost",
-				"identifier", identifier,
-				"host", t.Host,
-			)
+		if rt.host != nil {
+			i.Hosts = append(i.Hosts, rt.host)
+		}
+		if rt.listener != nil {
+			i.Listeners = append(i.Listeners, rt.listener)
+		}
+		i.tunnels[name] = rt
 
-			i.Listeners = append(i.Listeners, l)
-		default:
-			err = fmt.Errorf("unsupported protocol for tunnel %s: %s", name, t.Protocol)
+		if err = s.cluster.checkTunnel(rt, t.Addr); err != nil {
+			err = fmt.Errorf("unable to open tunnel %s: %s", name, err)
 			goto rollback
 		}
 	}
@@ -498,184 +783,1241 @@ func (s *Server) addTunnels(tunnels map[string]*proto.Tunnel, identifier id.ID)
 	if err != nil {
 		goto rollback
 	}
+	s.cluster.changed()
 
-	for _, l := range i.Listeners {
-		go s.listen(l, identifier)
+	for name, t := range i.tunnels {
+		if t.listener != nil && t.pool == "" {
+			go s.listen(t.listener, identifier, name, "")
+		}
 	}
 
-	return nil
+	return i.opened(), nil
 
 rollback:
 	for _, l := range i.Listeners {
 		l.Close()
 	}
 
-	return err
-}
-
-// Unsubscribe removes client from registry, disconnects client if already
-// connected and returns it's RegistryItem.
-func (s *Server) Unsubscribe(identifier id.ID) *RegistryItem {
-	if s.config.SubscriptionListener != nil {
-		s.config.SubscriptionListener.Unsubscribed(identifier)
-	}
-	s.connPool.DeleteConn(identifier)
-	return s.registry.Unsubscribe(identifier)
+	return nil, err
 }
 
-// Ping measures the RTT response time.
-func (s *Server) Ping(identifier id.ID) (time.Duration, error) {
-	return s.connPool.Ping(identifier)
-}
+// openTunnel creates host or opens listener based on data from proto.Tunnel.
+func (s *Server) openTunnel(name string, t *proto.Tunnel, identifier id.ID) (*registryTunnel, error) {
+	opened := *t
 
-func (s *Server) listen(l net.Listener, identifier id.ID) {
-	addr := l.Addr().String()
+	filter, err := newIPFilter(t.Allow, t.Deny)
+	if err != nil {
+		return nil, fmt.Errorf("invalid access list for tunnel %s: %s", name, err)
+	}
 
-	for {
-		conn, err := l.Accept()
-		if err != nil {
-			if strings.Contains(err.Error(), "use of closed network connection") ||
-				strings.Contains(err.Error(), "Listener closed") {
-				s.logger.Log(
-					"level", 2,
-					"action", "listener closed",
-					"identifier", identifier,
-					"addr", addr,
-				)
-				return
+	switch t.Protocol {
+	case proto.HTTP:
+		if t.Host == "" && s.config.Domain != "" {
+			host, err := s.assignHost()
+			if err != nil {
+				return nil, fmt.Errorf("unable to assign host for tunnel %s: %s", name, err)
 			}
+			opened.Host = host
 
 			s.logger.Log(
-				"level", 0,
-				"msg", "accept of connection failed",
+				"level", 2,
+				"action", "assign host",
 				"identifier", identifier,
-				"addr", addr,
-				"err", err,
+				"host", host,
 			)
-			continue
+		}
+		if err := validateHost(hostKey(opened.Host)); err != nil {
+			return nil, fmt.Errorf("invalid host for tunnel %s: %s", name, err)
+		}
+		if err := s.checkHost(opened.Host, identifier); err != nil {
+			return nil, fmt.Errorf("invalid host for tunnel %s: %s", name, err)
+		}
+		if t.JWT && s.jwt == nil {
+			return nil, fmt.Errorf("JWT auth is not supported for tunnel %s", name)
+		}
+		if t.JWT && (t.Auth != "" || t.AuthFile != "") {
+			return nil, fmt.Errorf("auth and JWT are exclusive for tunnel %s", name)
+		}
+		if err := ValidateHeaderRules(t.RequestHeaders); err != nil {
+			return nil, fmt.Errorf("invalid request headers for tunnel %s: %s", name, err)
+		}
+		if err := ValidateHeaderRules(t.ResponseHeaders); err != nil {
+			return nil, fmt.Errorf("invalid response headers for tunnel %s: %s", name, err)
+		}
+		auth := NewAuth(t.Auth)
+		if t.AuthFile != "" {
+			f, ok := s.config.AuthFiles[t.AuthFile]
+			if !ok {
+				return nil, fmt.Errorf("unknown auth file %q for tunnel %s", t.AuthFile, name)
+			}
+			if auth == nil {
+				auth = &Auth{}
+			}
+			auth.File = f
+		}
+		return &registryTunnel{tunnel: &opened, host: &HostAuth{
+			Host:        opened.Host,
+			Auth:        auth,
+			PathPrefix:  t.PathPrefix,
+			StripPrefix: t.StripPrefix,
+			Pool:        t.Pool,
+			JWT:         t.JWT,
+			HTTP2:       t.HTTP2,
+			filter:      filter,
+
+			RequestHeaders:  t.RequestHeaders,
+			ResponseHeaders: t.ResponseHeaders,
+		}, filter: filter}, nil
+	case proto.TCP, proto.TCP4, proto.TCP6, proto.UNIX:
+		if t.Pool {
+			rt, err := s.openSharedListener(name, t, identifier)
+			if err != nil {
+				return nil, err
+			}
+			rt.filter = filter
+			return rt, nil
 		}
 
-		msg := &proto.ControlMessage{
-			Action:         proto.ActionProxy,
-			ForwardedProto: l.Addr().Network(),
+		l, err := s.listenTunnel(t.Protocol, t.Addr)
+		if err != nil {
+			return nil, fmt.Errorf("unable to listen for tunnel %s: %s", name, err)
 		}
+		opened.Addr = l.Addr().String()
 
-		tlsConn, ok := conn.(*vhost.TLSConn)
-		if ok {
-			msg.ForwardedHost = tlsConn.Host()
-			err = keepAlive(tlsConn.Conn)
+		s.logger.Log(
+			"level", 2,
+			"action", "open listener",
+			"identifier", identifier,
+			"addr", l.Addr(),
+		)
 
-		} else {
-			msg.ForwardedHost = l.Addr().String()
-			err = keepAlive(conn)
+		return &registryTunnel{tunnel: &opened, listener: l, filter: filter}, nil
+	case proto.UDP:
+		if t.Pool {
+			return nil, fmt.Errorf("pool is not supported for tunnel %s: %s", name, t.Protocol)
 		}
 
+		pc, err := s.listenPacketTunnel(t.Protocol, t.Addr)
 		if err != nil {
-			s.logger.Log(
-				"level", 1,
-				"msg", "TCP keepalive for tunneled connection failed",
-				"identifier", identifier,
-				"ctrlMsg", msg,
-				"err", err,
-			)
+			return nil, fmt.Errorf("unable to listen for tunnel %s: %s", name, err)
 		}
+		l := newUDPListener(pc, DefaultUDPIdleTimeout)
+		opened.Addr = l.Addr().String()
 
-		go func() {
-			if err := s.proxyConn(identifier, conn, msg); err != nil {
-				s.logger.Log(
-					"level", 0,
-					"msg", "proxy error",
-					"identifier", identifier,
-					"ctrlMsg", msg,
-					"err", err,
-				)
-			}
-		}()
+		s.logger.Log(
+			"level", 2,
+			"action", "open UDP listener",
+			"identifier", identifier,
+			"addr", l.Addr(),
+		)
+
+		return &registryTunnel{tunnel: &opened, listener: l, filter: filter}, nil
+	case proto.SNI:
+		if s.vhostMuxer == nil {
+			return nil, fmt.Errorf("unable to configure SNI for tunnel %s: %s", name, t.Protocol)
+		}
+		if err := validateHost(hostKey(t.Host)); err != nil {
+			return nil, fmt.Errorf("invalid host for tunnel %s: %s", name, err)
+		}
+		if err := s.checkHost(t.Host, identifier); err != nil {
+			return nil, fmt.Errorf("invalid host for tunnel %s: %s", name, err)
+		}
+		l, err := s.vhostMuxer.Listen(t.Host)
+		if err != nil {
+			return nil, err
+		}
+
+		s.logger.Log(
+			"level", 2,
+			"action", "add SNI vhost",
+			"identifier", identifier,
+			"host", t.Host,
+		)
+
+		return &registryTunnel{tunnel: &opened, listener: l, sni: t.Host, filter: filter}, nil
+	default:
+		return nil, fmt.Errorf("unsupported protocol for tunnel %s: %s", name, t.Protocol)
 	}
 }
 
-func (s *Server) Upgrade(identifier id.ID, conn net.Conn, requestBytes []byte) error {
+// assignHost returns a random unused subdomain of Domain.
+func (s *Server) assignHost() (string, error) {
+	for i := 0; i < 10; i++ {
+		sub, err := randomSubdomain()
+		if err != nil {
+			return "", err
+		}
+		host := sub + "." + s.config.Domain
+		if s.isHostFree(host) {
+			return host, nil
+		}
+	}
 
-	var err error
+	return "", errors.New("no free subdomain")
+}
 
-	msg := &proto.ControlMessage{
-		Action:         proto.ActionProxy,
-		ForwardedProto: "https",
-	}
+// openSharedListener returns handle to listener shared by a pool of clients,
+// the listener is opened by the first member.
+func (s *Server) openSharedListener(name string, t *proto.Tunnel, identifier id.ID) (*registryTunnel, error) {
+	key := t.Protocol + "://" + t.Addr
 
-	tlsConn, ok := conn.(*tls.Conn)
-	if ok {
-		msg.ForwardedHost = tlsConn.ConnectionState().ServerName
-		err = keepAlive(tlsConn.NetConn())
+	s.sharedMu.Lock()
+	defer s.sharedMu.Unlock()
 
-	} else {
-		msg.ForwardedHost = conn.RemoteAddr().String()
-		err = keepAlive(conn)
-	}
+	sl, ok := s.shared[key]
+	if !ok {
+		s.releaseMirror(t.Protocol, t.Addr)
+		l, err := s.listenTunnel(t.Protocol, t.Addr)
+		if err != nil {
+			return nil, fmt.Errorf("unable to listen for tunnel %s: %s", name, err)
+		}
 
-	if err != nil {
 		s.logger.Log(
-			"level", 1,
-			"msg", "TCP keepalive for tunneled connection failed",
+			"level", 2,
+			"action", "open shared listener",
 			"identifier", identifier,
-			"ctrlMsg", msg,
-			"err", err,
+			"addr", l.Addr(),
 		)
+
+		sl = &sharedListener{Listener: l, key: key}
+		s.shared[key] = sl
+		go s.listen(l, id.ID{}, "", key)
 	}
+	sl.refs++
+
+	pl := &poolListener{sharedListener: sl}
+	pl.close = func() {
+		s.closeSharedListener(sl)
+	}
+
+	opened := *t
+	opened.Addr = sl.Addr().String()
+
+	return &registryTunnel{tunnel: &opened, listener: pl, pool: key}, nil
+}
+
+// listenTunnel opens listener for TCP tunnel according to ListenPolicy.
+func (s *Server) listenTunnel(network, addr string) (net.Listener, error) {
+	var (
+		l   net.Listener
+		err error
+	)
+	if s.config.ListenPolicy == nil {
+		l, err = net.Listen(network, addr)
+	} else {
+		l, err = s.config.ListenPolicy.listen(network, addr)
+	}
+	if err != nil || network == proto.UNIX {
+		return l, err
+	}
+
+	return s.acceptProxyProtocol(l)
+}
+
+// acceptProxyProtocol wraps l so that it reads PROXY protocol header from
+// load balancers, l is returned as is if ProxyProtocol is not configured.
+func (s *Server) acceptProxyProtocol(l net.Listener) (net.Listener, error) {
+	if len(s.config.ProxyProtocol) == 0 {
+		return l, nil
+	}
+
+	pl, err := NewProxyProtocolListener(l, s.config.ProxyProtocol, s.logger)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return pl, nil
+}
+
+// listenPacketTunnel opens packet listener for UDP tunnel according to
+// ListenPolicy.
+func (s *Server) listenPacketTunnel(network, addr string) (net.PacketConn, error) {
+	if s.config.ListenPolicy == nil {
+		return net.ListenPacket(network, addr)
+	}
+	return s.config.ListenPolicy.listenPacket(network, addr)
+}
+
+// closeSharedListener releases a handle to shared listener, the listener is
+// closed when the last handle is released.
+func (s *Server) closeSharedListener(sl *sharedListener) {
+	s.sharedMu.Lock()
+	defer s.sharedMu.Unlock()
+
+	if sl.refs--; sl.refs > 0 {
+		return
+	}
+
+	s.logger.Log(
+		"level", 2,
+		"action", "close shared listener",
+		"addr", sl.Addr(),
+	)
+
+	delete(s.shared, sl.key)
+	sl.Listener.Close()
+}
+
+// handleTunnelUpdates opens ActionTunnels stream to the client and applies
+// tunnel updates sent by the client until the stream is closed. Clients not
+// supporting tunnel updates reject the stream. If the connection carrying the
+// stream is lost while other connections of the client are alive the stream
+// is opened again.
+func (s *Server) handleTunnelUpdates(identifier id.ID) {
+	for s.tunnelUpdates(identifier) {
+		if !s.connPool.Connected(identifier) || s.ctx.Err() != nil {
+			return
+		}
+		s.logger.Log(
+			"level", 2,
+			"action", "reopen tunnel updates",
+			"identifier", identifier,
+		)
+	}
+}
+
+// tunnelUpdates serves a single ActionTunnels stream, it returns true if the
+// stream was lost.
+func (s *Server) tunnelUpdates(identifier id.ID) bool {
+	logger := log.NewContext(s.logger).With("identifier", identifier)
+
+	pr, pw := io.Pipe()
+	defer pw.Close()
+
+	// closing request body lets transport notice canceled context
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-s.ctx.Done():
+			pw.Close()
+		case <-done:
+		}
+	}()
+
+	req, err := http.NewRequest(http.MethodPost, s.connPool.URL(identifier), pr)
+	if err != nil {
+		logger.Log(
+			"level", 0,
+			"msg", "tunnel updates request creation failed",
+			"err", err,
+		)
+		return false
+	}
+	req.Header.Set(proto.HeaderAction, proto.ActionTunnels)
+	req = req.WithContext(s.ctx)
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		logger.Log(
+			"level", 2,
+			"msg", "tunnel updates failed",
+			"err", err,
+		)
+		return false
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		logger.Log(
+			"level", 2,
+			"msg", "tunnel updates not supported by client",
+			"status", resp.Status,
+		)
+		return false
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	enc := json.NewEncoder(pw)
+	for {
+		var u proto.TunnelUpdate
+		if err := dec.Decode(&u); err != nil {
+			if err != io.EOF {
+				logger.Log(
+					"level", 2,
+					"msg", "tunnel updates closed",
+					"err", err,
+				)
+				return true
+			}
+			return false
+		}
+
+		res := proto.TunnelUpdateResult{ID: u.ID}
+		if res.Tunnel, err = s.updateTunnel(&u, identifier); err != nil {
+			logger.Log(
+				"level", 1,
+				"msg", "tunnel update failed",
+				"action", u.Action,
+				"name", u.Name,
+				"err", err,
+			)
+			res.Error = err.Error()
+		}
+		if err := enc.Encode(&res); err != nil {
+			return false
+		}
+	}
+}
+
+// updateTunnel opens or closes a single tunnel of a connected client, it
+// returns the opened tunnel.
+func (s *Server) updateTunnel(u *proto.TunnelUpdate, identifier id.ID) (*proto.Tunnel, error) {
+	s.logger.Log(
+		"level", 1,
+		"action", "update tunnel",
+		"identifier", identifier,
+		"update", u.Action,
+		"name", u.Name,
+	)
+
+	switch u.Action {
+	case proto.TunnelAdd:
+		if u.Tunnel == nil {
+			return nil, fmt.Errorf("missing tunnel %s", u.Name)
+		}
+		rt, err := s.openTunnel(u.Name, u.Tunnel, identifier)
+		if err != nil {
+			return nil, err
+		}
+		err = s.cluster.checkTunnel(rt, u.Tunnel.Addr)
+		if err != nil {
+			err = fmt.Errorf("unable to open tunnel %s: %s", u.Name, err)
+		} else {
+			err = s.add(identifier, u.Name, rt)
+		}
+		if err != nil {
+			if rt.listener != nil {
+				rt.listener.Close()
+			}
+			return nil, err
+		}
+		s.cluster.changed()
+		if rt.listener != nil && rt.pool == "" {
+			go s.listen(rt.listener, identifier, u.Name, "")
+		}
+		return rt.tunnel, nil
+	case proto.TunnelRemove:
+		rt, err := s.remove(identifier, u.Name)
+		if err != nil {
+			return nil, err
+		}
+		if rt.listener != nil {
+			s.logger.Log(
+				"level", 2,
+				"action", "close listener",
+				"identifier", identifier,
+				"addr", rt.listener.Addr(),
+			)
+			rt.listener.Close()
+		}
+		s.cluster.changed()
+		s.deleteTunnelMetrics(&RegistryItem{tunnels: map[string]*registryTunnel{u.Name: rt}})
+	default:
+		return nil, fmt.Errorf("unknown tunnel update action %q", u.Action)
+	}
+
+	return nil, nil
+}
+
+// Subscribe allows to connect client with a given identifier, the
+// subscription is written to SubscriptionStore. Metadata of already subscribed
+// client is kept.
+func (s *Server) Subscribe(identifier id.ID) {
+	if _, ok := s.Subscription(identifier); ok {
+		s.registry.Subscribe(identifier)
+		return
+	}
+	if err := s.AddSubscription(&Subscription{ID: identifier}); err != nil {
+		s.logger.Log(
+			"level", 0,
+			"msg", "storing subscription failed",
+			"identifier", identifier,
+			"err", err,
+		)
+	}
+}
+
+// AddSubscription subscribes client with metadata or updates metadata of a
+// subscribed client, the subscription is written to SubscriptionStore. If
+// Created is zero it's set to the time client was subscribed.
+func (s *Server) AddSubscription(sub *Subscription) error {
+	v := *sub
+
+	s.subsMu.Lock()
+	if v.Created.IsZero() {
+		if old, ok := s.subs[v.ID]; ok {
+			v.Created = old.Created
+		} else {
+			v.Created = time.Now().UTC()
+		}
+	}
+	s.subs[v.ID] = &v
+	s.subsMu.Unlock()
+
+	s.registry.Subscribe(v.ID)
+
+	if s.config.SubscriptionStore == nil {
+		return nil
+	}
+	return s.config.SubscriptionStore.Put(&v)
+}
+
+// Subscription returns subscription of client, it returns false if client
+// was not subscribed with Subscribe or AddSubscription or loaded from
+// SubscriptionStore.
+func (s *Server) Subscription(identifier id.ID) (*Subscription, bool) {
+	s.subsMu.RLock()
+	defer s.subsMu.RUnlock()
+
+	sub, ok := s.subs[identifier]
+	if !ok {
+		return nil, false
+	}
+	v := *sub
+	return &v, true
+}
+
+// syncSubscriptions subscribes clients from store and unsubscribes clients
+// removed from store.
+func (s *Server) syncSubscriptions(subs []*Subscription) {
+	m := make(map[id.ID]*Subscription, len(subs))
+	for _, sub := range subs {
+		m[sub.ID] = sub
+	}
+
+	s.subsMu.Lock()
+	old := s.subs
+	s.subs = m
+	s.subsMu.Unlock()
+
+	for _, sub := range subs {
+		s.registry.Subscribe(sub.ID)
+	}
+	for identifier := range old {
+		if _, ok := m[identifier]; !ok {
+			s.unsubscribe(identifier)
+		}
+	}
+
+	s.logger.Log(
+		"level", 2,
+		"action", "sync subscriptions",
+		"count", len(subs),
+	)
+}
+
+// Unsubscribe removes client from registry, disconnects client if already
+// connected and returns it's RegistryItem. The subscription is removed from
+// SubscriptionStore.
+func (s *Server) Unsubscribe(identifier id.ID) *RegistryItem {
+	s.subsMu.Lock()
+	delete(s.subs, identifier)
+	s.subsMu.Unlock()
+
+	if s.config.SubscriptionStore != nil {
+		if err := s.config.SubscriptionStore.Delete(identifier); err != nil {
+			s.logger.Log(
+				"level", 0,
+				"msg", "removing subscription failed",
+				"identifier", identifier,
+				"err", err,
+			)
+		}
+	}
+
+	return s.unsubscribe(identifier)
+}
+
+func (s *Server) unsubscribe(identifier id.ID) *RegistryItem {
+	if s.config.SubscriptionListener != nil {
+		s.config.SubscriptionListener.Unsubscribed(identifier)
+	}
+	s.connPool.DeleteConn(identifier)
+	i := s.registry.Unsubscribe(identifier)
+	s.cluster.changed()
+	s.deleteTunnelMetrics(i)
+	return i
+}
+
+// checkHost returns error if client subscription does not allow host.
+func (s *Server) checkHost(host string, identifier id.ID) error {
+	s.subsMu.RLock()
+	sub := s.subs[identifier]
+	s.subsMu.RUnlock()
+
+	if !sub.allowsHost(host) {
+		return fmt.Errorf("host %s is not allowed", host)
+	}
+	return nil
+}
+
+// Ping measures the RTT response time.
+func (s *Server) Ping(identifier id.ID) (time.Duration, error) {
+	d, err := s.connPool.Ping(identifier)
+	if err == nil {
+		s.metrics.pingDuration.Observe(d.Seconds())
+	}
+	return d, err
+}
+
+// IsConnected returns true if client has an active control connection.
+func (s *Server) IsConnected(identifier id.ID) bool {
+	return s.connPool.Connected(identifier)
+}
+
+// Disconnect closes control connection of the client, the client stays
+// subscribed and may connect again.
+func (s *Server) Disconnect(identifier id.ID) error {
+	if !s.connPool.Connected(identifier) {
+		return errClientNotConnected
+	}
+
+	s.logger.Log(
+		"level", 1,
+		"action", "disconnect",
+		"identifier", identifier,
+	)
+
+	s.connPool.DeleteConn(identifier)
+	return nil
+}
+
+// listen accepts connections from l and proxies them to the client serving
+// tunnel name, if pool is set the client is selected from the pool of a shared
+// listener.
+func (s *Server) listen(l net.Listener, identifier id.ID, name, pool string) {
+	addr := l.Addr().String()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if strings.Contains(err.Error(), "use of closed network connection") ||
+				strings.Contains(err.Error(), "Listener closed") {
+				s.logger.Log(
+					"level", 2,
+					"action", "listener closed",
+					"identifier", identifier,
+					"addr", addr,
+				)
+				return
+			}
+
+			s.logger.Log(
+				"level", 0,
+				"msg", "accept of connection failed",
+				"identifier", identifier,
+				"addr", addr,
+				"err", err,
+			)
+			continue
+		}
+
+		if s.ctx.Err() != nil {
+			s.logger.Log(
+				"level", 2,
+				"msg", "server shutting down",
+				"identifier", identifier,
+				"addr", addr,
+			)
+			conn.Close()
+			continue
+		}
+
+		msg := &proto.ControlMessage{
+			Action:         proto.ActionProxy,
+			ForwardedProto: l.Addr().Network(),
+			RemoteAddr:     conn.RemoteAddr().String(),
+			LocalAddr:      conn.LocalAddr().String(),
+			TunnelName:     name,
+		}
+
+		tlsConn, ok := conn.(*vhost.TLSConn)
+		if ok {
+			msg.ForwardedHost = tlsConn.Host()
+			if vl, ok := l.(*vhost.Listener); ok {
+				msg.TunnelHost = vl.Name()
+			}
+			err = keepAlive(tlsConn.Conn)
+
+		} else if _, ok := conn.(*udpSession); ok {
+			msg.ForwardedHost = l.Addr().String()
+		} else {
+			msg.ForwardedHost = l.Addr().String()
+			err = keepAlive(conn)
+		}
+
+		if err != nil {
+			s.logger.Log(
+				"level", 1,
+				"msg", "TCP keepalive for tunneled connection failed",
+				"identifier", identifier,
+				"ctrlMsg", msg,
+				"err", err,
+			)
+		}
+
+		s.handleConn(conn, msg, identifier, pool)
+	}
+}
+
+// handleConn proxies conn accepted for tunnel msg.TunnelName of client
+// identifier, or a member of pool if set, in background.
+func (s *Server) handleConn(conn net.Conn, msg *proto.ControlMessage, identifier id.ID, pool string) {
+	if pool != "" {
+		var ok bool
+		if identifier, msg.TunnelName, ok = s.matchListener(pool); !ok {
+			s.logger.Log(
+				"level", 1,
+				"msg", "no client in pool",
+				"addr", msg.ForwardedHost,
+			)
+			conn.Close()
+			return
+		}
+	}
+
+	if !s.access.allowed(s.tunnelFilter(identifier, msg.TunnelName), addrIP(conn.RemoteAddr())) {
+		s.logger.Log(
+			"level", 1,
+			"msg", "connection forbidden",
+			"identifier", identifier,
+			"addr", msg.ForwardedHost,
+			"remoteAddr", conn.RemoteAddr(),
+		)
+		conn.Close()
+		return
+	}
+
+	go func() {
+		if err := s.proxyConn(identifier, conn, msg); err != nil {
+			s.logger.Log(
+				"level", 0,
+				"msg", "proxy error",
+				"identifier", identifier,
+				"ctrlMsg", msg,
+				"err", err,
+			)
+		}
+	}()
+}
+
+func (s *Server) Upgrade(identifier id.ID, conn net.Conn, requestBytes []byte) error {
+
+	var err error
+
+	msg := &proto.ControlMessage{
+		Action:         proto.ActionProxy,
+		ForwardedProto: "https",
+		RemoteAddr:     conn.RemoteAddr().String(),
+		LocalAddr:      conn.LocalAddr().String(),
+	}
+
+	tlsConn, ok := conn.(*tls.Conn)
+	if ok {
+		msg.ForwardedHost = tlsConn.ConnectionState().ServerName
+		err = keepAlive(tlsConn.NetConn())
+
+	} else {
+		msg.ForwardedHost = conn.RemoteAddr().String()
+		err = keepAlive(conn)
+	}
+
+	if err != nil {
+		s.logger.Log(
+			"level", 1,
+			"msg", "TCP keepalive for tunneled connection failed",
+			"identifier", identifier,
+			"ctrlMsg", msg,
+			"err", err,
+		)
+	}
+
+	go func() {
+		if err := s.proxyConnUpgraded(identifier, conn, msg, requestBytes); err != nil {
+			s.logger.Log(
+				"level", 0,
+				"msg", "proxy error",
+				"identifier", identifier,
+				"ctrlMsg", msg,
+				"err", err,
+			)
+		}
+	}()
+
+	return nil
+}
+
+// ServeHTTP proxies http connection to the client.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	stripClusterHeaders(r.Header)
+	s.serveHTTP(w, r, false)
+}
+
+// serveHTTP proxies request to the client, requests for hosts of other
+// cluster nodes are forwarded to them unless r was forwarded by a node.
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request, forwarded bool) {
+	var (
+		start      = time.Now()
+		identifier id.ID
+		status     int
+		n          int64
+	)
+
+	if s.config.AccessLog != nil {
+		body := &countingReadCloser{ReadCloser: r.Body}
+		r.Body = body
+		defer func() {
+			user, _, _ := r.BasicAuth()
+			s.logAccess(&AccessLogEntry{
+				Time:       start,
+				Protocol:   proto.HTTP,
+				Client:     identifier,
+				RemoteAddr: r.RemoteAddr,
+				Host:       r.Host,
+				Method:     r.Method,
+				Path:       r.URL.RequestURI(),
+				Proto:      r.Proto,
+				Status:     status,
+				User:       user,
+				Referer:    r.Referer(),
+				UserAgent:  r.UserAgent(),
+				BytesIn:    body.count(),
+				BytesOut:   n,
+				Duration:   time.Since(start),
+			})
+		}()
+	}
+
+	resp, identifier, err := s.roundTrip(r)
+	if err == errClientNotSubscribed && !forwarded {
+		if node := s.cluster.lookup(r.Host, cleanRequestPath(r.URL.Path)); node != nil {
+			sw := &statusWriter{ResponseWriter: w}
+			s.cluster.forward(sw, r, node, func(w http.ResponseWriter, r *http.Request, err error) {
+				s.logger.Log(
+					"level", 0,
+					"action", "cluster forward failed",
+					"host", r.Host,
+					"node", node.ID,
+					"err", err,
+				)
+				s.writeError(w, r, ErrorClientOffline)
+			})
+			status, n = sw.status, sw.n
+			return
+		}
+	}
+	if err == errUnauthorised {
+		w.Header().Set("WWW-Authenticate", "Basic realm=\"User Visible Realm\"")
+		status = s.writeError(w, r, ErrorAuthRequired)
+		return
+	}
+	if err == errInvalidToken {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		status = s.writeError(w, r, ErrorAuthRequired)
+		return
+	}
+	if err == errForbidden {
+		status = s.writeError(w, r, ErrorForbidden)
+		return
+	}
+	if err != nil {
+		s.logger.Log(
+			"level", 0,
+			"action", "round trip failed",
+			"addr", r.RemoteAddr,
+			"host", r.Host,
+			"url", r.URL,
+			"err", err,
+		)
+
+		status = s.writeError(w, r, errorClass(err))
+		return
+	}
+	defer resp.Body.Close()
+
+	if e := resp.Header.Get(proto.HeaderProxyError); e != "" {
+		s.logger.Log(
+			"level", 1,
+			"action", "backend failed",
+			"identifier", identifier,
+			"host", r.Host,
+			"url", r.URL,
+			"err", e,
+		)
+
+		class := ErrorBackendUnreachable
+		if resp.StatusCode == http.StatusGatewayTimeout {
+			class = ErrorTimeout
+		}
+		status = s.writeError(w, r, class)
+		return
+	}
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			s.logger.Log(
+				"level", 1,
+				"msg", "connection can not be hijacked",
+				"identifier", identifier,
+				"host", r.Host,
+				"proto", r.Proto,
+			)
+			status = s.writeError(w, r, ErrorBackendUnreachable)
+			return
+		}
+		status = resp.StatusCode
+		n = s.switchProtocols(hj, r, resp)
+		return
+	}
+
+	status = resp.StatusCode
+	copyHeader(w.Header(), resp.Header)
+	w.WriteHeader(resp.StatusCode)
+
+	var dst io.Writer = w
+	if d := s.flushInterval(resp); d < 0 {
+		// streamed responses must not wait in buffers, send headers so
+		// that the user knows the stream is open
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		dst = flushWriter{w}
+	} else if d > 0 {
+		lw := newLatencyWriter(w, d)
+		defer lw.stop()
+		dst = lw
+	}
+
+	n = transfer(dst, resp.Body, log.NewContext(s.logger).With(
+		"dir", "client to user",
+		"dst", r.RemoteAddr,
+		"src", r.Host,
+	))
+
+	// trailers are known once the body is read i.e. gRPC status
+	for k, vv := range resp.Trailer {
+		if len(vv) > 0 {
+			w.Header()[http.TrailerPrefix+k] = vv
+		}
+	}
+}
+
+// ClusterHandler returns handler of requests and streams forwarded by other
+// cluster nodes, it must be served on ClusterConfig.Addr over TLS with
+// HTTP/1.1. Requests without valid cluster secret are rejected.
+func (s *Server) ClusterHandler() http.Handler {
+	return http.HandlerFunc(s.serveCluster)
+}
+
+func (s *Server) serveCluster(w http.ResponseWriter, r *http.Request) {
+	network, target, ok := s.cluster.accept(r)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	if network == "" {
+		s.serveHTTP(w, r, true)
+		return
+	}
+	s.serveClusterStream(w, r, network, target)
+}
+
+// serveClusterStream takes over connection of stream forwarded by other node
+// and proxies it to the client owning target.
+func (s *Server) serveClusterStream(w http.ResponseWriter, r *http.Request, network, target string) {
+	if upgradeType(r.Header) != clusterUpgrade {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	identifier, name, t, ok := s.registry.clusterTarget(network, target)
+	if !ok {
+		s.logger.Log(
+			"level", 1,
+			"msg", "no tunnel for cluster stream",
+			"network", network,
+			"target", target,
+		)
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		s.logger.Log(
+			"level", 0,
+			"msg", "hijack of cluster stream failed",
+			"err", err,
+		)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	if _, err := io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: "+clusterUpgrade+"\r\n\r\n"); err != nil {
+		conn.Close()
+		return
+	}
+
+	c := &clusterConn{
+		Conn:   conn,
+		r:      brw.Reader,
+		remote: clusterRemoteAddr(network, r.RemoteAddr, conn.RemoteAddr()),
+	}
+	msg := &proto.ControlMessage{
+		Action:         proto.ActionProxy,
+		ForwardedProto: t.listener.Addr().Network(),
+		ForwardedHost:  t.listener.Addr().String(),
+		RemoteAddr:     r.RemoteAddr,
+		LocalAddr:      t.listener.Addr().String(),
+		TunnelName:     name,
+	}
+	if network == proto.SNI {
+		msg.ForwardedHost = target
+		msg.TunnelHost = t.sni
+	}
+
+	s.logger.Log(
+		"level", 2,
+		"action", "cluster stream",
+		"identifier", identifier,
+		"network", network,
+		"target", target,
+	)
+
+	s.handleConn(c, msg, identifier, t.pool)
+}
+
+// syncMirrors opens listeners on ports of TCP and UDP tunnels of other
+// cluster nodes and closes listeners on ports they no longer use, connections
+// accepted by them are streamed to the nodes.
+func (s *Server) syncMirrors() {
+	want := make(map[string]bool)
+	for _, l := range s.cluster.listeners() {
+		if port := listenerPort(l.Addr); port != "" {
+			want[listenerNetwork(l.Protocol)+"/"+port] = true
+		}
+	}
+
+	s.mirrorsMu.Lock()
+	defer s.mirrorsMu.Unlock()
+
+	if s.ctx.Err() != nil {
+		return
+	}
+
+	for k, l := range s.mirrors {
+		if !want[k] {
+			l.Close()
+			delete(s.mirrors, k)
+		}
+	}
+	for k := range want {
+		if _, ok := s.mirrors[k]; ok {
+			continue
+		}
+		network, port := k[:strings.Index(k, "/")], k[strings.Index(k, "/")+1:]
+		l, err := s.listenMirror(network, port)
+		if err != nil {
+			// port may be used by a local tunnel i.e. pool, retried
+			// on next sync
+			s.logger.Log(
+				"level", 2,
+				"msg", "unable to listen on port of cluster node",
+				"network", network,
+				"port", port,
+				"err", err,
+			)
+			continue
+		}
+
+		s.logger.Log(
+			"level", 2,
+			"action", "open cluster listener",
+			"addr", l.Addr(),
+		)
+
+		s.mirrors[k] = l
+		go s.serveMirror(l, network, port)
+	}
+}
+
+// listenMirror opens listener of network on port according to ListenPolicy.
+func (s *Server) listenMirror(network, port string) (net.Listener, error) {
+	if network == proto.UDP {
+		pc, err := s.listenPacketTunnel(network, ":"+port)
+		if err != nil {
+			return nil, err
+		}
+		return newUDPListener(pc, DefaultUDPIdleTimeout), nil
+	}
+	return s.listenTunnel(network, ":"+port)
+}
+
+// serveMirror streams connections accepted from l to node owning the port.
+func (s *Server) serveMirror(l net.Listener, network, port string) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if strings.Contains(err.Error(), "use of closed network connection") ||
+				strings.Contains(err.Error(), "Listener closed") {
+				return
+			}
 
-	go func() {
-		if err := s.proxyConnUpgraded(identifier, conn, msg, requestBytes); err != nil {
 			s.logger.Log(
 				"level", 0,
-				"msg", "proxy error",
-				"identifier", identifier,
-				"ctrlMsg", msg,
+				"msg", "accept of connection failed",
+				"addr", l.Addr(),
 				"err", err,
 			)
+			continue
 		}
-	}()
 
-	return nil
+		node := s.cluster.lookupListener(network, port)
+		if node == nil {
+			conn.Close()
+			continue
+		}
+		go s.cluster.stream(conn, node, network, port)
+	}
 }
 
-// ServeHTTP proxies http connection to the client.
-func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	resp, err := s.RoundTrip(r)
-	if err == errUnauthorised {
-		w.Header().Set("WWW-Authenticate", "Basic realm=\"User Visible Realm\"")
-		http.Error(w, err.Error(), http.StatusUnauthorized)
-		return
+// releaseMirror closes listener on port of addr opened for other nodes so
+// that a local pool member can share the port.
+func (s *Server) releaseMirror(network, addr string) {
+	s.mirrorsMu.Lock()
+	defer s.mirrorsMu.Unlock()
+
+	k := listenerNetwork(network) + "/" + listenerPort(addr)
+	if l, ok := s.mirrors[k]; ok {
+		l.Close()
+		delete(s.mirrors, k)
+	}
+}
+
+// closeMirrors closes all listeners opened for other nodes.
+func (s *Server) closeMirrors() {
+	s.mirrorsMu.Lock()
+	defer s.mirrorsMu.Unlock()
+
+	for k, l := range s.mirrors {
+		l.Close()
+		delete(s.mirrors, k)
+	}
+}
+
+// flushInterval returns flush interval of response body, it's negative for
+// streamed responses.
+func (s *Server) flushInterval(resp *http.Response) time.Duration {
+	if ct, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); ct == "text/event-stream" {
+		return -1
+	}
+	// chunked by the backend, i.e. long-polling or gRPC
+	if resp.ContentLength == -1 {
+		return -1
+	}
+	return s.config.FlushInterval
+}
+
+// switchProtocols hijacks connection of the user, writes the switching
+// protocols response and streams data in both directions until either side
+// closes. It returns number of bytes sent to the user.
+func (s *Server) switchProtocols(hj http.Hijacker, r *http.Request, resp *http.Response) int64 {
+	body, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		s.logger.Log(
+			"level", 0,
+			"msg", "switching protocols response body is not writable",
+			"host", r.Host,
+		)
+		return 0
 	}
+
+	conn, brw, err := hj.Hijack()
 	if err != nil {
 		s.logger.Log(
 			"level", 0,
-			"action", "round trip failed",
-			"addr", r.RemoteAddr,
+			"msg", "hijack failed",
 			"host", r.Host,
-			"url", r.URL,
 			"err", err,
 		)
+		return 0
+	}
+	defer conn.Close()
 
-		http.Error(w, err.Error(), http.StatusBadGateway)
-		return
+	fmt.Fprintf(brw, "HTTP/1.1 %s\r\n", resp.Status)
+	resp.Header.Write(brw)
+	brw.WriteString("\r\n")
+	if err := brw.Flush(); err != nil {
+		s.logger.Log(
+			"level", 1,
+			"msg", "write switching protocols response failed",
+			"host", r.Host,
+			"err", err,
+		)
+		return 0
 	}
-	defer resp.Body.Close()
 
-	copyHeader(w.Header(), resp.Header)
-	w.WriteHeader(resp.StatusCode)
+	done := make(chan struct{})
+	go func() {
+		transfer(body, brw.Reader, log.NewContext(s.logger).With(
+			"dir", "user to client",
+			"dst", r.Host,
+			"src", r.RemoteAddr,
+		))
+		body.Close()
+		close(done)
+	}()
 
-	transfer(w, resp.Body, log.NewContext(s.logger).With(
+	n := transfer(conn, body, log.NewContext(s.logger).With(
 		"dir", "client to user",
 		"dst", r.RemoteAddr,
 		"src", r.Host,
 	))
+	conn.Close()
+	<-done
+
+	return n
+}
+
+// writeError writes error page of error class and returns the status code.
+func (s *Server) writeError(w http.ResponseWriter, r *http.Request, class string) int {
+	status, err := s.config.ErrorPages.writeError(w, r, class)
+	if err != nil {
+		s.logger.Log(
+			"level", 0,
+			"msg", "error page template failed",
+			"class", class,
+			"host", r.Host,
+			"err", err,
+		)
+	}
+	return status
 }
 
 // RoundTrip is http.RoundTriper implementation.
 func (s *Server) RoundTrip(r *http.Request) (*http.Response, error) {
-	identifier, auth, ok := s.Subscriber(r.Host)
+	resp, _, err := s.roundTrip(r)
+	return resp, err
+}
+
+// roundTrip is RoundTrip that also returns identifier of the client the
+// request was routed to.
+func (s *Server) roundTrip(r *http.Request) (*http.Response, id.ID, error) {
+	p := cleanRequestPath(r.URL.Path)
+	h, tunnelHost, ok := s.match(r.Host, p)
 	if !ok {
-		return nil, errClientNotSubscribed
+		return nil, id.ID{}, errClientNotSubscribed
+	}
+	identifier, auth := h.identifier, h.auth
+
+	if !s.access.allowed(h.filter, s.access.clientIP(r)) {
+		return nil, identifier, errForbidden
 	}
 
 	outr := r.WithContext(r.Context())
@@ -683,15 +2025,29 @@ func (s *Server) RoundTrip(r *http.Request) (*http.Response, error) {
 		outr.Body = nil // Issue 16036: nil Body for http.Transport retries
 	}
 	outr.Header = cloneHeader(r.Header)
+	u := *r.URL
+	outr.URL = &u
+	if p != r.URL.Path {
+		outr.URL.Path = p
+		outr.URL.RawPath = ""
+	}
 
 	if auth != nil {
 		user, password, _ := r.BasicAuth()
-		if auth.User != user || auth.Password != password {
-			return nil, errUnauthorised
+		if !auth.Verify(user, password) {
+			return nil, identifier, errUnauthorised
 		}
 		outr.Header.Del("Authorization")
 	}
 
+	if h.jwt || s.jwt.protects(r.Host) {
+		claims, err := s.jwt.authenticate(r, r.Host)
+		if err != nil {
+			return nil, identifier, err
+		}
+		s.jwt.forward(outr.Header, claims)
+	}
+
 	setXForwardedFor(outr.Header, r.RemoteAddr)
 
 	scheme := r.URL.Scheme
@@ -707,13 +2063,77 @@ func (s *Server) RoundTrip(r *http.Request) (*http.Response, error) {
 		outr.Header.Set("X-Forwarded-Proto", scheme)
 	}
 
+	if h.strip && h.prefix != "" {
+		outr.URL.Path = "/" + strings.TrimLeft(strings.TrimPrefix(p, h.prefix), "/")
+		outr.URL.RawPath = ""
+		outr.Header.Set("X-Forwarded-Prefix", h.prefix)
+	}
+
+	var vars *strings.Replacer
+	serverRules := s.headerRules(r.Host)
+	if len(h.reqRules) > 0 || len(h.respRules) > 0 || len(serverRules) > 0 {
+		var remoteAddr string
+		if ip := s.access.clientIP(r); ip != nil {
+			remoteAddr = ip.String()
+		}
+		vars = headerVars(remoteAddr, identifier.String(), r.Host)
+	}
+	rewriteHeaders(outr.Header, h.reqRules, vars)
+	for _, rules := range serverRules {
+		rewriteHeaders(outr.Header, rules.Request, vars)
+	}
+
 	msg := &proto.ControlMessage{
 		Action:         proto.ActionProxy,
 		ForwardedHost:  r.Host,
 		ForwardedProto: scheme,
+		TunnelHost:     tunnelHost,
+		PathPrefix:     h.prefix,
+		TunnelName:     h.name,
+	}
+
+	var (
+		resp *http.Response
+		err  error
+	)
+	if h.http2 && r.Method != http.MethodConnect && upgradeType(r.Header) == "" {
+		msg.Action = proto.ActionProxyHTTP2
+		resp, err = s.proxyHTTP2(identifier, outr, msg)
+	} else {
+		resp, err = s.proxyHTTP(identifier, outr, msg)
+	}
+	if err == nil {
+		rewriteHeaders(resp.Header, h.respRules, vars)
+		for _, rules := range serverRules {
+			rewriteHeaders(resp.Header, rules.Response, vars)
+		}
+	}
+	return resp, identifier, err
+}
+
+// headerRules returns server header rules of host.
+func (s *Server) headerRules(host string) []*HeaderRules {
+	var v []*HeaderRules
+	for _, rules := range s.config.HeaderRules {
+		if rules.Host == "" || matchHost(rules.Host, host) {
+			v = append(v, rules)
+		}
 	}
+	return v
+}
 
-	return s.proxyHTTP(identifier, outr, msg)
+// logAccess writes entry to access log if configured.
+func (s *Server) logAccess(e *AccessLogEntry) {
+	if s.config.AccessLog == nil {
+		return
+	}
+	if err := s.config.AccessLog.Log(e); err != nil {
+		s.logger.Log(
+			"level", 0,
+			"msg", "access log write failed",
+			"err", err,
+		)
+	}
 }
 
 func (s *Server) proxyConnUpgraded(identifier id.ID, conn net.Conn, msg *proto.ControlMessage, requestBytes []byte) error {
@@ -794,6 +2214,37 @@ func (s *Server) proxyConn(identifier id.ID, conn net.Conn, msg *proto.ControlMe
 
 	defer conn.Close()
 
+	s.balancer.acquire(identifier)
+	defer s.balancer.release(identifier)
+
+	// series are kept so that updates of streams outliving the tunnel do
+	// not recreate deleted series
+	var (
+		streams  = s.metrics.streams.With(tunnelLabel(msg), msg.ForwardedProto)
+		bytesIn  = s.metrics.bytes.With(tunnelLabel(msg), dirIn)
+		bytesOut = s.metrics.bytes.With(tunnelLabel(msg), dirOut)
+	)
+	streams.Inc()
+	defer streams.Dec()
+
+	var (
+		start = time.Now()
+		in    int64
+		out   int64
+	)
+	defer func() {
+		s.logAccess(&AccessLogEntry{
+			Time:       start,
+			Protocol:   accessLogProtocol(msg),
+			Client:     identifier,
+			RemoteAddr: conn.RemoteAddr().String(),
+			Host:       msg.ForwardedHost,
+			BytesIn:    atomic.LoadInt64(&in),
+			BytesOut:   out,
+			Duration:   time.Since(start),
+		})
+	}()
+
 	pr, pw := io.Pipe()
 	defer pr.Close()
 	defer pw.Close()
@@ -808,11 +2259,14 @@ func (s *Server) proxyConn(identifier id.ID, conn net.Conn, msg *proto.ControlMe
 
 	done := make(chan struct{})
 	go func() {
-		transfer(pw, conn, log.NewContext(s.logger).With(
+		n := transfer(pw, conn, log.NewContext(s.logger).With(
 			"dir", "user to client",
 			"dst", identifier,
 			"src", conn.RemoteAddr(),
 		))
+		bytesIn.Add(float64(n))
+		atomic.StoreInt64(&in, n)
+		pw.Close()
 		cancel()
 		close(done)
 	}()
@@ -823,11 +2277,12 @@ func (s *Server) proxyConn(identifier id.ID, conn net.Conn, msg *proto.ControlMe
 	}
 	defer resp.Body.Close()
 
-	transfer(conn, resp.Body, log.NewContext(s.logger).With(
+	out = transfer(conn, resp.Body, log.NewContext(s.logger).With(
 		"dir", "client to user",
 		"dst", conn.RemoteAddr(),
 		"src", identifier,
 	))
+	bytesOut.Add(float64(out))
 
 	select {
 	case <-done:
@@ -852,18 +2307,25 @@ func (s *Server) proxyHTTP(identifier id.ID, r *http.Request, msg *proto.Control
 		"ctrlMsg", msg,
 	)
 
+	// Pipe is closed by the writer, closing it on return would reset the
+	// stream and break reading the response body. Upgrade requests keep the
+	// pipe open, user data follows the request once protocol is switched.
 	pr, pw := io.Pipe()
-	defer pr.Close()
-	defer pw.Close()
+	upgrade := upgradeType(r.Header) != ""
 
 	req, err := s.connectRequest(identifier, msg, pr)
 	if err != nil {
+		pw.Close()
 		return nil, fmt.Errorf("proxy request error: %s", err)
 	}
 
 	go func() {
 		cw := &countWriter{pw, 0}
 		err := r.Write(cw)
+		if err != nil || !upgrade {
+			pw.CloseWithError(err)
+		}
+		s.metrics.bytes.With(tunnelLabel(msg), dirIn).Add(float64(cw.count))
 		if err != nil {
 			s.logger.Log(
 				"level", 0,
@@ -889,9 +2351,16 @@ func (s *Server) proxyHTTP(identifier id.ID, r *http.Request, msg *proto.Control
 		}
 	}()
 
-	resp, err := s.httpClient.Do(req)
+	resp, err := s.sendHTTP(identifier, req, msg)
 	if err != nil {
-		return nil, fmt.Errorf("io error: %s", err)
+		pr.Close()
+		return nil, err
+	}
+
+	if upgrade {
+		if resp, err = s.upgradeResponse(r, resp, pw, tunnelLabel(msg)); err != nil {
+			return nil, err
+		}
 	}
 
 	s.logger.Log(
@@ -905,6 +2374,120 @@ func (s *Server) proxyHTTP(identifier id.ID, r *http.Request, msg *proto.Control
 	return resp, nil
 }
 
+// proxyHTTP2 passes r to client as HTTP/2 request, unlike proxyHTTP request
+// and response bodies are streamed independently and trailers are preserved.
+func (s *Server) proxyHTTP2(identifier id.ID, r *http.Request, msg *proto.ControlMessage) (*http.Response, error) {
+	s.logger.Log(
+		"level", 2,
+		"action", "proxy HTTP/2",
+		"identifier", identifier,
+		"ctrlMsg", msg,
+	)
+
+	req, err := http.NewRequest(r.Method, s.connPool.URL(identifier)+r.URL.RequestURI(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("proxy request error: %s", err)
+	}
+	req = req.WithContext(r.Context())
+
+	req.Header = cloneHeader(r.Header)
+	removeHopHeaders(req.Header)
+	proto.DeleteFromHeader(req.Header)
+	msg.WriteToHeader(req.Header)
+	req.Trailer = r.Trailer
+
+	if r.Body != nil {
+		tunnel := tunnelLabel(msg)
+		req.ContentLength = r.ContentLength
+		req.Body = &doneReader{ReadCloser: r.Body, done: func(n int64) {
+			s.metrics.bytes.With(tunnel, dirIn).Add(float64(n))
+		}}
+	}
+
+	resp, err := s.sendHTTP(identifier, req, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	s.logger.Log(
+		"level", 2,
+		"action", "proxy HTTP/2 done",
+		"identifier", identifier,
+		"ctrlMsg", msg,
+		"status code", resp.StatusCode,
+	)
+
+	return resp, nil
+}
+
+// sendHTTP sends request of HTTP tunnel stream to client, the stream is
+// accounted until the response body is closed.
+func (s *Server) sendHTTP(identifier id.ID, req *http.Request, msg *proto.ControlMessage) (*http.Response, error) {
+	tunnel := tunnelLabel(msg)
+	s.balancer.acquire(identifier)
+	s.metrics.streams.With(tunnel, proto.HTTP).Inc()
+	done := func(n int64) {
+		s.metrics.bytes.With(tunnel, dirOut).Add(float64(n))
+		s.metrics.streams.With(tunnel, proto.HTTP).Dec()
+		s.balancer.release(identifier)
+	}
+
+	start := time.Now()
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		done(0)
+		if e, ok := err.(*url.Error); ok && e.Err == errClientNotConnected {
+			return nil, errClientNotConnected
+		}
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			return nil, err
+		}
+		return nil, fmt.Errorf("io error: %s", err)
+	}
+	s.metrics.httpDuration.With(strconv.Itoa(resp.StatusCode)).Observe(time.Since(start).Seconds())
+	resp.Body = &doneReader{ReadCloser: resp.Body, done: done}
+
+	return resp, nil
+}
+
+// upgradeResponse reads response of the backend to upgrade request r, client
+// relays it as raw bytes in body of resp. If the backend switched protocols
+// body of the returned response is io.ReadWriteCloser, writes go to the
+// backend through pw.
+func (s *Server) upgradeResponse(r *http.Request, resp *http.Response, pw *io.PipeWriter, tunnel string) (*http.Response, error) {
+	if resp.StatusCode != http.StatusOK || resp.Header.Get(proto.HeaderProxyError) != "" {
+		pw.Close()
+		return resp, nil
+	}
+
+	br := bufio.NewReader(resp.Body)
+	bresp, err := http.ReadResponse(br, r)
+	if err != nil {
+		pw.Close()
+		resp.Body.Close()
+		return nil, fmt.Errorf("invalid upgrade response: %s", err)
+	}
+
+	if bresp.StatusCode != http.StatusSwitchingProtocols {
+		pw.Close()
+		bresp.Body = &readCloser{Reader: bresp.Body, Closer: resp.Body}
+		return bresp, nil
+	}
+
+	cw := &countWriter{pw, 0}
+	bresp.Body = &upgradeBody{
+		Reader: br,
+		Writer: cw,
+		close: func() error {
+			pw.Close()
+			s.metrics.bytes.With(tunnel, dirIn).Add(float64(cw.count))
+			return resp.Body.Close()
+		},
+	}
+
+	return bresp, nil
+}
+
 // connectRequest creates HTTP request to client with a given identifier having
 // control message and data input stream, output data stream results from
 // response the created request.
@@ -926,14 +2509,65 @@ func (s *Server) Addr() string {
 	return s.listener.Addr().String()
 }
 
-// Stop closes the server.
+// Stop closes the server and all client connections immediately, in-flight
+// requests and streams are aborted. See Shutdown for graceful stop.
 func (s *Server) Stop() {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.Shutdown(ctx)
+}
+
+// Shutdown gracefully stops the server. It closes the control listener,
+// stops accepting connections on tunnel listeners, sends HTTP/2 GOAWAY to
+// clients and waits for in-flight requests and TCP streams to finish. When
+// they are done or ctx is done all client connections and tunnel listeners
+// are closed. It returns ctx error if ctx was done before in-flight streams
+// finished. HTTP server running the Server as handler should be shut down
+// separately.
+func (s *Server) Shutdown(ctx context.Context) error {
 	s.logger.Log(
 		"level", 1,
-		"action", "stop",
+		"action", "shutdown",
 	)
 
+	s.cancel()
 	if s.listener != nil {
 		s.listener.Close()
 	}
+
+	// stop accepting public connections, streams in progress are drained
+	// below
+	for _, i := range s.registry.Subscribers() {
+		for _, l := range i.Listeners {
+			l.Close()
+		}
+	}
+	if s.vhostMuxer != nil {
+		s.vhostMuxer.Close()
+	}
+	s.closeMirrors()
+
+	conns := s.connPool.stop()
+	errs := make(chan error, len(conns))
+	for _, c := range conns {
+		go func(c *http2.ClientConn) {
+			errs <- c.Shutdown(ctx)
+		}(c)
+	}
+
+	var err error
+	for range conns {
+		if e := <-errs; e != nil && e == ctx.Err() {
+			err = e
+		}
+	}
+
+	s.connPool.closeAll()
+
+	s.logger.Log(
+		"level", 1,
+		"action", "stop",
+	)
+
+	return err
 }
@@ -0,0 +1,43 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+)
+
+var (
+	subdomainAdjectives = []string{
+		"amber", "bold", "brave", "bright", "calm", "clever", "cool", "crisp",
+		"eager", "fancy", "fast", "gentle", "happy", "jolly", "keen", "kind",
+		"lively", "lucky", "mellow", "merry", "misty", "noble", "proud", "quick",
+		"quiet", "rapid", "shiny", "silent", "smart", "sunny", "swift", "witty",
+	}
+	subdomainNouns = []string{
+		"badger", "bear", "beaver", "bison", "camel", "cobra", "crane", "eagle",
+		"falcon", "ferret", "fox", "gecko", "heron", "koala", "lemur", "lynx",
+		"marten", "moose", "otter", "owl", "panda", "parrot", "puffin", "raven",
+		"salmon", "seal", "shark", "sloth", "tiger", "turtle", "walrus", "wolf",
+	}
+)
+
+// randomSubdomain returns a random human readable subdomain label in form
+// "adjective-noun-1234".
+func randomSubdomain() (string, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	n := binary.BigEndian.Uint64(b[:])
+
+	adj := subdomainAdjectives[n%uint64(len(subdomainAdjectives))]
+	n /= uint64(len(subdomainAdjectives))
+	noun := subdomainNouns[n%uint64(len(subdomainNouns))]
+	n /= uint64(len(subdomainNouns))
+
+	return fmt.Sprintf("%s-%s-%04d", adj, noun, n%10000), nil
+}
@@ -0,0 +1,230 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+)
+
+// DefaultSubscriptionWatchInterval specifies how often FileSubscriptionStore
+// checks the file for external edits.
+const DefaultSubscriptionWatchInterval = 2 * time.Second
+
+// Subscription holds a client allowed to connect and its metadata.
+type Subscription struct {
+	// ID is the client identifier.
+	ID id.ID `json:"id"`
+	// Name is optional display name of the client.
+	Name string `json:"name,omitempty"`
+	// Hosts specifies hosts the client may open HTTP and SNI tunnels for,
+	// wildcard entries like "*.example.com" match any subdomain. If empty
+	// any host is allowed.
+	Hosts []string `json:"hosts,omitempty"`
+	// Created is the time the client was subscribed.
+	Created time.Time `json:"created"`
+}
+
+// allowsHost returns true if client may open tunnel for host.
+func (s *Subscription) allowsHost(host string) bool {
+	if s == nil || len(s.Hosts) == 0 {
+		return true
+	}
+
+	for _, h := range s.Hosts {
+		if matchHost(h, host) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SubscriptionStore persists subscriptions of a Server.
+type SubscriptionStore interface {
+	// Load returns all stored subscriptions.
+	Load() ([]*Subscription, error)
+	// Put adds or replaces subscription.
+	Put(s *Subscription) error
+	// Delete removes subscription of a client, it's not an error if the
+	// client is not subscribed.
+	Delete(identifier id.ID) error
+	// Watch invokes f with all subscriptions whenever the store is changed
+	// by other process, it blocks until ctx is done.
+	Watch(ctx context.Context, f func([]*Subscription))
+}
+
+// FileSubscriptionStore is SubscriptionStore keeping subscriptions in a JSON
+// file. The file is an array of subscriptions, it's replaced atomically on
+// every change and polled for external edits.
+type FileSubscriptionStore struct {
+	path string
+	// Interval specifies how often the file is checked for external edits,
+	// if zero DefaultSubscriptionWatchInterval is used.
+	Interval time.Duration
+
+	mu   sync.Mutex
+	subs map[id.ID]*Subscription
+	// data is the file content as last read or written.
+	data []byte
+}
+
+// NewFileSubscriptionStore creates a new FileSubscriptionStore for path, the
+// file is created on first change if it does not exist.
+func NewFileSubscriptionStore(path string) (*FileSubscriptionStore, error) {
+	s := &FileSubscriptionStore{
+		path: path,
+		subs: make(map[id.ID]*Subscription),
+	}
+	if _, err := s.read(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Load implements SubscriptionStore.
+func (s *FileSubscriptionStore) Load() ([]*Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.list(), nil
+}
+
+// Put implements SubscriptionStore.
+func (s *FileSubscriptionStore) Put(sub *Subscription) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v := *sub
+	s.subs[sub.ID] = &v
+
+	return s.write()
+}
+
+// Delete implements SubscriptionStore.
+func (s *FileSubscriptionStore) Delete(identifier id.ID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.subs[identifier]; !ok {
+		return nil
+	}
+	delete(s.subs, identifier)
+
+	return s.write()
+}
+
+// Watch implements SubscriptionStore.
+func (s *FileSubscriptionStore) Watch(ctx context.Context, f func([]*Subscription)) {
+	interval := s.Interval
+	if interval == 0 {
+		interval = DefaultSubscriptionWatchInterval
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		s.mu.Lock()
+		changed, err := s.read()
+		subs := s.list()
+		s.mu.Unlock()
+
+		if err == nil && changed {
+			f(subs)
+		}
+	}
+}
+
+// read loads the file if it's content changed, it must be called with mu held.
+func (s *FileSubscriptionStore) read() (bool, error) {
+	b, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		b, err = []byte{}, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if s.data != nil && bytes.Equal(b, s.data) {
+		return false, nil
+	}
+
+	var v []*Subscription
+	if len(bytes.TrimSpace(b)) > 0 {
+		if err := json.Unmarshal(b, &v); err != nil {
+			return false, err
+		}
+	}
+
+	subs := make(map[id.ID]*Subscription, len(v))
+	for _, sub := range v {
+		subs[sub.ID] = sub
+	}
+	s.subs = subs
+	s.data = b
+
+	return true, nil
+}
+
+// write replaces the file, it must be called with mu held.
+func (s *FileSubscriptionStore) write() error {
+	b, err := json.MarshalIndent(s.list(), "", "  ")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	f, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), s.path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	s.data = b
+
+	return nil
+}
+
+// list returns copy of subscriptions sorted by ID, it must be called with mu
+// held.
+func (s *FileSubscriptionStore) list() []*Subscription {
+	v := make([]*Subscription, 0, len(s.subs))
+	for _, sub := range s.subs {
+		c := *sub
+		v = append(v, &c)
+	}
+	sort.Slice(v, func(i, j int) bool {
+		return v[i].ID.String() < v[j].ID.String()
+	})
+
+	return v
+}
@@ -0,0 +1,98 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+func TestFileSubscriptionStore(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "tunnel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "clients.json")
+	newServer := func() *Server {
+		store, err := NewFileSubscriptionStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		store.Interval = 10 * time.Millisecond
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := NewServer(&ServerConfig{
+			Listener:          l,
+			SubscriptionStore: store,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	a := id.New([]byte("a"))
+	b := id.New([]byte("b"))
+
+	s := newServer()
+	if err := s.AddSubscription(&Subscription{ID: a, Name: "a", Hosts: []string{"*.example.com"}}); err != nil {
+		t.Fatal(err)
+	}
+	s.Subscribe(b)
+	s.Subscribe(a)
+	s.Unsubscribe(b)
+	s.Stop()
+
+	// restart
+	s = newServer()
+	defer s.Stop()
+
+	if !s.IsSubscribed(a) || s.IsSubscribed(b) {
+		t.Fatal("unexpected subscriptions")
+	}
+	sub, ok := s.Subscription(a)
+	if !ok || sub.Name != "a" || sub.Created.IsZero() {
+		t.Fatalf("unexpected subscription %+v", sub)
+	}
+
+	// allowed hosts
+	if _, err := s.openTunnel("http", &proto.Tunnel{Protocol: proto.HTTP, Host: "demo.example.com"}, a); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.openTunnel("http", &proto.Tunnel{Protocol: proto.HTTP, Host: "demo.example.org"}, a); err == nil {
+		t.Fatal("expected error")
+	}
+
+	// external edit
+	data := `[{"id": "` + b.String() + `", "name": "b"}]`
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for !s.IsSubscribed(b) || s.IsSubscribed(a) {
+		select {
+		case <-ctx.Done():
+			t.Fatal("external edit not applied")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
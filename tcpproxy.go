@@ -23,9 +23,14 @@ type TCPProxy struct {
 	// * host and port
 	// * port
 	// * host
+	// * tunnel host, the wildcard host connection was matched with
 	localAddrMap map[string]string
 	// logger is the proxy logger.
 	logger log.Logger
+	// ProxyProtocol specifies optional PROXY protocol version, 1 or 2,
+	// the header carrying the end user address is sent to the local server
+	// before the data.
+	ProxyProtocol int
 }
 
 // NewTCPProxy creates new direct TCPProxy, everything will be proxied to
@@ -68,7 +73,7 @@ func (p *TCPProxy) Proxy(w io.Writer, r io.ReadCloser, msg *proto.ControlMessage
 		return
 	}
 
-	target := p.localAddrFor(msg.ForwardedHost)
+	target := p.localAddrFor(msg.ForwardedHost, msg.TunnelHost)
 	if target == "" {
 		p.logger.Log(
 			"level", 1,
@@ -101,6 +106,19 @@ func (p *TCPProxy) Proxy(w io.Writer, r io.ReadCloser, msg *proto.ControlMessage
 		)
 	}
 
+	if p.ProxyProtocol != 0 {
+		if err := writeProxyHeader(local, p.ProxyProtocol, msg.RemoteAddr, msg.LocalAddr); err != nil {
+			p.logger.Log(
+				"level", 0,
+				"msg", "PROXY protocol header write failed",
+				"target", target,
+				"ctrlMsg", msg,
+				"err", err,
+			)
+			return
+		}
+	}
+
 	done := make(chan struct{})
 	go func() {
 		transfer(flushWriter{w}, local, log.NewContext(p.logger).With(
@@ -115,34 +133,52 @@ func (p *TCPProxy) Proxy(w io.Writer, r io.ReadCloser, msg *proto.ControlMessage
 		"src", msg.ForwardedHost,
 	))
 
+	// let local service know there is nothing more to read so that the
+	// stream finishes when it closes the connection
+	if c, ok := local.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+	}
+
 	<-done
 }
 
-func (p *TCPProxy) localAddrFor(hostPort string) string {
-	if len(p.localAddrMap) == 0 {
-		return p.localAddr
+func (p *TCPProxy) localAddrFor(hostPort, tunnelHost string) string {
+	return lookupLocalAddr(p.localAddr, p.localAddrMap, hostPort, tunnelHost)
+}
+
+// lookupLocalAddr returns local address for hostPort from localAddrMap, see
+// TCPProxy for the order of precedence, localAddr is returned if nothing
+// matches.
+func lookupLocalAddr(localAddr string, localAddrMap map[string]string, hostPort, tunnelHost string) string {
+	if len(localAddrMap) == 0 {
+		return localAddr
 	}
 
 	// try hostPort
-	if addr := p.localAddrMap[hostPort]; addr != "" {
+	if addr := localAddrMap[hostPort]; addr != "" {
 		return addr
 	}
 
 	// try port
 	host, port, _ := net.SplitHostPort(hostPort)
-	if addr := p.localAddrMap[port]; addr != "" {
+	if addr := localAddrMap[port]; addr != "" {
 		return addr
 	}
 
 	// try 0.0.0.0:port
-	if addr := p.localAddrMap[fmt.Sprintf("0.0.0.0:%s", port)]; addr != "" {
+	if addr := localAddrMap[fmt.Sprintf("0.0.0.0:%s", port)]; addr != "" {
 		return addr
 	}
 
 	// try host
-	if addr := p.localAddrMap[host]; addr != "" {
+	if addr := localAddrMap[host]; addr != "" {
+		return addr
+	}
+
+	// try tunnel host i.e. wildcard
+	if addr := localAddrMap[tunnelHost]; tunnelHost != "" && addr != "" {
 		return addr
 	}
 
-	return p.localAddr
+	return localAddr
 }
@@ -11,4 +11,14 @@ var (
 	DefaultTimeout = 10 * time.Second
 	// DefaultPingTimeout specifies a ping timeout.
 	DefaultPingTimeout = 500 * time.Millisecond
+	// DefaultPingInterval specifies how often server pings connected
+	// clients to measure round trip time.
+	DefaultPingInterval = 30 * time.Second
+	// DefaultUDPIdleTimeout specifies how long UDP session can be idle
+	// before it's closed.
+	DefaultUDPIdleTimeout = 60 * time.Second
 )
+
+// MaxClientConns specifies how many control connections a client may open,
+// streams are distributed across them.
+const MaxClientConns = 16
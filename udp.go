@@ -0,0 +1,298 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// UDP datagrams are carried over streams as frames, a frame is a datagram
+// prefixed with its length as 16 bit big endian integer.
+const (
+	udpFrameHeaderSize = 2
+	udpMaxDatagramSize = 65535
+	// udpSessionQueueSize is number of datagrams buffered per session,
+	// datagrams exceeding it are dropped.
+	udpSessionQueueSize = 64
+)
+
+var errUDPClosed = errors.New("use of closed network connection")
+
+// writeUDPFrame writes datagram p as a single frame to w.
+func writeUDPFrame(w io.Writer, p []byte) error {
+	b := make([]byte, udpFrameHeaderSize+len(p))
+	binary.BigEndian.PutUint16(b, uint16(len(p)))
+	copy(b[udpFrameHeaderSize:], p)
+	_, err := w.Write(b)
+	return err
+}
+
+// readUDPFrame reads a single frame from r into buf and returns the datagram,
+// buf must be at least udpMaxDatagramSize long.
+func readUDPFrame(r io.Reader, buf []byte) ([]byte, error) {
+	var h [udpFrameHeaderSize]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(h[:]))
+	if _, err := io.ReadFull(r, buf[:n]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// udpListener demultiplexes datagrams received on a PacketConn into sessions
+// by remote address, new sessions are returned by Accept. Sessions not
+// transferring data for idle time are closed.
+type udpListener struct {
+	pc   net.PacketConn
+	idle time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]*udpSession
+
+	accept    chan *udpSession
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newUDPListener(pc net.PacketConn, idle time.Duration) *udpListener {
+	l := &udpListener{
+		pc:       pc,
+		idle:     idle,
+		sessions: make(map[string]*udpSession),
+		accept:   make(chan *udpSession),
+		closed:   make(chan struct{}),
+	}
+	go l.serve()
+	go l.expire()
+
+	return l
+}
+
+func (l *udpListener) serve() {
+	buf := make([]byte, udpMaxDatagramSize)
+	for {
+		n, addr, err := l.pc.ReadFrom(buf)
+		if err != nil {
+			l.Close()
+			return
+		}
+
+		s, ok := l.session(addr)
+		s.push(append([]byte(nil), buf[:n]...))
+		if ok {
+			continue
+		}
+
+		select {
+		case l.accept <- s:
+		case <-l.closed:
+			return
+		}
+	}
+}
+
+// session returns session of remote address addr creating it if needed, ok is
+// false if the session was created.
+func (l *udpListener) session(addr net.Addr) (s *udpSession, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := addr.String()
+	if s, ok = l.sessions[key]; ok {
+		return
+	}
+
+	s = &udpSession{
+		l:      l,
+		addr:   addr,
+		in:     make(chan []byte, udpSessionQueueSize),
+		last:   time.Now(),
+		closed: make(chan struct{}),
+	}
+	l.sessions[key] = s
+
+	return
+}
+
+func (l *udpListener) remove(s *udpSession) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.sessions[s.addr.String()] == s {
+		delete(l.sessions, s.addr.String())
+	}
+}
+
+func (l *udpListener) expire() {
+	t := time.NewTicker(l.idle / 2)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+		case <-l.closed:
+			return
+		}
+
+		var expired []*udpSession
+		l.mu.Lock()
+		for _, s := range l.sessions {
+			if s.idle() > l.idle {
+				expired = append(expired, s)
+			}
+		}
+		l.mu.Unlock()
+
+		for _, s := range expired {
+			s.Close()
+		}
+	}
+}
+
+// Accept waits for and returns the next session.
+func (l *udpListener) Accept() (net.Conn, error) {
+	select {
+	case s := <-l.accept:
+		return s, nil
+	case <-l.closed:
+		return nil, errUDPClosed
+	}
+}
+
+// Close closes the listener and all sessions.
+func (l *udpListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		err = l.pc.Close()
+
+		l.mu.Lock()
+		sessions := make([]*udpSession, 0, len(l.sessions))
+		for _, s := range l.sessions {
+			sessions = append(sessions, s)
+		}
+		l.mu.Unlock()
+
+		for _, s := range sessions {
+			s.Close()
+		}
+	})
+	return err
+}
+
+// Addr returns the listener network address.
+func (l *udpListener) Addr() net.Addr {
+	return l.pc.LocalAddr()
+}
+
+// udpSession is net.Conn reading and writing framed datagrams exchanged with
+// a single remote address.
+type udpSession struct {
+	l    *udpListener
+	addr net.Addr
+	in   chan []byte
+
+	// rbuf holds framed datagram not yet returned by Read.
+	rbuf []byte
+	// wbuf holds incomplete frame written by Write.
+	wbuf []byte
+
+	mu   sync.Mutex
+	last time.Time
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (s *udpSession) push(p []byte) {
+	s.touch()
+	select {
+	case s.in <- p:
+	default:
+		// drop datagram like a full socket buffer would
+	}
+}
+
+func (s *udpSession) touch() {
+	s.mu.Lock()
+	s.last = time.Now()
+	s.mu.Unlock()
+}
+
+func (s *udpSession) idle() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Since(s.last)
+}
+
+// Read reads framed datagrams.
+func (s *udpSession) Read(p []byte) (int, error) {
+	if len(s.rbuf) == 0 {
+		select {
+		case d := <-s.in:
+			s.rbuf = make([]byte, udpFrameHeaderSize+len(d))
+			binary.BigEndian.PutUint16(s.rbuf, uint16(len(d)))
+			copy(s.rbuf[udpFrameHeaderSize:], d)
+		case <-s.closed:
+			return 0, io.EOF
+		}
+	}
+
+	n := copy(p, s.rbuf)
+	s.rbuf = s.rbuf[n:]
+
+	return n, nil
+}
+
+// Write writes framed datagrams, every complete frame is sent to the remote
+// address.
+func (s *udpSession) Write(p []byte) (int, error) {
+	select {
+	case <-s.closed:
+		return 0, errUDPClosed
+	default:
+	}
+
+	s.wbuf = append(s.wbuf, p...)
+	for len(s.wbuf) >= udpFrameHeaderSize {
+		n := udpFrameHeaderSize + int(binary.BigEndian.Uint16(s.wbuf))
+		if len(s.wbuf) < n {
+			break
+		}
+		if _, err := s.l.pc.WriteTo(s.wbuf[udpFrameHeaderSize:n], s.addr); err != nil {
+			return 0, err
+		}
+		s.touch()
+		s.wbuf = s.wbuf[n:]
+	}
+
+	return len(p), nil
+}
+
+// Close closes the session, the remote address would start a new session when
+// sending next datagram.
+func (s *udpSession) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		s.l.remove(s)
+	})
+	return nil
+}
+
+func (s *udpSession) LocalAddr() net.Addr                { return s.l.pc.LocalAddr() }
+func (s *udpSession) RemoteAddr() net.Addr               { return s.addr }
+func (s *udpSession) SetDeadline(t time.Time) error      { return nil }
+func (s *udpSession) SetReadDeadline(t time.Time) error  { return nil }
+func (s *udpSession) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,177 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/log"
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+// Backoff of reads from local socket after errors, persistent errors must not
+// make the read loop spin.
+const (
+	udpReadMinBackoff = 10 * time.Millisecond
+	udpReadMaxBackoff = time.Second
+)
+
+// UDPProxy forwards UDP datagrams, every stream is a session of a single
+// remote address and is forwarded from a dedicated local socket.
+type UDPProxy struct {
+	// localAddr specifies default UDP address of the local server.
+	localAddr string
+	// localAddrMap specifies mapping from ControlMessage.ForwardedHost to
+	// local server address, keys may contain host and port, only host or
+	// only port. The order of precedence is the same as in TCPProxy.
+	localAddrMap map[string]string
+	// logger is the proxy logger.
+	logger log.Logger
+}
+
+// NewUDPProxy creates new direct UDPProxy, everything will be proxied to
+// localAddr.
+func NewUDPProxy(localAddr string, logger log.Logger) *UDPProxy {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+
+	return &UDPProxy{
+		localAddr: localAddr,
+		logger:    logger,
+	}
+}
+
+// NewMultiUDPProxy creates a new dispatching UDPProxy, sessions may go to
+// different backends based on localAddrMap.
+func NewMultiUDPProxy(localAddrMap map[string]string, logger log.Logger) *UDPProxy {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+
+	return &UDPProxy{
+		localAddrMap: localAddrMap,
+		logger:       logger,
+	}
+}
+
+// Proxy is a ProxyFunc.
+func (p *UDPProxy) Proxy(w io.Writer, r io.ReadCloser, msg *proto.ControlMessage) {
+	if msg.ForwardedProto != proto.UDP {
+		p.logger.Log(
+			"level", 0,
+			"msg", "unsupported protocol",
+			"ctrlMsg", msg,
+		)
+		return
+	}
+
+	target := lookupLocalAddr(p.localAddr, p.localAddrMap, msg.ForwardedHost, msg.TunnelHost)
+	if target == "" {
+		p.logger.Log(
+			"level", 1,
+			"msg", "no target",
+			"ctrlMsg", msg,
+		)
+		return
+	}
+
+	local, err := net.DialTimeout("udp", target, DefaultTimeout)
+	if err != nil {
+		p.logger.Log(
+			"level", 0,
+			"msg", "dial failed",
+			"target", target,
+			"ctrlMsg", msg,
+			"err", err,
+		)
+		return
+	}
+	defer local.Close()
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		buf := make([]byte, udpMaxDatagramSize)
+		var backoff time.Duration
+		for {
+			n, err := local.Read(buf)
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				// i.e. connection refused reported by ICMP, keep
+				// reading until the session ends
+				p.logger.Log(
+					"level", 2,
+					"msg", "read from local failed",
+					"target", target,
+					"err", err,
+				)
+
+				if backoff *= 2; backoff == 0 {
+					backoff = udpReadMinBackoff
+				} else if backoff > udpReadMaxBackoff {
+					backoff = udpReadMaxBackoff
+				}
+				select {
+				case <-stop:
+					return
+				case <-time.After(backoff):
+				}
+				continue
+			}
+			backoff = 0
+
+			if err := writeUDPFrame(flushWriter{w}, buf[:n]); err != nil {
+				p.logger.Log(
+					"level", 2,
+					"msg", "write to remote failed",
+					"dst", msg.ForwardedHost,
+					"err", err,
+				)
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, udpMaxDatagramSize)
+	for {
+		d, err := readUDPFrame(r, buf)
+		if err != nil {
+			if err != io.EOF {
+				p.logger.Log(
+					"level", 2,
+					"msg", "read from remote failed",
+					"src", msg.ForwardedHost,
+					"err", err,
+				)
+			}
+			break
+		}
+		if _, err := local.Write(d); err != nil {
+			p.logger.Log(
+				"level", 2,
+				"msg", "write to local failed",
+				"target", target,
+				"err", err,
+			)
+		}
+	}
+
+	close(stop)
+	local.Close()
+	<-done
+}
@@ -5,15 +5,22 @@
 package tunnel
 
 import (
+	"bufio"
+	"errors"
 	"io"
 	"net"
 	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http/httpguts"
 
 	"github.com/mmatczuk/go-http-tunnel/log"
 )
 
-func transfer(dst io.Writer, src io.Reader, logger log.Logger) {
+func transfer(dst io.Writer, src io.Reader, logger log.Logger) int64 {
 	n, err := io.Copy(dst, src)
 	if err != nil {
 		if !strings.Contains(err.Error(), "context canceled") && !strings.Contains(err.Error(), "CANCEL") {
@@ -30,6 +37,8 @@ func transfer(dst io.Writer, src io.Reader, logger log.Logger) {
 		"action", "transferred",
 		"bytes", n,
 	)
+
+	return n
 }
 
 func setXForwardedFor(h http.Header, remoteAddr string) {
@@ -45,6 +54,49 @@ func setXForwardedFor(h http.Header, remoteAddr string) {
 	}
 }
 
+// upgradeType returns protocol requested in Upgrade header if h is header of
+// a connection upgrade request or response i.e. WebSocket handshake.
+func upgradeType(h http.Header) string {
+	if !httpguts.HeaderValuesContainsToken(h["Connection"], "Upgrade") {
+		return ""
+	}
+	return h.Get("Upgrade")
+}
+
+// hopHeaders are hop-by-hop headers, they must not be passed in HTTP/2
+// requests.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders removes hop-by-hop headers and headers listed in
+// Connection header from h, "TE: trailers" required by gRPC is kept.
+func removeHopHeaders(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, k := range strings.Split(v, ",") {
+			if k = strings.TrimSpace(k); k != "" {
+				h.Del(k)
+			}
+		}
+	}
+
+	trailers := httpguts.HeaderValuesContainsToken(h["Te"], "trailers")
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
+	if trailers {
+		h.Set("Te", "trailers")
+	}
+}
+
 func cloneHeader(h http.Header) http.Header {
 	h2 := make(http.Header, len(h))
 	for k, vv := range h {
@@ -74,6 +126,42 @@ func (cw *countWriter) Write(p []byte) (n int, err error) {
 	return
 }
 
+// doneReader calls done with number of bytes read when closed.
+type doneReader struct {
+	io.ReadCloser
+	count int64
+	once  sync.Once
+	done  func(count int64)
+}
+
+func (r *doneReader) Read(p []byte) (n int, err error) {
+	n, err = r.ReadCloser.Read(p)
+	r.count += int64(n)
+	return
+}
+
+func (r *doneReader) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(func() { r.done(r.count) })
+	return err
+}
+
+// countingReadCloser counts bytes read, count is safe to access concurrently.
+type countingReadCloser struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReadCloser) Read(p []byte) (n int, err error) {
+	n, err = r.ReadCloser.Read(p)
+	atomic.AddInt64(&r.n, int64(n))
+	return
+}
+
+func (r *countingReadCloser) count() int64 {
+	return atomic.LoadInt64(&r.n)
+}
+
 type flushWriter struct {
 	w io.Writer
 }
@@ -85,3 +173,124 @@ func (fw flushWriter) Write(p []byte) (n int, err error) {
 	}
 	return
 }
+
+// latencyWriter flushes w at most latency after a write, it must be stopped
+// when no longer used.
+type latencyWriter struct {
+	w       io.Writer
+	latency time.Duration
+
+	mu      sync.Mutex
+	t       *time.Timer
+	pending bool
+}
+
+func newLatencyWriter(w io.Writer, latency time.Duration) *latencyWriter {
+	return &latencyWriter{
+		w:       w,
+		latency: latency,
+	}
+}
+
+func (lw *latencyWriter) Write(p []byte) (n int, err error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+
+	n, err = lw.w.Write(p)
+	if lw.pending {
+		return
+	}
+	if lw.t == nil {
+		lw.t = time.AfterFunc(lw.latency, lw.flush)
+	} else {
+		lw.t.Reset(lw.latency)
+	}
+	lw.pending = true
+
+	return
+}
+
+func (lw *latencyWriter) flush() {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+
+	if !lw.pending {
+		return
+	}
+	if f, ok := lw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	lw.pending = false
+}
+
+func (lw *latencyWriter) stop() {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+
+	lw.pending = false
+	if lw.t != nil {
+		lw.t.Stop()
+	}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// upgradeBody is body of a switching protocols response, it's read and
+// written until closed.
+type upgradeBody struct {
+	io.Reader
+	io.Writer
+	once  sync.Once
+	close func() error
+	err   error
+}
+
+func (b *upgradeBody) Close() error {
+	b.once.Do(func() { b.err = b.close() })
+	return b.err
+}
+
+// statusWriter records status code and number of bytes of response written
+// to http.ResponseWriter.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	n      int64
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 && (code >= 200 || code == http.StatusSwitchingProtocols) {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(p []byte) (n int, err error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err = w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection can not be hijacked")
+	}
+	return hj.Hijack()
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}